@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/gw2api"
+)
+
+const (
+	// roleSlotAccess binds the role of the access after the colon
+	roleSlotAccess = "access:"
+
+	// accessFreeToPlay is given to members whose verified accounts are all free to play accounts
+	accessFreeToPlay = "FreeToPlay"
+)
+
+// accessChoices are the accesses that can get a role, with their names on the dashboard
+var accessChoices = []struct {
+	Access string
+	Name   string
+}{
+	{Access: accessFreeToPlay, Name: "Free to play"},
+	{Access: gw2api.AccessGuildWars2, Name: "Guild Wars 2"},
+	{Access: gw2api.AccessHeartOfThorns, Name: "Heart of Thorns"},
+	{Access: gw2api.AccessPathOfFire, Name: "Path of Fire"},
+	{Access: gw2api.AccessEndOfDragons, Name: "End of Dragons"},
+}
+
+// accessRole is a role for everyone with the game or expansion on one of their verified accounts
+type accessRole struct {
+	Access string `json:"access"`
+	// RoleID is the bound discord role, the role is found or created by Name if it is empty.
+	// Name defaults to the name of the access
+	RoleID string `json:"role"`
+	Name   string `json:"name"`
+}
+
+// name returns the name of a new role of the access
+func (r accessRole) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	for _, choice := range accessChoices {
+		if choice.Access == r.Access {
+			return choice.Name
+		}
+	}
+	return r.Access
+}
+
+func accessRoleSlot(access string) string {
+	return roleSlotAccess + access
+}
+
+// memberAccess returns the accesses of the accounts, including accessFreeToPlay if every account is a free to play account
+func memberAccess(accounts []worldWithRank) (access []string) {
+	freeToPlay := len(accounts) > 0
+	for _, account := range accounts {
+		for _, a := range account.Access {
+			if indexOfString(a, access) == -1 {
+				access = append(access, a)
+			}
+		}
+		freeToPlay = freeToPlay && account.FreeToPlay
+	}
+	if freeToPlay {
+		access = append(access, accessFreeToPlay)
+	}
+	return
+}
+
+// planAccessRoles finds the roles of the accesses and remembers them for assignManagedRoles.
+// The roles of the other accesses are removed with a matching reason
+func planAccessRoles(options *guildOptions, access []string, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (managedRoles []guildRole) {
+	for _, r := range options.AccessRoles {
+		if r.RoleID != "" {
+			plan.setRemoveReason(r.RoleID, "gw2 access changed")
+		}
+		if indexOfString(r.Access, access) == -1 {
+			continue
+		}
+		var roleID string
+		roleID, roles = findSlotRole(accessRoleSlot(r.Access), r.name(), roles, guildRoles, plan)
+		plan.verifiedRoleIDs = append(plan.verifiedRoleIDs, roleID)
+		plan.setReason(roleID, "gw2 access "+r.Access)
+	}
+	return roles
+}
+
+// validateAccessRoles checks that every access role is a known access with a role the bot can assign
+func validateAccessRoles(guildID string, options *guildOptions) (err error) {
+	var seen []string
+	for _, r := range options.AccessRoles {
+		known := false
+		for _, choice := range accessChoices {
+			known = known || choice.Access == r.Access
+		}
+		if !known {
+			return errors.New("unknown access of access roles")
+		}
+		if indexOfString(r.Access, seen) != -1 {
+			return errors.New("every access can only have one role")
+		}
+		seen = append(seen, r.Access)
+		if len(r.Name) > maxRoleNameLength {
+			return errors.New("role names can not be longer than 100 characters")
+		}
+		if r.RoleID != "" {
+			role, erro := dg.State.Role(guildID, r.RoleID)
+			if erro != nil || !assignableRole(guildID, role) {
+				return errors.New("the chosen roles have to be roles of this discord server that the bot can assign")
+			}
+		}
+	}
+	return
+}
+
+// getAccessChoices lists the accesses that can get a role for the dashboard
+func getAccessChoices(active string) (st []serversTemplate) {
+	for _, choice := range accessChoices {
+		st = append(st, serversTemplate{
+			ID:     choice.Access,
+			Name:   choice.Name,
+			Active: choice.Access == active,
+		})
+	}
+	return
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// apiPrefix is the path all api endpoints are served under
+	apiPrefix = "/api/v1/"
+
+	// maxAPIBodySize limits the size of request bodies
+	maxAPIBodySize = 64 * 1024
+)
+
+// guildVerifies holds the discord servers that are verified as a whole right now
+var guildVerifies sync.Map
+
+// apiError is the body of every failed api request
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiGuild is a discord server the caller can manage
+type apiGuild struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// apiRole is a role the bot manages on a discord server
+type apiRole struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// apiMember is a member of a discord server with at least one managed role
+type apiMember struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+	// Worlds and Teams are taken from the cached accounts of the member and can be empty
+	Worlds []int `json:"worlds"`
+	Teams  []int `json:"teams"`
+}
+
+// apiVerifyJob summarizes a verification of a whole discord server
+type apiVerifyJob struct {
+	// Queued members have an api key and are updated by the regular update workers
+	Queued int `json:"queued"`
+	// Skipped members have no api key or are bots, they are left unchanged
+	Skipped int `json:"skipped"`
+}
+
+// apiRequest is an authenticated api request
+type apiRequest struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	userID  string
+	servers []discordgo.UserGuild
+}
+
+// handleAPI serves the json api. The endpoints are described in templates/openapi.json
+// nolint: gocyclo
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+
+	req, ok := authenticateAPI(w, r)
+	if !ok {
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "worlds":
+		if req.allowMethods(http.MethodGet) {
+			req.getWorlds()
+		}
+	case len(path) == 1 && path[0] == "guilds":
+		if req.allowMethods(http.MethodGet) {
+			req.getGuilds()
+		}
+	case len(path) >= 3 && path[0] == "guilds":
+		if !checkUserIsMember(path[1], req.servers) {
+			writeAPIError(w, http.StatusForbidden, "you are missing permissions to manage roles on this server")
+			return
+		}
+		req.handleGuild(path[1], path[2:])
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleGuild serves the endpoints of a single discord server
+func (req apiRequest) handleGuild(guildID string, path []string) {
+	switch {
+	case len(path) == 1 && path[0] == "settings":
+		if !req.allowMethods(http.MethodGet, http.MethodPut) {
+			return
+		}
+		if req.r.Method == http.MethodPut {
+			req.putSettings(guildID)
+			return
+		}
+		req.getSettings(guildID)
+	case len(path) == 1 && path[0] == "roles":
+		if req.allowMethods(http.MethodGet) {
+			req.getRoles(guildID)
+		}
+	case len(path) == 1 && path[0] == "members":
+		if req.allowMethods(http.MethodGet) {
+			req.getMembers(guildID)
+		}
+	case len(path) == 1 && path[0] == "verify":
+		if req.allowMethods(http.MethodPost) {
+			req.verifyGuild(guildID)
+		}
+	case len(path) == 3 && path[0] == "members" && path[2] == "verify":
+		if req.allowMethods(http.MethodPost) {
+			req.verifyMember(guildID, path[1])
+		}
+	default:
+		writeAPIError(req.w, http.StatusNotFound, "not found")
+	}
+}
+
+// authenticateAPI authenticates the request with the dashboard session or a discord oauth token sent as bearer token.
+// Changes with the dashboard session also need the csrf token of the session in the X-CSRF-Token header
+func authenticateAPI(w http.ResponseWriter, r *http.Request) (req apiRequest, ok bool) {
+	req = apiRequest{w: w, r: r}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		user, err := internalGetDiscordUser(token)
+		if err != nil || user == nil {
+			writeAPIError(w, http.StatusUnauthorized, "invalid discord token")
+			return
+		}
+		req.userID = user.ID
+		req.servers, err = getDiscordServersOfToken(token)
+		if err != nil {
+			loglevels.Errorf("Error getting guilds for user %v: %v\n", user.ID, err)
+			writeAPIError(w, http.StatusBadGateway, "the discord api is currently down")
+			return
+		}
+		return req, true
+	}
+
+	session, err := getSession(w, r)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "log in to the dashboard or send a discord token")
+		return
+	}
+	if r.Method != http.MethodGet && !session.checkCSRF(r) {
+		writeAPIError(w, http.StatusForbidden, "invalid csrf token")
+		return
+	}
+	req.userID = session.UserID
+	req.servers, err = getDiscordServers(session.UserID)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "the discord api is currently down")
+		return
+	}
+	return req, true
+}
+
+// allowMethods writes an error if the request method is not one of methods
+func (req apiRequest) allowMethods(methods ...string) bool {
+	if indexOfString(req.r.Method, methods) >= 0 {
+		return true
+	}
+	req.w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(req.w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func (req apiRequest) getWorlds() {
+	worlds := make([]*linkInfo, 0, len(currentWorlds))
+	for _, world := range currentWorlds {
+		worlds = append(worlds, world)
+	}
+	sort.Slice(worlds, func(i, j int) bool { return worlds[i].ID < worlds[j].ID })
+	writeAPIResponse(req.w, http.StatusOK, worlds)
+}
+
+func (req apiRequest) getGuilds() {
+	guilds := make([]apiGuild, 0, len(req.servers))
+	for _, server := range req.servers {
+		if checkUserIsMember(server.ID, req.servers) {
+			guilds = append(guilds, apiGuild{ID: server.ID, Name: server.Name})
+		}
+	}
+	writeAPIResponse(req.w, http.StatusOK, guilds)
+}
+
+// getSettings responds with the settings of the discord server. The api key is never sent back
+func (req apiRequest) getSettings(guildID string) {
+	options, err := getGuildSettings(guildID)
+	if err != nil {
+		writeAPIError(req.w, http.StatusInternalServerError, "unexpected error while loading the settings")
+		return
+	}
+	options.Gw2AccountKey = ""
+	writeAPIResponse(req.w, http.StatusOK, options)
+}
+
+// putSettings replaces the settings of the discord server. A missing api key or missing world roles keep the saved ones
+func (req apiRequest) putSettings(guildID string) {
+	options := &guildOptions{}
+	if err := json.NewDecoder(http.MaxBytesReader(req.w, req.r.Body, maxAPIBodySize)).Decode(options); err != nil {
+		writeAPIError(req.w, http.StatusBadRequest, "invalid settings: "+err.Error())
+		return
+	}
+
+	saved, err := getGuildSettings(guildID)
+	if err != nil {
+		writeAPIError(req.w, http.StatusInternalServerError, "unexpected error while loading the settings")
+		return
+	}
+	if options.Gw2AccountKey == "" {
+		options.Gw2AccountKey = saved.Gw2AccountKey
+	}
+	keepRoleBindings(guildID, options)
+
+	if err = validateGuildOptions(guildID, options); err != nil {
+		writeAPIError(req.w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if err = saveGuildSettings(guildID, options); err != nil {
+		writeAPIError(req.w, http.StatusInternalServerError, "unexpected error while saving the settings")
+		return
+	}
+	loglevels.Infof("settings saved with the api by user %v for guild %v\n", req.userID, guildID)
+	go updateVerificationMessage(guildID, saved.VerificationChannelID)
+
+	options.Gw2AccountKey = ""
+	writeAPIResponse(req.w, http.StatusOK, options)
+}
+
+func (req apiRequest) getRoles(guildID string) {
+	guild, err := dg.State.Guild(guildID)
+	if err != nil {
+		writeAPIError(req.w, http.StatusNotFound, "the bot is not on this server")
+		return
+	}
+	managed, err := getGuildRoles(guildID, guild.Roles)
+	if err != nil {
+		writeAPIError(req.w, http.StatusInternalServerError, "unexpected error while loading the roles")
+		return
+	}
+
+	roles := make([]apiRole, 0, len(managed))
+	for _, role := range managed {
+		roles = append(roles, apiRole{ID: role.ID, Name: role.Name})
+	}
+	writeAPIResponse(req.w, http.StatusOK, roles)
+}
+
+// getMembers responds with every member that has a role managed by the bot
+func (req apiRequest) getMembers(guildID string) {
+	guild, err := dg.State.Guild(guildID)
+	if err != nil {
+		writeAPIError(req.w, http.StatusNotFound, "the bot is not on this server")
+		return
+	}
+	managed, err := getGuildRoles(guildID, guild.Roles)
+	if err != nil {
+		writeAPIError(req.w, http.StatusInternalServerError, "unexpected error while loading the roles")
+		return
+	}
+	roleNames := make(map[string]string, len(managed))
+	for _, role := range managed {
+		roleNames[role.ID] = role.Name
+	}
+
+	dg.State.RLock()
+	guildMembers := make([]*discordgo.Member, len(guild.Members))
+	copy(guildMembers, guild.Members)
+	dg.State.RUnlock()
+
+	members := make([]apiMember, 0)
+	for _, m := range guildMembers {
+		member := apiMember{
+			ID:     m.User.ID,
+			Name:   m.User.Username,
+			Roles:  []string{},
+			Worlds: []int{},
+			Teams:  []int{},
+		}
+		if m.Nick != "" {
+			member.Name = m.Nick
+		}
+		for _, roleID := range m.Roles {
+			if name, ok := roleNames[roleID]; ok {
+				member.Roles = append(member.Roles, name)
+			}
+		}
+		if len(member.Roles) == 0 {
+			continue
+		}
+		member.Worlds, member.Teams = getCachedWorlds(m.User.ID)
+		members = append(members, member)
+	}
+	writeAPIResponse(req.w, http.StatusOK, members)
+}
+
+// getCachedWorlds returns the worlds and teams of the cached accounts of the user without requesting the gw2 api
+func getCachedWorlds(userID string) (worlds, teams []int) {
+	worlds, teams = []int{}, []int{}
+	keys, err := getAPIKeys(userID)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		accountString, err := database.GetCache("gw2Account" + hashKey(key))
+		if err != nil {
+			continue
+		}
+		var account gw2api.Account
+		if err = json.Unmarshal([]byte(accountString), &account); err != nil || account.ID == "" {
+			continue
+		}
+		if indexOfInt(account.World, worlds) < 0 {
+			worlds = append(worlds, account.World)
+		}
+
+		team := account.WvW.TeamID
+		var wvw gw2api.AccountWvW
+		if wvwString, erro := database.GetCache("gw2AccountWvW" + hashKey(key)); erro == nil {
+			if erro = json.Unmarshal([]byte(wvwString), &wvw); erro == nil && wvw.Team != 0 {
+				team = wvw.Team
+			}
+		}
+		if team != 0 && indexOfInt(team, teams) < 0 {
+			teams = append(teams, team)
+		}
+	}
+	return
+}
+
+// verifyMember updates a single member right away
+func (req apiRequest) verifyMember(guildID, userID string) {
+	member, err := getMember(guildID, userID)
+	if err != nil {
+		writeAPIError(req.w, http.StatusNotFound, "the user is not on this server")
+		return
+	}
+
+	err = updateUserInGuild(req.r.Context(), member, triggerAPI)
+	if _, notVerified := err.(notVerifiedError); notVerified {
+		// the roles of unverified members are updated as well, the user just has no account to verify
+		writeAPIError(req.w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(req.w, http.StatusBadGateway, err.Error())
+		return
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyGuild updates every member of the discord server in the background
+func (req apiRequest) verifyGuild(guildID string) {
+	guild, err := dg.State.Guild(guildID)
+	if err != nil {
+		writeAPIError(req.w, http.StatusNotFound, "the bot is not on this server")
+		return
+	}
+	if _, running := guildVerifies.LoadOrStore(guildID, struct{}{}); running {
+		writeAPIError(req.w, http.StatusConflict, "this server is already being verified")
+		return
+	}
+
+	dg.State.RLock()
+	userIDs := make([]string, 0, len(guild.Members))
+	for _, member := range guild.Members {
+		if !member.User.Bot {
+			userIDs = append(userIDs, member.User.ID)
+		}
+	}
+	skipped := len(guild.Members) - len(userIDs)
+	dg.State.RUnlock()
+
+	// members without api key are left to the purge
+	var users []string
+	for _, userID := range userIDs {
+		keys, erro := getAPIKeys(userID)
+		if erro != nil || len(keys) == 0 {
+			skipped++
+			continue
+		}
+		users = append(users, userID)
+	}
+
+	loglevels.Infof("verifying %v members of guild %v requested by user %v\n", len(users), guildID, req.userID)
+	go queueMembers(stopping, guildID, users)
+	writeAPIResponse(req.w, http.StatusAccepted, apiVerifyJob{
+		Queued:  len(users),
+		Skipped: skipped,
+	})
+}
+
+// queueMembers queues the users for the update workers like the full updates do, until ctx is done
+func queueMembers(ctx context.Context, guildID string, users []string) {
+	defer guildVerifies.Delete(guildID)
+	for _, userID := range users {
+		select {
+		case updateUserChannel <- struct {
+			string
+			bool
+		}{string: userID, bool: false}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	loglevels.Infof("queued the members of guild %v\n", guildID)
+}
+
+// handleOpenAPI serves the description of the api next to the dashboard template
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, filepath.Join(filepath.Dir(config.TemplatePath), "openapi.json"))
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIResponse(w, status, apiError{Error: message})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		loglevels.Errorf("Error writing api response: %v\n", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// defaultAuditRetentionDays is used if config.AuditRetentionDays is not set
+	defaultAuditRetentionDays = 30
+
+	// auditDisplayLimit is the number of entries shown by the audit command and on the dashboard
+	auditDisplayLimit = 25
+
+	// auditSearchLimit is the number of entries searched when filtering the audit log by user
+	auditSearchLimit = 1000
+)
+
+// triggers of the changes in the audit log
+const (
+	triggerScheduled     = "scheduled update"
+	triggerUserRequest   = "user request"
+	triggerMemberJoin    = "member joined"
+	triggerVerifyCommand = "verify command"
+	triggerPurge         = "purge command"
+	triggerPreview       = "applied preview"
+	triggerAPI           = "api request"
+	triggerLinksChanged  = "linked worlds changed"
+)
+
+// actions in the audit log
+const (
+	auditRoleAdded   = "added role"
+	auditRoleRemoved = "removed role"
+	auditRoleCreated = "created role"
+	auditNickname    = "changed nickname"
+)
+
+// auditEntry is a single change the bot made on a discord server
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// UserID is empty for changes that don't belong to a member, like creating roles
+	UserID   string `json:"userId,omitempty"`
+	Action   string `json:"action"`
+	RoleID   string `json:"roleId,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	Reason   string `json:"reason"`
+	Trigger  string `json:"trigger"`
+	// By is the discord user that triggered the changes, if any
+	By string `json:"by,omitempty"`
+}
+
+// format describes the entry in one line, name returns how to show a user
+func (e auditEntry) format(name func(userID string) string) (line string) {
+	line = e.Time.UTC().Format("2006-01-02 15:04:05") + " "
+	if e.UserID != "" {
+		line += name(e.UserID) + " "
+	}
+	line += e.Action
+	if e.Role != "" {
+		line += " `" + e.Role + "`"
+	}
+	if e.Nickname != "" {
+		line += " to `" + e.Nickname + "`"
+	}
+	trigger := e.Trigger
+	if e.By != "" {
+		trigger += " by " + name(e.By)
+	}
+	return line + fmt.Sprintf(" (%v, %v)", e.Reason, trigger)
+}
+
+// mention shows users as discord mention
+func mention(userID string) string {
+	return "<@" + userID + ">"
+}
+
+// memberName shows users with their name on the discord server if they are still a member
+func memberName(guildID string) func(string) string {
+	return func(userID string) string {
+		member, err := dg.State.Member(guildID, userID)
+		if err != nil {
+			return userID
+		}
+		if member.Nick != "" {
+			return member.Nick
+		}
+		return member.User.Username
+	}
+}
+
+func auditRetention() time.Duration {
+	days := config.AuditRetentionDays
+	if days <= 0 {
+		days = defaultAuditRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// writeAuditLog saves the entries and sends them to the audit channel of the discord server if there is one
+func writeAuditLog(guildID string, options *guildOptions, entries []auditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	for _, entry := range entries {
+		entryBytes, err := json.Marshal(entry)
+		if err != nil {
+			loglevels.Errorf("Error marshaling audit entry: %v\n", err)
+			continue
+		}
+		err = database.AddAuditEntry(guildID, entry.Time, string(entryBytes), auditRetention())
+		if err != nil {
+			loglevels.Errorf("Error saving audit entry for guild %v: %v\n", guildID, err)
+		}
+	}
+
+	if options == nil || options.AuditChannelID == "" {
+		return
+	}
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		lines = append(lines, entry.format(mention))
+	}
+	for _, message := range splitMessage(lines, 2000) {
+		// don't ping everyone that got a role
+		_, err := dg.ChannelMessageSendComplex(options.AuditChannelID, &discordgo.MessageSend{
+			Content:         message,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			loglevels.Warningf("Error sending audit log to channel %v of guild %v: %v\n", options.AuditChannelID, guildID, err)
+			return
+		}
+	}
+}
+
+// getAuditLog returns up to limit entries of the discord server, newest first.
+// If userID is not empty, only entries of that user are returned
+func getAuditLog(guildID, userID string, limit int) (entries []auditEntry, err error) {
+	searchLimit := limit
+	if userID != "" {
+		searchLimit = auditSearchLimit
+	}
+	entryStrings, err := database.GetAuditEntries(guildID, searchLimit)
+	if err != nil {
+		loglevels.Errorf("Error getting audit log of guild %v: %v\n", guildID, err)
+		return
+	}
+
+	for _, entryString := range entryStrings {
+		var entry auditEntry
+		if erro := json.Unmarshal([]byte(entryString), &entry); erro != nil {
+			loglevels.Warningf("Error unmarshaling audit entry of guild %v: %v\n", guildID, erro)
+			continue
+		}
+		if userID != "" && entry.UserID != userID {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) >= limit {
+			break
+		}
+	}
+	return
+}
+
+// splitMessage joins the lines to messages of at most limit bytes, longer lines are cut
+func splitMessage(lines []string, limit int) (messages []string) {
+	message := ""
+	for _, line := range lines {
+		if len(line) > limit {
+			line = truncateRunes(line, limit)
+		}
+		if message != "" && len(message)+1+len(line) > limit {
+			messages = append(messages, message)
+			message = ""
+		}
+		if message != "" {
+			message += "\n"
+		}
+		message += line
+	}
+	if message != "" {
+		messages = append(messages, message)
+	}
+	return
+}
+
+// truncateRunes cuts the text to at most limit bytes without splitting a character
+func truncateRunes(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	for limit > 0 && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	return text[:limit]
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		limit    int
+		expected []string
+	}{
+		{"empty", nil, 10, nil},
+		{"one message", []string{"abc", "def"}, 10, []string{"abc\ndef"}},
+		{"split", []string{"abcd", "efgh", "ijkl"}, 10, []string{"abcd\nefgh", "ijkl"}},
+		{"long line", []string{"abcdefghijkl"}, 10, []string{"abcdefghij"}},
+		// ä is two bytes, the cut must not end inside of it
+		{"long line with multi byte characters", []string{"ääääää"}, 5, []string{"ää"}},
+		{"emoji", []string{"a🙂🙂"}, 6, []string{"a🙂"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := splitMessage(test.lines, test.limit)
+			if strings.Join(messages, "|") != strings.Join(test.expected, "|") || len(messages) != len(test.expected) {
+				t.Errorf("got %q, expected %q", messages, test.expected)
+			}
+			for _, message := range messages {
+				if len(message) > test.limit || !utf8.ValidString(message) {
+					t.Errorf("got invalid message %q", message)
+				}
+			}
+		})
+	}
+}
@@ -1,29 +1,31 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/greaka/discordwvwbot/gw2api"
 	"github.com/greaka/discordwvwbot/loglevels"
 
-	"github.com/gomodule/redigo/redis"
-
 	"github.com/bwmarrin/discordgo"
 )
 
 var (
 	// updateUserChannel holds discord user ids to update
-	updateUserChannel chan struct {
+	updateUserChannel = make(chan struct {
 		string
 		bool
-	}
-
-	bucket chan interface{}
+	}, 1000)
 
 	// dg holds the discord bot session
 	dg *discordgo.Session
 
+	// gw2Client sends all requests to the gw2 api
+	gw2Client *gw2api.Client
+
 	// currentWorlds holds the currently active worlds
 	currentWorlds map[int]*linkInfo
 
@@ -40,36 +42,34 @@ const (
 	// delayBetweenUsers holds the duration to wait before queueing up the next user to update in a full update cycle
 	/* 	gw2 api rate limit: 600 requests per minute
 	api keys to check per user (average): 3
-	600 / 3 = 200 users per minute
-	60/200 = 0.3s per user
+	requests per api key: 2 (/account and /account/wvw)
+	600 / 3 / 2 = 100 users per minute
+	60/100 = 0.6s per user
 	*/
-	delayBetweenUsers = 300 * time.Millisecond
+	delayBetweenUsers = 600 * time.Millisecond
 )
 
 // starting up the bot part
-func startBot() {
-	updateUserChannel = make(chan struct {
-		string
-		bool
-	}, 1000)
-	go fillBucket()
-
+// startBot connects to discord and runs the updates until stopping is done.
+// Queued updates are still processed after stopping, until the queue is empty or work is done
+func startBot(stopping, work context.Context) {
 	var err error
 
 	dg.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsGuilds |
 		discordgo.IntentsGuildMembers |
-		discordgo.IntentsGuildMessages |
 		discordgo.IntentsDirectMessages)
 
 	// add event listener
 	dg.AddHandler(guildCreate)
 	dg.AddHandler(guildMemberAdd)
 	dg.AddHandler(messageReceive)
+	dg.AddHandler(interactionCreate)
 
 	// open the connection to listen for events
 	err = dg.Open()
 	if err != nil {
 		loglevels.Errorf("Error opening discord connection: %v\n", err)
+		fail(err)
 		return
 	}
 	defer func() {
@@ -79,39 +79,49 @@ func startBot() {
 	}()
 	loglevels.Info("Bot is now running")
 
+	registerSlashCommands()
+
 	statusListenTo()
 
 	// firing up the update cycle
-	go updater()
-
-	for i := 0; i < 4; i++ {
-		go updateCycle()
+	go updater(stopping)
+	go resetLinkedRoles(stopping)
+
+	var workers sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			updateCycle(stopping, work)
+		}()
 	}
-
-	updateCycle()
+	workers.Wait()
+	loglevels.Info("Finished all updates")
 }
 
-func fillBucket() {
-	bucket = make(chan interface{}, 600)
-	rate := time.Tick(time.Second)
-	for i := 0; i < 600; i++ {
-		bucket <- nil
-	}
+// updateCycle updates the queued users until stopping is done and the queue is empty
+func updateCycle(stopping, work context.Context) {
+	// waiting for userids to update
 	for {
-		<-rate
-		for i := 0; i < 10; i++ {
-			select {
-			case bucket <- nil:
-			default:
-			}
+		select {
+		case userID := <-updateUserChannel:
+			updateUser(work, userID)
+		case <-stopping.Done():
+			drainUpdates(work)
+			return
 		}
 	}
 }
 
-func updateCycle() {
-	// waiting for userids to update
-	for {
-		updateUser(<-updateUserChannel)
+// drainUpdates updates the remaining queued users until the queue is empty or work is done
+func drainUpdates(work context.Context) {
+	for work.Err() == nil {
+		select {
+		case userID := <-updateUserChannel:
+			updateUser(work, userID)
+		default:
+			return
+		}
 	}
 }
 
@@ -119,17 +129,17 @@ func statusListenTo() {
 	text := config.HostURL
 	listenKind = !listenKind
 	if listenKind {
-		text = ".wvw help"
+		text = "/wvw help"
 	}
 	// update discord status to "listening to <hosturl>"
 	status := discordgo.UpdateStatusData{
 		Status:    string(discordgo.StatusOnline),
 		AFK:       false,
 		IdleSince: nil,
-		Game: &discordgo.Game{
+		Activities: []*discordgo.Activity{{
 			Name: text,
-			Type: 2,
-		},
+			Type: discordgo.ActivityTypeListening,
+		}},
 	}
 	statusUpdateError := dg.UpdateStatusComplex(status)
 	if statusUpdateError != nil {
@@ -144,10 +154,10 @@ func statusUpdateWorlds() {
 		Status:    string(discordgo.StatusOnline),
 		AFK:       false,
 		IdleSince: &now,
-		Game: &discordgo.Game{
+		Activities: []*discordgo.Activity{{
 			Name: "updating worlds",
-			Type: 0,
-		},
+			Type: discordgo.ActivityTypeGame,
+		}},
 	}
 	statusUpdateError := dg.UpdateStatusComplex(status)
 	if statusUpdateError != nil {
@@ -166,10 +176,10 @@ func statusUpdateUsers() {
 		Status:    string(discordgo.StatusOnline),
 		AFK:       false,
 		IdleSince: &now,
-		Game: &discordgo.Game{
+		Activities: []*discordgo.Activity{{
 			Name: text,
-			Type: 0,
-		},
+			Type: discordgo.ActivityTypeGame,
+		}},
 	}
 	statusUpdateError := dg.UpdateStatusComplex(status)
 	if statusUpdateError != nil {
@@ -177,22 +187,29 @@ func statusUpdateUsers() {
 	}
 }
 
-// updater commands updates. it starts world updates and full user updates
-func updater() {
-	updateCurrentWorlds()
-	updateAllUsers() // has to run here to set delayBetweenFullUpdates
+// updater commands updates. it starts world updates and full user updates until ctx is done
+func updater(ctx context.Context) {
+	loadWorldSnapshot()
+	updateCurrentWorlds(ctx)
+	// the world names are needed to find the world roles
+	migrateRoleBindings()
+	go updateVerificationMessages()
+	updateAllUsers(ctx) // has to run here to set delayBetweenFullUpdates
 	queueUserChannel := setDelay()
 	for {
 		// reset timer until next wvw reset update
 		worldsChannel := resetWorldUpdateTimer()
 		select {
 		case <-worldsChannel:
-			updateCurrentWorlds()
+			updateCurrentWorlds(ctx)
+			go updateVerificationMessages()
 			queueUserChannel = setDelay()
-			updateAllUsers()
+			updateAllUsers(ctx)
 		case <-queueUserChannel:
 			queueUserChannel = setDelay()
-			updateAllUsers()
+			updateAllUsers(ctx)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -249,23 +266,39 @@ func nextWorldReset() (nextReset time.Time) {
 }
 
 // updateAllUsers will send update requests for every user and will wait the set duration between requests
-func updateAllUsers() {
+func updateAllUsers(ctx context.Context) {
 	loglevels.Info("Updating all users...")
 	statusUpdateUsers()
-	redisConn := usersDatabase.Get()
-	defer closeConnection(redisConn)
-	iterateThroughUsers := time.Tick(delayBetweenUsers)
+	startRemovalCycle()
+	start := time.Now()
+	iterateThroughUsers := time.NewTicker(delayBetweenUsers)
+	defer iterateThroughUsers.Stop()
 	processValue := func(userID string) {
-		for len(updateUserChannel) > 10 {
-			<-iterateThroughUsers
+		for len(updateUserChannel) > 10 && ctx.Err() == nil {
+			select {
+			case <-iterateThroughUsers.C:
+			case <-ctx.Done():
+			}
 		}
-		updateUserChannel <- struct {
+		select {
+		case updateUserChannel <- struct {
 			string
 			bool
-		}{string: userID, bool: false}
+		}{string: userID, bool: false}:
+		case <-ctx.Done():
+		}
 	}
 
-	userCount = iterateDatabase(redisConn, processValue)
+	count, err := database.IterateUsers(processValue)
+	if err != nil {
+		loglevels.Errorf("Error iterating users: %v\n", err)
+	}
+	if ctx.Err() != nil {
+		loglevels.Info("Stopped updating all users")
+		return
+	}
+	userCount = count
+	lastFullUpdate = time.Since(start)
 	statusListenTo()
 	loglevels.Infof("Finished updating %v users", userCount)
 
@@ -276,84 +309,113 @@ func updateAllUsers() {
 
 // guildMemberAdd listens to new users joining a discord server
 func guildMemberAdd(_ *discordgo.Session, m *discordgo.GuildMemberAdd) {
-	_ = updateUserInGuild(m.Member)
+	_ = updateUserInGuild(context.Background(), m.Member, triggerMemberJoin)
 }
 
 // guildCreate listens to the bot getting added to discord servers
 // upon connecting to discord or after restoring the connection, the bot will receive this event for every server it is currently added to
 func guildCreate(s *discordgo.Session, m *discordgo.GuildCreate) {
-	erro := s.RequestGuildMembers(m.ID, "", 0, false)
+	erro := s.RequestGuildMembers(m.ID, "", 0, "", false)
 	if erro != nil {
 		loglevels.Errorf("Error requesting members for guild %v: %v", m.ID, erro)
 	}
 
-	redisConn := guildsDatabase.Get()
 	// only update when the guild is not already in the database
-	alreadyIn, err := redis.Int(redisConn.Do("EXISTS", m.ID))
+	alreadyIn, err := database.GuildExists(m.ID)
 	if err != nil {
-		loglevels.Errorf("Error checking if guild %v is in redis guilds: %v\n", m.ID, err)
+		loglevels.Errorf("Error checking if guild %v is in database guilds: %v\n", m.ID, err)
 		return
 	}
-	if alreadyIn == 0 {
-		err = saveNewGuild(redisConn, m.ID)
-		closeConnection(redisConn)
+	if !alreadyIn {
+		err = saveNewGuild(m.ID)
 		if err != nil {
-			loglevels.Errorf("Error adding guild %v to redis guilds: %v\n", m.ID, err)
+			loglevels.Errorf("Error adding guild %v to database guilds: %v\n", m.ID, err)
 			return
 		}
 		// updateAllUsers()
-	} else {
-		closeConnection(redisConn)
 	}
 }
 
 // updateCurrentWorlds updates the current world list
-func updateCurrentWorlds() {
+func updateCurrentWorlds(ctx context.Context) {
 	loglevels.Info("Updating worlds...")
 	statusUpdateWorlds()
 
-	worlds, err := getWorlds()
+	worlds, err := getWorlds(ctx)
 	if err != nil {
 		return
 	}
 
+	// the links are built aside, so that the previous links stay in use until the new ones are complete
+	var matches []gw2api.MatchOverview
+	var links map[int]*linkInfo
 	for {
-		matches, err := getCurrentMatches()
+		matches, err = getCurrentMatches(ctx)
 		if err != nil {
 			loglevels.Errorf("Error fetching current worlds: %v\n", err)
 			return
 		}
 
 		// reformat to custom projection
-		currentWorlds = make(map[int]*linkInfo)
+		links = make(map[int]*linkInfo)
 		for _, match := range matches {
-			processMatchColor(match.AllWorlds.Red)
-			processMatchColor(match.AllWorlds.Blue)
-			processMatchColor(match.AllWorlds.Green)
+			processMatchColor(links, match.ID, "red", match.AllWorlds.Red)
+			processMatchColor(links, match.ID, "blue", match.AllWorlds.Blue)
+			processMatchColor(links, match.ID, "green", match.AllWorlds.Green)
+		}
+
+		// since the world restructuring, teams play the matches instead of worlds
+		restructured := false
+		for id := range links {
+			if gw2api.IsTeam(id) {
+				restructured = true
+				break
+			}
 		}
 
 		inconsistent := false
 		for _, world := range worlds {
-			if world.ID > 10000 {
+			if gw2api.IsTeam(world.ID) {
+				if team, ok := links[world.ID]; ok {
+					team.Name = world.Name
+				}
 				continue
 			}
-			if _, ok := currentWorlds[world.ID]; !ok {
-				loglevels.Warningf("World %v not found in match data, trying again...", world.ID)
-				inconsistent = true
-				break
+			if _, ok := links[world.ID]; !ok {
+				if !restructured {
+					loglevels.Warningf("World %v not found in match data, trying again...", world.ID)
+					inconsistent = true
+					break
+				}
+				// worlds are not part of any match anymore, but accounts still have one
+				links[world.ID] = &linkInfo{
+					ID:     world.ID,
+					Linked: []int{world.ID},
+				}
+			}
+			links[world.ID].Name = world.Name
+		}
+		for id, team := range links {
+			if gw2api.IsTeam(id) && team.Name == "" {
+				team.Name = gw2api.TeamName(id)
 			}
-			currentWorlds[world.ID].Name = world.Name
 		}
 		if inconsistent {
-			delay := time.After(1 * time.Minute)
-			<-delay
+			select {
+			case <-time.After(1 * time.Minute):
+			case <-ctx.Done():
+				return
+			}
 		} else {
 			break
 		}
 	}
 
+	currentWorlds = links
+	worldsUpdated = time.Now()
 	statusListenTo()
 	loglevels.Info("Finished updating worlds")
+	saveWorldSnapshot(matches, links)
 
 	loglevels.Info("Current Links:")
 	var worldList [2]string
@@ -369,43 +431,48 @@ func updateCurrentWorlds() {
 	}
 	loglevels.Infof("%v", worldList[0])
 	loglevels.Infof("%v", worldList[1])
+
+	handleLinkChanges(ctx)
 }
 
-func processMatchColor(worlds []int) {
+func processMatchColor(links map[int]*linkInfo, match, color string, worlds []int) {
 	for _, world := range worlds {
-		if world > 10000 {
-			continue
-		}
-		if _, ok := currentWorlds[world]; !ok {
-			currentWorlds[world] = &linkInfo{
+		if _, ok := links[world]; !ok {
+			links[world] = &linkInfo{
 				ID:     world,
 				Linked: worlds,
+				Match:  match,
+				Color:  color,
 			}
 		}
 	}
 }
 
 // updateUser updates a single user on all discord servers
-func updateUser(userID struct {
+func updateUser(ctx context.Context, userID struct {
 	string
 	bool
 }) {
-	redisConn := guildsDatabase.Get()
-	defer closeConnection(redisConn)
-	data, err := getAccountData(userID)
+	data, err := getAccountData(ctx, userID)
+	trigger := triggerScheduled
+	if userID.bool {
+		trigger = triggerUserRequest
+	}
 	processGuild := func(guild string) {
-		member, erro := dg.State.Member(guild, userID.string)
+		member, erro := getMember(guild, userID.string)
 		if erro == nil {
-			_ = updateUserDataInGuild(member, data, err == nil, userID.bool)
+			_ = updateUserDataInGuild(ctx, member, data, err == nil && !removalsPaused(), userID.bool, trigger)
 		}
 	}
 
-	iterateDatabase(redisConn, processGuild)
+	if _, erro := database.IterateGuilds(processGuild); erro != nil {
+		loglevels.Errorf("Error iterating guilds for user %v: %v\n", userID.string, erro)
+	}
 }
 
 // getAccountData gets the gw2 account data for a specific discord user
 // nolint: gocyclo
-func getAccountData(userID struct {
+func getAccountData(ctx context.Context, userID struct {
 	string
 	bool
 }) (data gw2AccountData, err error) {
@@ -424,33 +491,52 @@ func getAccountData(userID struct {
 		i++
 		key := keys[i]
 		// get account data
-		account, erro := getCheckedGw2Account(key, userID)
-		if erro != nil {
-			err = erro
+		account, erro := getCheckedGw2Account(ctx, key, userID)
+		var wvw gw2api.AccountWvW
+		var permissions []string
+		checked := time.Now()
+		fresh := erro == nil
+		if !fresh {
+			// the last known data of the key stands in, so that the other accounts are not judged on incomplete data
+			known, ok := getLastKnownAccount(key)
+			if !ok {
+				err = erro
+				continue
+			}
+			account, wvw, permissions, checked = known.Account, known.WvW, known.Permissions, known.Checked
+		}
+		if account.ID == "" {
+			// the key got revoked
+			data.addRevoked(key)
 			continue
 		}
 
 		_, erro = checkUnique(account.ID, userID.string, false)
 		if erro != nil {
 			if erro.Error() == AlreadyTaken {
-				redisConn := usersDatabase.Get()
-				_, erro := redisConn.Do("SREM", userID.string, key)
-				closeConnection(redisConn)
-				if erro != nil {
-					loglevels.Errorf("Error deleting api key from redis: %v", erro)
-				}
+				_ = removeAPIKey(userID.string, key) // nolint: errcheck, gosec
 			}
 			continue
 		}
 
-		// add the name to the account names
-		data.Name += " | " + account.Name
-
-		// add world to users worlds
-		data.Worlds = append(data.Worlds, worldWithRank{
-			ID:   account.World,
-			rank: account.WvWRank,
-		})
+		if fresh {
+			if token, erro := getCachedGw2TokenInfo(ctx, key); erro == nil {
+				permissions = token.Permissions
+			} else if known, ok := getLastKnownAccount(key); ok {
+				permissions = known.Permissions
+			}
+			wvw, erro = getCachedGw2AccountWvW(ctx, key)
+			if erro == nil {
+				rememberAccount(key, account, wvw, permissions)
+			} else if known, ok := getLastKnownAccount(key); ok {
+				wvw = known.WvW
+			} else {
+				// keep the world, but don't remove roles based on the missing team or wvw guild
+				loglevels.Warningf("Error getting wvw info: %v\n", erro)
+				err = erro
+			}
+		}
+		data.addAccount(account, wvw, permissions, checked)
 	}
 	// strip the first " | ", on unexpected errors the name can still be empty
 	if len(data.Name) >= 3 {
@@ -459,27 +545,152 @@ func getAccountData(userID struct {
 	return
 }
 
+// getKnownAccountData gets the gw2 account data for a specific discord user from the last known data of the api keys.
+// Unlike getAccountData, it sends no requests and changes nothing, so that previews have no side effects.
+// err is set if one of the keys has no known data, like getAccountData does for failed requests
+func getKnownAccountData(userID string) (data gw2AccountData, err error) {
+	data = gw2AccountData{
+		Name:   "",
+		Worlds: []worldWithRank{},
+	}
+	keys, err := getAPIKeys(userID)
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		if key == deletedUserKey || !keyRevokedSince(key).IsZero() {
+			data.addRevoked(key)
+			continue
+		}
+		known, ok := getLastKnownAccount(key)
+		if !ok {
+			err = fmt.Errorf("no known data of an api key of user %v", userID)
+			continue
+		}
+		// accounts of other users are removed with the next update
+		if owner, erro := database.GetAccountOwner(known.Account.ID); erro == nil && owner != userID {
+			continue
+		}
+		data.addAccount(known.Account, known.WvW, known.Permissions, known.Checked)
+	}
+	if len(data.Name) >= 3 {
+		data.Name = data.Name[3:]
+	}
+	return
+}
+
+// addRevoked marks the data as revoked since the key stopped working, the earliest revoked key counts
+func (data *gw2AccountData) addRevoked(key string) {
+	if since := keyRevokedSince(key); !data.Revoked || since.Before(data.RevokedSince) {
+		data.RevokedSince = since
+	}
+	data.Revoked = true
+}
+
+// addAccount adds the account to the account names and worlds.
+// The permissions of the key are nil if they are not known, the key is not refused for them then
+func (data *gw2AccountData) addAccount(account gw2api.Account, wvw gw2api.AccountWvW, permissions []string, checked time.Time) {
+	if wvw.Team == 0 {
+		wvw.Team = account.WvW.TeamID
+	}
+
+	// add the name to the account names
+	data.Name += " | " + account.Name
+
+	var created time.Time
+	if account.Created != "" {
+		var err error
+		created, err = time.Parse(time.RFC3339, account.Created)
+		if err != nil {
+			loglevels.Warningf("Error parsing creation date %v of account %v: %v\n", account.Created, account.Name, err)
+		}
+	}
+
+	// add world to users worlds
+	data.Worlds = append(data.Worlds, worldWithRank{
+		ID:                 account.World,
+		rank:               account.Rank(),
+		Team:               wvw.Team,
+		WvWGuild:           wvw.Guild,
+		Account:            account.Name,
+		Guilds:             account.Guilds,
+		Access:             account.Access,
+		FreeToPlay:         account.FreeToPlay(),
+		Created:            created,
+		DailyAP:            account.DailyAP,
+		MonthlyAP:          account.MonthlyAP,
+		FractalLevel:       account.FractalLevel,
+		MissingProgression: permissions != nil && indexOfString("progression", permissions) == -1,
+		Checked:            checked,
+	})
+}
+
+// getMember returns a copy of the member from the state with the guild id set.
+// Members of the state are shared with the event handlers, so they must not be changed
+func getMember(guildID, userID string) (member *discordgo.Member, err error) {
+	stateMember, err := dg.State.Member(guildID, userID)
+	if err != nil {
+		return
+	}
+	dg.State.RLock()
+	copied := *stateMember
+	dg.State.RUnlock()
+	copied.GuildID = guildID
+	return &copied, nil
+}
+
 // updateUserInGuild gets the account data and updates the user on a specific discord server
-func updateUserInGuild(member *discordgo.Member) (err error) {
-	data, err := getAccountData(struct {
+func updateUserInGuild(ctx context.Context, member *discordgo.Member, trigger string) (err error) {
+	data, err := getAccountData(ctx, struct {
 		string
 		bool
 	}{string: member.User.ID, bool: true})
 
-	err = updateUserDataInGuild(member, data, err == nil, true)
+	err = updateUserDataInGuild(ctx, member, data, err == nil && !removalsPaused(), true, trigger)
 	return
 }
 
-// updateUserDataInGuild updates the user on a specific discord server
-func updateUserDataInGuild(member *discordgo.Member, data gw2AccountData, removeWorlds bool, renameUser bool) (err error) {
+// updateUserDataInGuild updates the user on a specific discord server.
+// The changes are computed as a plan and applied right away, so that they end up in the audit log
+func updateUserDataInGuild(ctx context.Context, member *discordgo.Member, data gw2AccountData, removeWorlds bool, renameUser bool, trigger string) (err error) {
 	options, err := getGuildSettings(member.GuildID)
 	if err != nil {
 		return
 	}
 
-	guildRoles, err := dg.GuildRoles(member.GuildID)
+	plan, err := newGuildPlan(member.GuildID, "", options)
+	if err != nil {
+		return
+	}
+	plan.Trigger = trigger
+
+	err = planUserDataInGuild(ctx, member, data, removeWorlds, renameUser, plan.member(member))
+	if _, notVerified := err.(notVerifiedError); err != nil && !notVerified {
+		return
+	}
+	plan.confirmRemovals()
+	plan.removeEmpty()
+	if erro := applyPlan(plan); erro != nil {
+		err = erro
+	}
+	return
+}
+
+// notVerifiedError is returned for members without an account that can be verified,
+// their plan still has to be applied to give them the unverified role
+type notVerifiedError struct {
+	error
+}
+
+// planUserDataInGuild adds the changes of updating the user on a specific discord server to the plan,
+// which also provides the settings
+// nolint: gocyclo
+func planUserDataInGuild(ctx context.Context, member *discordgo.Member, data gw2AccountData, removeWorlds bool, renameUser bool, plan *memberPlan) (err error) {
+	options := plan.guild.Options
+
+	guildRoles, err := plan.guild.discordRoles()
 	if err != nil {
-		loglevels.Errorf("Error getting guild roles: %v\n", err)
 		return
 	}
 
@@ -488,112 +699,147 @@ func updateUserDataInGuild(member *discordgo.Member, data gw2AccountData, remove
 		return
 	}
 
+	if data.Revoked && time.Since(data.RevokedSince) < options.gracePeriod() {
+		// keep the roles until the grace period of the discord server is over
+		removeWorlds = false
+	}
+
+	if options.GiveUnverifiedRole {
+		plan.unverifiedRoleID, roles = findSlotRole(roleSlotUnverified, options.unverifiedRoleName(), roles, guildRoles, plan)
+		plan.setReason(plan.unverifiedRoleID, "not verified")
+		plan.setRemoveReason(plan.unverifiedRoleID, "verified")
+	}
+
 	var worlds []int
+	var teams []int
+	var wvwGuilds []string
+	var accounts []string
+	var gw2Guilds []string
+	var verifiedAccounts []worldWithRank
+	var unmet []string
+	freeToPlay := false
+	highestRank := 0
 	for _, world := range data.Worlds {
-		if world.rank >= options.MinimumRank {
+		if reason := options.unmetRequirement(world); reason != "" {
+			if indexOfString(reason, unmet) == -1 {
+				unmet = append(unmet, reason)
+			}
+		} else if options.RefuseFreeToPlay && world.FreeToPlay {
+			freeToPlay = true
+		} else {
+			verifiedAccounts = append(verifiedAccounts, world)
+			if world.rank > highestRank {
+				highestRank = world.rank
+			}
 			worlds = append(worlds, world.ID)
+			if world.Team != 0 {
+				teams = append(teams, world.Team)
+			}
+			if world.WvWGuild != "" {
+				wvwGuilds = append(wvwGuilds, world.WvWGuild)
+			}
+			accounts = append(accounts, world.Account)
+			gw2Guilds = append(gw2Guilds, world.Guilds...)
 		}
 	}
 	if len(worlds) == 0 {
-		err = errors.New(fmt.Sprintf("No account from <@%v> meets the wvw rank requirement of this server", member.User.ID))
+		switch {
+		case data.Revoked && len(data.Worlds) == 0:
+			// the roles stay until the grace period is over, like the direct message about the key promises
+			err = notVerifiedError{fmt.Errorf("The api key of <@%v> stopped working", member.User.ID)}
+			plan.removeReason = "api key revoked"
+		case len(data.Worlds) == 0:
+			err = notVerifiedError{fmt.Errorf("<@%v> has not added an api key", member.User.ID)}
+			// the bot never saw an account of the member, roles given by hand are left to the purge
+			if removeWorlds && plan.unverifiedRoleID != "" && !holdsManagedRole(member, roles) {
+				plan.addRole(findManagedRole(plan.unverifiedRoleID, roles))
+			}
+			return
+		case freeToPlay && len(unmet) == 0:
+			err = notVerifiedError{fmt.Errorf("This server does not verify free to play accounts like the one of <@%v>", member.User.ID)}
+			plan.removeReason = "free to play account"
+		default:
+			err = notVerifiedError{fmt.Errorf("No account from <@%v> meets the requirements of this server: %v", member.User.ID, strings.Join(unmet, ", "))}
+			plan.removeReason = strings.Join(unmet, ", ")
+		}
+		// the verified, world, linked, rank and access roles of revoked and refused accounts are replaced with
+		// the unverified role. Only trust missing accounts if every api key could be checked
+		assignManagedRoles(member, roles, nil, removeWorlds, plan)
 		return
 	}
 
-	if options.RenameUsers && renameUser {
-		_ = dg.GuildMemberNickname(member.GuildID, member.User.ID, data.Name) // nolint: errcheck, gosec
+	if options.RenameUsers && renameUser && !options.nicknameExempt(member.Roles) {
+		if nickname := options.nickname(discordName(member.User), data); nickname != "" && nickname != member.Nick {
+			plan.Nickname = nickname
+		}
+	}
+
+	switch {
+	case data.Revoked:
+		plan.removeReason = "api key revoked"
+	case len(unmet) > 0:
+		plan.removeReason = strings.Join(unmet, ", ")
+	case freeToPlay:
+		plan.removeReason = "free to play account"
+	default:
+		plan.removeReason = removeReasons[options.Mode]
 	}
 
+	roles = planRankRole(options, highestRank, roles, guildRoles, plan)
+	roles = planAccessRoles(options, memberAccess(verifiedAccounts), roles, guildRoles, plan)
+
 	switch options.Mode {
 	case allServers:
-		err = updateUserToWorldsInGuild(member, worlds, removeWorlds, options, roles, guildRoles)
+		err = updateUserToWorldsInGuild(member, worlds, removeWorlds, options, roles, guildRoles, plan)
 	case oneServer:
-		err = updateUserToVerifyInGuild(member, worlds, removeWorlds, options, options.Gw2ServerID, roles, guildRoles)
+		err = updateUserToVerifyInGuild(member, worlds, verifiedAccounts, removeWorlds, options, options.Gw2ServerID, roles, guildRoles, plan)
 	case userBased:
-		err = updateUserToUserBasedVerifyInGuild(member, worlds, removeWorlds, options, roles, guildRoles)
+		err = updateUserToUserBasedVerifyInGuild(ctx, member, worlds, verifiedAccounts, removeWorlds, options, roles, guildRoles, plan)
+	case oneTeam:
+		err = updateUserToVerifyInGuild(member, teams, verifiedAccounts, removeWorlds, options, options.Gw2TeamID, roles, guildRoles, plan)
+	case allTeams:
+		err = updateUserToWorldsInGuild(member, teams, removeWorlds, options, roles, guildRoles, plan)
+	case wvwGuild:
+		err = updateUserToWvWGuildVerifyInGuild(member, wvwGuilds, removeWorlds, options, roles, guildRoles, plan)
+	case guildMember:
+		err = updateUserToGuildMemberVerifyInGuild(ctx, member, accounts, gw2Guilds, removeWorlds, options, roles, guildRoles, plan)
 	}
 	return
 }
 
 // updateUserToWorldsInGuild updates the world roles for the user in a specific guild
 // nolint: gocyclo
-func updateUserToWorldsInGuild(member *discordgo.Member, userWorlds []int, removeWorlds bool, options *guildOptions, roles []guildRole, guildRoles []*discordgo.Role) (err error) {
+func updateUserToWorldsInGuild(member *discordgo.Member, userWorlds []int, removeWorlds bool, options *guildOptions, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (err error) {
 	var wantedRoles []string
 
 	for _, world := range userWorlds {
-		found := false
-		for _, role := range roles {
-			if currentWorlds[world].Name == role.Name {
-				wantedRoles = append(wantedRoles, role.ID)
-				found = true
-				break
-			}
-		}
-		if !found {
-			for _, role := range guildRoles {
-				if role.Name == currentWorlds[world].Name {
-					wantedRoles = append(wantedRoles, role.ID)
-					found = true
-					roleStruct := guildRole{
-						ID:   role.ID,
-						Name: role.Name,
-					}
-					_ = addGuildRole(member.GuildID, roleStruct) // nolint: errcheck, gosec
-					roles = append(roles, roleStruct)
-					break
-				}
-			}
-			if !found {
-				_, roleStruct, err := createRoleAndAddToManaged(member.GuildID, currentWorlds[world].Name)
-				if err != nil {
-					continue
-				}
-				roles = append(roles, roleStruct)
-				wantedRoles = append(wantedRoles, roleStruct.ID)
-			}
+		if _, ok := currentWorlds[world]; !ok {
+			// teams that are not part of the current matches have no name
+			continue
 		}
+		var roleID string
+		roleID, roles = findSlotRole(worldRoleSlot(world), options.worldRoleName(currentWorlds[world].Name), roles, guildRoles, plan)
+		wantedRoles = append(wantedRoles, roleID)
 	}
 
 	if options.CreateRoles {
 		for _, world := range currentWorlds {
-			found := false
-			for _, role := range roles {
-				if role.Name == world.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				for _, role := range guildRoles {
-					if role.Name == world.Name {
-						found = true
-						roleStruct := guildRole{
-							ID:   role.ID,
-							Name: role.Name,
-						}
-						roles = append(roles, roleStruct)
-						break
-					}
-				}
-			}
-			if !found {
-				_, _, _ = createRoleAndAddToManaged(member.GuildID, world.Name) // nolint: errcheck, gosec
+			// only create roles for worlds in all servers mode and for teams in all teams mode
+			if gw2api.IsTeam(world.ID) != (options.Mode == allTeams) {
+				continue
 			}
+			_, roles = findSlotRole(worldRoleSlot(world.ID), options.worldRoleName(world.Name), roles, guildRoles, plan)
 		}
 	}
 
-	err = assignManagedRoles(member, roles, wantedRoles, removeWorlds)
+	assignManagedRoles(member, roles, wantedRoles, removeWorlds, plan)
 	return
 }
 
 func createRole(guildID, name string) (newRole *discordgo.Role, err error) {
-	newRole, err = dg.GuildRoleCreate(guildID)
+	newRole, err = dg.GuildRoleCreate(guildID, &discordgo.RoleParams{Name: name})
 	if err != nil {
 		loglevels.Errorf("Error creating guild role in guild %v: %v\n", guildID, err)
-		return
-	}
-	newRole, err = dg.GuildRoleEdit(guildID, newRole.ID, name, newRole.Color, newRole.Hoist, newRole.Permissions, newRole.Mentionable)
-	if err != nil {
-		loglevels.Errorf("Error editing guild role in guild %v: %v\n", guildID, err)
 	}
 	return
 }
@@ -611,6 +857,28 @@ func createRoleAndAddToManaged(guildID, name string) (newRole *discordgo.Role, r
 	return
 }
 
+// findOrCreateManagedRole returns the managed role with the name.
+// An existing discord role of guildRoles with the name gets managed, otherwise a new role is created
+func findOrCreateManagedRole(name string, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (roleID string, managedRoles []guildRole) {
+	for _, role := range roles {
+		if role.Name == name {
+			return role.ID, roles
+		}
+	}
+	for _, role := range guildRoles {
+		if role.Name == name {
+			roleStruct := guildRole{
+				ID:   role.ID,
+				Name: role.Name,
+			}
+			plan.manageRole(roleStruct)
+			return role.ID, append(roles, roleStruct)
+		}
+	}
+	roleStruct := plan.createRole(name)
+	return roleStruct.ID, append(roles, roleStruct)
+}
+
 func addRole(roleID string, member *discordgo.Member) (err error) {
 	if indexOfString(roleID, member.Roles) == -1 {
 		err = dg.GuildMemberRoleAdd(member.GuildID, member.User.ID, roleID)
@@ -621,10 +889,7 @@ func addRole(roleID string, member *discordgo.Member) (err error) {
 	return
 }
 
-func removeRole(roleID string, member *discordgo.Member, remove bool) (err error) {
-	if !remove {
-		return
-	}
+func removeRole(roleID string, member *discordgo.Member) (err error) {
 	if indexOfString(roleID, member.Roles) != -1 {
 		err = dg.GuildMemberRoleRemove(member.GuildID, member.User.ID, roleID)
 		if err != nil {
@@ -634,7 +899,23 @@ func removeRole(roleID string, member *discordgo.Member, remove bool) (err error
 	return
 }
 
-func assignManagedRoles(member *discordgo.Member, managedRoles []guildRole, wantedRoles []string, removeRoles bool) (err error) {
+// holdsManagedRole reports whether the member has one of the managed roles
+func holdsManagedRole(member *discordgo.Member, managedRoles []guildRole) bool {
+	for _, role := range managedRoles {
+		if indexOfString(role.ID, member.Roles) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+func assignManagedRoles(member *discordgo.Member, managedRoles []guildRole, wantedRoles []string, removeRoles bool, plan *memberPlan) {
+	if len(wantedRoles) > 0 {
+		wantedRoles = append(wantedRoles, plan.verifiedRoleIDs...)
+	} else if removeRoles && plan.unverifiedRoleID != "" {
+		wantedRoles = []string{plan.unverifiedRoleID}
+	}
+
 	var managedRolesOfUser []string
 	for _, role := range member.Roles {
 		for _, managedRole := range managedRoles {
@@ -648,83 +929,54 @@ func assignManagedRoles(member *discordgo.Member, managedRoles []guildRole, want
 	for _, role := range managedRolesOfUser {
 		index := indexOfString(role, wantedRoles)
 		if index == -1 {
-			err = removeRole(role, member, removeRoles) // nolint: gosec, errcheck
+			if removeRoles {
+				plan.removeRole(findManagedRole(role, managedRoles))
+			}
 		} else {
 			wantedRoles = remove(wantedRoles, index)
 		}
 	}
 
 	for _, role := range wantedRoles {
-		err = addRole(role, member) // nolint: gosec, errcheck
+		if indexOfString(role, member.Roles) == -1 {
+			plan.addRole(findManagedRole(role, managedRoles))
+		}
 	}
-	return
 }
 
-// nolint: gocyclo
-func updateUserToVerifyInGuild(member *discordgo.Member, worlds []int, removeWorlds bool, options *guildOptions, verifyWorld int, roles []guildRole, guildRoles []*discordgo.Role) (erro error) {
-	var verifiedID string
-	var linkedID string
+// getVerifyRoles finds or creates the verified role and, if linked servers are allowed, the linked role.
+// world is the name of the world or team that is verified for, if any
+func getVerifyRoles(options *guildOptions, world string, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (verifiedID, linkedID string, managedRoles []guildRole) {
+	verifiedID, roles = findSlotRole(roleSlotVerified, options.verifiedRoleName(world), roles, guildRoles, plan)
+	if options.AllowLinked {
+		linkedID, roles = findSlotRole(roleSlotLinked, options.linkedRoleName(world), roles, guildRoles, plan)
+	} else if id := options.LinkedRoleID; id != "" {
+		// the bound linked role is still managed
+		linkedID = id
+	}
+	return verifiedID, linkedID, roles
+}
+
+// updateUserToVerifyInGuild verifies the user if one of the worlds is the verify world and gives the linked role for its links
+// and the additional worlds of the discord server. In team modes the worlds and the verify world are teams
+func updateUserToVerifyInGuild(member *discordgo.Member, worlds []int, accounts []worldWithRank, removeWorlds bool, options *guildOptions, verifyWorld int, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (erro error) {
 	var wantedRoles []string
 
-	for _, role := range roles {
-		switch role.Name {
-		case "WvW-Verified":
-			verifiedID = role.ID
-		case "WvW-Linked":
-			linkedID = role.ID
-		}
-	}
+	verifiedID, linkedID, roles := getVerifyRoles(options, getWorldName(verifyWorld), roles, guildRoles, plan)
+	plan.setReason(linkedID, "linked world")
+	plan.setRemoveReason(linkedID, "link change")
 
-	if verifiedID == "" || (options.AllowLinked && linkedID == "") {
-		for _, role := range guildRoles {
-			if role.Name == "WvW-Verified" {
-				verifiedID = role.ID
-				roleStruct := guildRole{
-					ID:   role.ID,
-					Name: role.Name,
-				}
-				roles = append(roles, roleStruct)
-				erro = addGuildRole(member.GuildID, roleStruct)
-				if erro != nil {
-					loglevels.Warningf("Error adding existing verified role %v to managed roles: %v", role.ID, erro)
-				}
-			}
-			if role.Name == "WvW-Linked" {
-				linkedID = role.ID
-				roleStruct := guildRole{
-					ID:   role.ID,
-					Name: role.Name,
-				}
-				roles = append(roles, roleStruct)
-				erro = addGuildRole(member.GuildID, roleStruct)
-				if erro != nil {
-					loglevels.Warningf("Error adding existing linked role %v to managed roles: %v", role.ID, erro)
-				}
-			}
-		}
-		if verifiedID == "" {
-			_, roleStruct, err := createRoleAndAddToManaged(member.GuildID, "WvW-Verified")
-			if err != nil {
-				return err
-			}
-			verifiedID = roleStruct.ID
-			roles = append(roles, roleStruct)
-		}
-		if options.AllowLinked && linkedID == "" {
-			_, roleStruct, err := createRoleAndAddToManaged(member.GuildID, "WvW-Linked")
-			if err != nil {
-				return err
-			}
-			linkedID = roleStruct.ID
-			roles = append(roles, roleStruct)
-		}
+	var linkedWorlds []int
+	if world, ok := currentWorlds[verifyWorld]; ok {
+		linkedWorlds = world.Linked
 	}
-
-	linkedWorlds := currentWorlds[verifyWorld].Linked
 	additionalWorlds, err := getAdditionalWorlds(member.GuildID)
 	if err != nil {
 		removeWorlds = false
 	} else {
+		if gw2api.IsTeam(verifyWorld) {
+			additionalWorlds = additionalTeams(additionalWorlds, accounts)
+		}
 		linkedWorlds = append(linkedWorlds, additionalWorlds...)
 	}
 
@@ -736,6 +988,7 @@ func updateUserToVerifyInGuild(member *discordgo.Member, worlds []int, removeWor
 				if indexOfInt(world, worlds) != -1 {
 					if options.VerifyOnly {
 						wantedRoles = append(wantedRoles, verifiedID)
+						plan.setReason(verifiedID, "linked world")
 					} else {
 						wantedRoles = append(wantedRoles, linkedID)
 					}
@@ -744,15 +997,93 @@ func updateUserToVerifyInGuild(member *discordgo.Member, worlds []int, removeWor
 		}
 	}
 
-	erro = assignManagedRoles(member, roles, wantedRoles, removeWorlds)
+	assignManagedRoles(member, roles, wantedRoles, removeWorlds, plan)
+	return
+}
+
+// additionalTeams maps the worlds allowed on a discord server to the teams of the accounts on these worlds.
+// Accounts of one world play in different teams since the world restructuring, so only the accounts know their team
+func additionalTeams(additionalWorlds []int, accounts []worldWithRank) (teams []int) {
+	for _, id := range additionalWorlds {
+		if gw2api.IsTeam(id) {
+			if indexOfInt(id, teams) == -1 {
+				teams = append(teams, id)
+			}
+			continue
+		}
+		for _, account := range accounts {
+			if account.ID == id && account.Team != 0 && indexOfInt(account.Team, teams) == -1 {
+				teams = append(teams, account.Team)
+			}
+		}
+	}
+	return
+}
+
+// updateUserToWvWGuildVerifyInGuild verifies the user if one of the selected wvw guilds of the user is allowed on the discord server
+func updateUserToWvWGuildVerifyInGuild(member *discordgo.Member, wvwGuilds []string, removeWorlds bool, options *guildOptions, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (erro error) {
+	var wantedRoles []string
+
+	verifiedID, _, roles := getVerifyRoles(options, "", roles, guildRoles, plan)
+
+	for _, guild := range wvwGuilds {
+		if indexOfString(guild, options.WvWGuildIDs) != -1 {
+			wantedRoles = append(wantedRoles, verifiedID)
+			break
+		}
+	}
+
+	assignManagedRoles(member, roles, wantedRoles, removeWorlds, plan)
+	return
+}
+
+// updateUserToGuildMemberVerifyInGuild verifies the user if one of the accounts is a member of the gw2 guilds of the discord server.
+// If rank roles are enabled, the user gets a role named after the guild rank of each of the accounts
+func updateUserToGuildMemberVerifyInGuild(ctx context.Context, member *discordgo.Member, accounts, gw2Guilds []string, removeWorlds bool, options *guildOptions, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (erro error) {
+	var wantedRoles []string
+
+	verifiedID, _, roles := getVerifyRoles(options, "", roles, guildRoles, plan)
+
+	for _, guild := range options.Gw2GuildIDs {
+		if indexOfString(guild, gw2Guilds) == -1 {
+			continue
+		}
+		if indexOfString(verifiedID, wantedRoles) == -1 {
+			wantedRoles = append(wantedRoles, verifiedID)
+		}
+
+		if !options.GuildRankRoles || options.Gw2AccountKey == "" {
+			continue
+		}
+		members, err := getCachedGw2GuildMembers(ctx, guild, options.Gw2AccountKey)
+		if err != nil {
+			// keep the rank roles until the ranks can be looked up again
+			loglevels.Warningf("Error getting members of guild %v for discord server %v: %v\n", guild, member.GuildID, err)
+			removeWorlds = false
+			continue
+		}
+		for _, gw2Member := range members {
+			if indexOfString(gw2Member.Name, accounts) == -1 {
+				continue
+			}
+			var roleID string
+			roleID, roles = findGuildRankRole(gw2Member.Rank, roles, guildRoles, plan)
+			plan.setReason(roleID, "guild rank "+gw2Member.Rank)
+			if indexOfString(roleID, wantedRoles) == -1 {
+				wantedRoles = append(wantedRoles, roleID)
+			}
+		}
+	}
+
+	assignManagedRoles(member, roles, wantedRoles, removeWorlds, plan)
 	return
 }
 
-func updateUserToUserBasedVerifyInGuild(member *discordgo.Member, worlds []int, removeWorlds bool, options *guildOptions, roles []guildRole, guildRoles []*discordgo.Role) (err error) {
-	owner, err := getCachedGw2Account(options.Gw2AccountKey)
+func updateUserToUserBasedVerifyInGuild(ctx context.Context, member *discordgo.Member, worlds []int, accounts []worldWithRank, removeWorlds bool, options *guildOptions, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (err error) {
+	owner, err := getCachedGw2Account(ctx, options.Gw2AccountKey)
 	if err != nil {
 		return
 	}
-	err = updateUserToVerifyInGuild(member, worlds, removeWorlds, options, owner.World, roles, guildRoles)
+	err = updateUserToVerifyInGuild(member, worlds, accounts, removeWorlds, options, owner.World, roles, guildRoles, plan)
 	return
 }
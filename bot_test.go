@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestPlanUserDataWithoutVerifiedAccount(t *testing.T) {
+	previousDatabase := database
+	defer func() {
+		database = previousDatabase
+	}()
+
+	held := []string{"verified", "world", "unmanaged"}
+	tests := []struct {
+		name         string
+		options      guildOptions
+		memberRoles  []string
+		data         gw2AccountData
+		removeWorlds bool
+		add          []string
+		remove       []string
+	}{
+		{"refused free to play account", guildOptions{RefuseFreeToPlay: true}, held,
+			gw2AccountData{Worlds: []worldWithRank{{ID: 2201, FreeToPlay: true}}}, true, []string{"unverified"}, []string{"verified", "world"}},
+		{"refused free to play account without removals", guildOptions{RefuseFreeToPlay: true}, held,
+			gw2AccountData{Worlds: []worldWithRank{{ID: 2201, FreeToPlay: true}}}, false, nil, nil},
+		// roles of members the bot never saw an account of are left to the purge
+		{"no api key", guildOptions{}, held,
+			gw2AccountData{}, true, nil, nil},
+		{"no api key without managed roles", guildOptions{}, []string{"unmanaged"},
+			gw2AccountData{}, true, []string{"unverified"}, nil},
+		{"no api key with failed requests", guildOptions{}, held,
+			gw2AccountData{}, false, nil, nil},
+		{"rank below minimum", guildOptions{MinimumRank: 100}, held,
+			gw2AccountData{Worlds: []worldWithRank{{ID: 2201, rank: 50}}}, true, []string{"unverified"}, []string{"verified", "world"}},
+		{"refused free to play account and unmet requirement", guildOptions{RefuseFreeToPlay: true, MinimumFractalLevel: 10}, held,
+			gw2AccountData{Worlds: []worldWithRank{{ID: 2201, FreeToPlay: true}, {ID: 2202, FractalLevel: 5}}}, true, []string{"unverified"}, []string{"verified", "world"}},
+		{"revoked key within the grace period", guildOptions{RevokedKeyGracePeriod: 2}, held,
+			gw2AccountData{Revoked: true, RevokedSince: time.Now().Add(-24 * time.Hour)}, true, nil, nil},
+		{"revoked key after the grace period", guildOptions{RevokedKeyGracePeriod: 2}, held,
+			gw2AccountData{Revoked: true, RevokedSince: time.Now().Add(-72 * time.Hour)}, true, []string{"unverified"}, []string{"verified", "world"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			for _, id := range []string{"verified", "world", "unverified"} {
+				if err := database.AddManagedRole("guild", guildRole{ID: id, Name: id}); err != nil {
+					t.Fatalf("adding managed role: %v", err)
+				}
+			}
+
+			options := test.options
+			options.Mode = oneServer
+			options.Gw2ServerID = 2201
+			options.VerifiedRoleID = "verified"
+			options.GiveUnverifiedRole = true
+			options.UnverifiedRoleID = "unverified"
+			plan, err := newGuildPlan("guild", "", &options)
+			if err != nil {
+				t.Fatalf("creating plan: %v", err)
+			}
+			plan.guildRoles = []*discordgo.Role{{ID: "verified"}, {ID: "world"}, {ID: "unverified"}, {ID: "unmanaged"}}
+
+			member := &discordgo.Member{
+				GuildID: "guild",
+				User:    &discordgo.User{ID: "user"},
+				Roles:   test.memberRoles,
+			}
+			err = planUserDataInGuild(context.Background(), member, test.data, test.removeWorlds, false, plan.member(member))
+			if _, notVerified := err.(notVerifiedError); !notVerified {
+				t.Errorf("got error %v, expected a notVerifiedError", err)
+			}
+
+			m := plan.member(member)
+			if add := roleIDs(m.Add); !equalStrings(add, test.add) {
+				t.Errorf("got added roles %v, expected %v", add, test.add)
+			}
+			if remove := roleIDs(m.Remove); !equalStrings(remove, test.remove) {
+				t.Errorf("got removed roles %v, expected %v", remove, test.remove)
+			}
+		})
+	}
+}
+
+func roleIDs(roles []guildRole) (ids []string) {
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+	return
+}
+
+func TestAdditionalTeams(t *testing.T) {
+	accounts := []worldWithRank{{ID: 2201, Team: 12005}, {ID: 2202, Team: 12007}, {ID: 2203}}
+	tests := []struct {
+		name       string
+		additional []int
+		expected   []int
+	}{
+		{"no additional worlds", nil, nil},
+		{"world of an account", []int{2201}, []int{12005}},
+		{"worlds of several accounts", []int{2201, 2202}, []int{12005, 12007}},
+		{"world without accounts", []int{2204}, nil},
+		{"account without team", []int{2203}, nil},
+		{"team", []int{12010}, []int{12010}},
+		{"team of a world and the team", []int{2201, 12005}, []int{12005}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if teams := additionalTeams(test.additional, accounts); !sameWorlds(teams, test.expected) {
+				t.Errorf("got teams %v, expected %v", teams, test.expected)
+			}
+		})
+	}
+}
+
+func TestPlanUserDataAdditionalWorlds(t *testing.T) {
+	previousDatabase, previousWorlds := database, currentWorlds
+	defer func() {
+		database, currentWorlds = previousDatabase, previousWorlds
+	}()
+	currentWorlds = map[int]*linkInfo{
+		2201:  {ID: 2201, Name: "First", Linked: []int{2201}},
+		12001: {ID: 12001, Name: "Team", Linked: []int{12001}},
+	}
+
+	tests := []struct {
+		name    string
+		mode    mode
+		account worldWithRank
+		add     []string
+	}{
+		{"world of the server", oneServer, worldWithRank{ID: 2201, Team: 12005}, []string{"verified"}},
+		{"additional world", oneServer, worldWithRank{ID: 2202, Team: 12005}, []string{"linked"}},
+		{"other world", oneServer, worldWithRank{ID: 2203, Team: 12005}, nil},
+		{"team of the server", oneTeam, worldWithRank{ID: 2203, Team: 12001}, []string{"verified"}},
+		{"additional world in team mode", oneTeam, worldWithRank{ID: 2202, Team: 12005}, []string{"linked"}},
+		{"other world in team mode", oneTeam, worldWithRank{ID: 2203, Team: 12005}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			if err := database.AddAdditionalWorld("guild", 2202, time.Hour); err != nil {
+				t.Fatalf("adding additional world: %v", err)
+			}
+
+			options := guildOptions{
+				Mode:           test.mode,
+				Gw2ServerID:    2201,
+				Gw2TeamID:      12001,
+				AllowLinked:    true,
+				VerifiedRoleID: "verified",
+				LinkedRoleID:   "linked",
+			}
+			plan, err := newGuildPlan("guild", "", &options)
+			if err != nil {
+				t.Fatalf("creating plan: %v", err)
+			}
+			plan.guildRoles = []*discordgo.Role{{ID: "verified"}, {ID: "linked"}}
+
+			member := &discordgo.Member{
+				GuildID: "guild",
+				User:    &discordgo.User{ID: "user"},
+			}
+			data := gw2AccountData{Name: "Verified.1234", Worlds: []worldWithRank{test.account}}
+			if err = planUserDataInGuild(context.Background(), member, data, true, false, plan.member(member)); err != nil {
+				if _, notVerified := err.(notVerifiedError); !notVerified || test.add != nil {
+					t.Fatalf("planning: %v", err)
+				}
+			}
+
+			m := plan.member(member)
+			if add := roleIDs(m.Add); !equalStrings(add, test.add) {
+				t.Errorf("got added roles %v, expected %v", add, test.add)
+			}
+		})
+	}
+}
@@ -1,104 +1,111 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/greaka/discordwvwbot/loglevels"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+// messageReceive handles the bot owner commands in direct messages, everything else is a slash command.
+// Direct messages contain their content without the privileged message content intent
 func messageReceive(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if !strings.HasPrefix(m.Content, ".wvw") {
+	if m.GuildID != "" || !strings.HasPrefix(m.Content, ".wvw") {
 		return
 	}
 
-	_ = s.ChannelTyping(m.ChannelID) // nolint: errcheck, gosec
+	ctx := &commandContext{
+		ChannelID: m.ChannelID,
+		Author:    m.Author,
+		reply: func(content string) (err error) {
+			_, err = s.ChannelMessageSend(m.ChannelID, content)
+			return
+		},
+	}
+	if !isOwner(ctx, false) {
+		_ = ctx.reply("The bot only knows slash commands now, type `/wvw help` to see them.") // nolint: errcheck, gosec
+		return
+	}
 
 	mes := strings.Trim(m.Content[4:], " ")
 
-	// remember to add new functions to the help doc
 	switch {
-	case strings.HasPrefix(mes, "help"):
-		printHelp(m)
-	case strings.HasPrefix(mes, "addkey"):
-		key := strings.Trim(mes[6:], " ")
-		addKey(m, key)
-	case strings.HasPrefix(mes, "purge"):
-		relink := strings.Trim(mes[5:], " ")
-		purgeGuild(m, relink)
-	case strings.HasPrefix(mes, "check"):
-		printUserWorlds(m, strings.Trim(mes[5:], " "))
-	case strings.HasPrefix(mes, "verify"):
-		userID := strings.Trim(mes[6:], " ")
-		commandVerifyUser(m, userID)
 	case strings.HasPrefix(mes, "kill"):
-		if isOwner(m, true) {
-			os.Exit(1)
-		}
-	case strings.HasPrefix(mes, "allow"):
-		server := strings.Trim(mes[5:], " ")
-		commandAddServer(m, server)
-	case strings.HasPrefix(mes, "deletealldata"):
-		commandDeleteAllData(m)
+		sendSuccess(ctx)
+		fail(errors.New("killed by the owner"))
 	case strings.HasPrefix(mes, "leave"):
 		server := strings.Trim(mes[5:], " ")
-		if isOwner(m, true) {
-			err := dg.GuildLeave(server)
-			if err != nil {
-				sendErrorMes(m, err.Error())
-			}
+		err := dg.GuildLeave(server)
+		if err != nil {
+			sendErrorMes(ctx, err.Error())
+			return
 		}
+		sendSuccess(ctx)
 	}
 }
 
-func printHelp(m *discordgo.MessageCreate) {
-	_, err := dg.ChannelMessageSend(m.ChannelID, `available commands:
-	> **help**
+func printHelp(m *commandContext) {
+	err := m.reply(`available commands:
+	> **/wvw help**
 	prints this message
-	
-	> **addkey** `+"`API-KEY`"+`
-	adds an api key to the bot. Use it like this:
-	`+"`.wvw addkey XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXXXXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX`"+`
 
-	> **verify**
-	re-verifies you on all servers
+	> **/wvw addkey** ` + "`key`" + `
+	adds an api key to the bot. Nobody else can see the key, you can also use it in a direct message to the bot
 
-	> **deletealldata**
-    Deletes all data associated with your Discord account.
-    The bot will not know about you anymore after using this command.
+	> **/wvw verify**
+	re-verifies you on this server, or on all servers in a direct message
 
-__Commands requiring  `+"`Manage Roles`"+` permission__
-	
-	> **purge**
+	> **/wvw links** ` + "`date`" + `
+	shows the matchups and links of today or of a past date, see also ` + config.HostURL + `/links
+
+	> **/wvw notifications** ` + "`enabled`" + `
+	turns the direct messages about api keys that stopped working on or off
+
+	> **/wvw deletealldata**
+	Deletes all data associated with your Discord account.
+	The bot will not know about you anymore after using this command.
+
+__Commands requiring  ` + "`Manage Roles`" + ` permission__
+
+	> **/wvw purge**
 	removes roles from players that were manually verified
 
-	> **purge** linked
+	> **/wvw purge** ` + "`linked: True`" + `
 	like purge, but only for linked servers
 
-	> **verify** `+"`discordUserId`"+`
+	> **/wvw preview** ` + "`purge: True`" + ` ` + "`linked: True`" + `
+	shows the role and nickname changes of verifying everyone without applying them, optionally including a purge
+
+	> **/wvw apply** ` + "`plan`" + `
+	applies exactly the changes of a preview
+
+	> **/wvw verify** ` + "`user`" + `
 	verifies a user in your discord server
 
-	> **check** `+"`discordUserId`"+`
-	shows the worlds, account names and wvw ranks of the user
+	> **/wvw check** ` + "`user`" + `
+	shows the worlds, account names, wvw ranks and rank role of the user
 
-	> **allow** `+"`serverName`"+`
+	> **/wvw audit** ` + "`user`" + `
+	shows the latest role and nickname changes of the bot, optionally only of one user
+
+	> **/wvw allow** ` + "`server`" + `
 	Sets a server as an additional linked server for 24h.
-    You can add as many servers as you want. The time will reset to 24h for all additional servers.
+	You can add as many servers as you want. The time will reset to 24h for all additional servers.
 	`)
 	if err != nil {
 		loglevels.Errorf("Failed to send help message to user %v: %v", m.Author.ID, err)
 	}
 }
 
-func addKey(m *discordgo.MessageCreate, key string) {
-	_ = dg.ChannelMessageDelete(m.ChannelID, m.Message.ID) // nolint: errcheck, gosec
-
+func addKey(m *commandContext, key string) {
 	err := checkKey(key, m.Author.ID)
 	if err != nil {
-		_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+fmt.Sprintf(" %v", err))
+		erro := m.reply(m.Author.Mention() + fmt.Sprintf(" %v", err))
 		if erro != nil {
 			loglevels.Errorf("Failed to send key error message to user %v: %v", m.Author.ID, erro)
 		}
@@ -107,7 +114,7 @@ func addKey(m *discordgo.MessageCreate, key string) {
 
 	err = addUserKey(m.Author.ID, key)
 	if err != nil {
-		_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+fmt.Sprintf(" %v", err))
+		erro := m.reply(m.Author.Mention() + fmt.Sprintf(" %v", err))
 		if erro != nil {
 			loglevels.Errorf("Failed to send key save failed message to user %v: %v", m.Author.ID, erro)
 		}
@@ -117,22 +124,64 @@ func addKey(m *discordgo.MessageCreate, key string) {
 	sendSuccess(m)
 }
 
-// nolint: gocyclo
-func purgeGuild(m *discordgo.MessageCreate, relink string) {
+func purgeGuild(m *commandContext, relink string) {
 	roles, allowed := isManagerOfRoles(m, true)
 	if !allowed {
 		return
 	}
 
-	authRoles, err := getGuildRoles(m.GuildID, roles)
+	options, err := getGuildSettings(m.GuildID)
+	if err != nil {
+		sendError(m)
+		return
+	}
+
+	plan, err := newGuildPlan(m.GuildID, m.Author.ID, options)
+	if err != nil {
+		sendError(m)
+		return
+	}
+	plan.Trigger = triggerPurge
+
+	err = planPurge(plan, roles, relink == "linked")
 	if err != nil {
 		sendError(m)
 		return
 	}
 
-	if relink == "linked" {
+	plan.removeEmpty()
+	err = applyPlan(plan)
+	if err != nil {
+		loglevels.Warningf("Error purging guild %v: %v", m.GuildID, err)
+		erro := m.reply(m.Author.Mention() + " Completed with errors.")
+		if erro != nil {
+			loglevels.Errorf("Failed to send partial success message to user %v: %v", m.Author.ID, erro)
+		}
+		return
+	}
+
+	sendSuccess(m)
+}
+
+// getPurgeTargets returns the managed roles to purge and the members that have one of them without being known to the bot
+// nolint: gocyclo
+func getPurgeTargets(guildID string, roles []*discordgo.Role, options *guildOptions, linkedOnly bool) (authRoles []guildRole, tempMap map[string]*discordgo.Member, err error) {
+	authRoles, err = getGuildRoles(guildID, roles)
+	if err != nil {
+		return
+	}
+	// the unverified role belongs to members without api key
+	for i, role := range authRoles {
+		if role.ID == options.UnverifiedRoleID {
+			authRoles = append(authRoles[:i], authRoles[i+1:]...)
+			break
+		}
+	}
+
+	if linkedOnly {
+		linkedName := options.linkedRoleName(options.verifyWorldName())
 		for _, role := range authRoles {
-			if role.Name == "WvW-Linked" {
+			if role.ID == options.LinkedRoleID || (options.LinkedRoleID == "" && role.Name == linkedName) {
 				authRoles = authRoles[:0]
 				authRoles = append(authRoles, role)
 				break
@@ -140,46 +189,126 @@ func purgeGuild(m *discordgo.MessageCreate, relink string) {
 		}
 	}
 
-	guild, err := dg.State.Guild(m.GuildID)
+	guild, err := dg.State.Guild(guildID)
 	if err != nil {
-		loglevels.Errorf("Error finding guild %v in state for purge command", m.GuildID)
-		sendError(m)
+		loglevels.Errorf("Error finding guild %v in state for purge command", guildID)
 		return
 	}
 
-	tempMap := make(map[string]*discordgo.Member)
+	tempMap = make(map[string]*discordgo.Member)
+	dg.State.RLock()
 	for _, v := range guild.Members {
 		for _, role := range authRoles {
 			for _, memberRole := range v.Roles {
 				if memberRole == role.ID {
-					tempMap[v.User.ID] = v
+					// copies, because the members of the state must not be changed
+					member := *v
+					member.GuildID = guildID
+					tempMap[v.User.ID] = &member
 					break
 				}
 			}
 		}
 	}
+	dg.State.RUnlock()
 
-	redisConn := usersDatabase.Get()
 	processValue := func(userID string) {
 		if _, ok := tempMap[userID]; ok {
 			delete(tempMap, userID)
 		}
 	}
-	_ = iterateDatabase(redisConn, processValue)
-	closeConnection(redisConn)
+	_, err = database.IterateUsers(processValue)
+	if err != nil {
+		loglevels.Errorf("Error iterating users for purge in guild %v: %v", guildID, err)
+	}
+	return
+}
 
-	for userID := range tempMap {
-		for _, role := range authRoles {
-			erro := dg.GuildMemberRoleRemove(m.GuildID, userID, role.ID)
-			if erro != nil {
-				err = erro
-			}
+// commandPreview shows the role changes of updating everyone with the current settings without applying them
+func commandPreview(m *commandContext, purge, linkedOnly bool) {
+	_, allowed := isManagerOfRoles(m, true)
+	if !allowed {
+		return
+	}
+
+	options, err := getGuildSettings(m.GuildID)
+	if err != nil {
+		sendError(m)
+		return
+	}
+
+	plan, err := newGuildPlan(m.GuildID, m.Author.ID, options)
+	if err != nil {
+		sendError(m)
+		return
+	}
+	plan.Trigger = triggerPreview
+	plan.startComputing(purge, linkedOnly)
+
+	err = plan.waitComputed(planComputeWait)
+	if err == errPlanComputing {
+		erro := m.reply(m.Author.Mention() + " The preview takes a while on this server, it is sent here once it is computed.")
+		if erro != nil {
+			loglevels.Errorf("Failed to send preview message to user %v: %v", m.Author.ID, erro)
 		}
+		// computing stops before the answers to the command expire
+		err = plan.waitComputed(planComputeTimeout)
+	}
+	if err != nil {
+		sendError(m)
+		return
+	}
+
+	erro := m.reply(plan.summary(1800) + "\nApply exactly these changes within 15 minutes with `/wvw apply plan: " + plan.ID + "`")
+	if erro != nil {
+		loglevels.Errorf("Failed to send preview message to user %v: %v", m.Author.ID, erro)
+	}
+}
+
+// commandAudit shows the latest entries of the audit log of the discord server
+func commandAudit(m *commandContext, userID string) {
+	_, allowed := isManagerOfRoles(m, true)
+	if !allowed {
+		return
 	}
 
+	entries, err := getAuditLog(m.GuildID, userID, auditDisplayLimit)
 	if err != nil {
-		loglevels.Warningf("Error purging guild %v: %v", m.GuildID, err)
-		_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+" Completed with errors.")
+		sendError(m)
+		return
+	}
+	if len(entries) == 0 {
+		sendErrorMes(m, "there are no changes in the audit log.")
+		return
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		lines = append(lines, entry.format(mention))
+	}
+	erro := replyMessages(m, lines)
+	if erro != nil {
+		loglevels.Errorf("Failed to send audit log to user %v: %v", m.Author.ID, erro)
+	}
+}
+
+// commandApply applies a plan of commandPreview
+func commandApply(m *commandContext, id string) {
+	_, allowed := isManagerOfRoles(m, true)
+	if !allowed {
+		return
+	}
+
+	plan, err := takePlan(id, m.GuildID, m.Author.ID)
+	if err != nil {
+		sendErrorMes(m, err.Error())
+		return
+	}
+
+	err = applyPlan(plan)
+	if err != nil {
+		loglevels.Warningf("Error applying plan %v in guild %v: %v", plan.ID, m.GuildID, err)
+		erro := m.reply(m.Author.Mention() + " Completed with errors.")
 		if erro != nil {
 			loglevels.Errorf("Failed to send partial success message to user %v: %v", m.Author.ID, erro)
 		}
@@ -189,8 +318,14 @@ func purgeGuild(m *discordgo.MessageCreate, relink string) {
 	sendSuccess(m)
 }
 
-func isManagerOfRoles(m *discordgo.MessageCreate, sendOnFailure bool) (roles []*discordgo.Role, found bool) {
+func isManagerOfRoles(m *commandContext, sendOnFailure bool) (roles []*discordgo.Role, found bool) {
 	member := m.Member
+	if member == nil {
+		if sendOnFailure {
+			sendErrorMes(m, "this command only works on a discord server.")
+		}
+		return
+	}
 	roles, err := dg.GuildRoles(m.GuildID)
 	if err != nil {
 		loglevels.Warningf("Error getting roles for guild %v: %v", m.GuildID, err)
@@ -218,7 +353,7 @@ func isManagerOfRoles(m *discordgo.MessageCreate, sendOnFailure bool) (roles []*
 		}
 	}
 	if !found && sendOnFailure {
-		_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+", you are missing the permission `Manage Roles` to perform this operation.")
+		erro := m.reply(m.Author.Mention() + ", you are missing the permission `Manage Roles` to perform this operation.")
 		if erro != nil {
 			loglevels.Errorf("Failed to send error message to user %v: %v", m.Author.ID, erro)
 		}
@@ -226,9 +361,9 @@ func isManagerOfRoles(m *discordgo.MessageCreate, sendOnFailure bool) (roles []*
 	return
 }
 
-func isOwner(m *discordgo.MessageCreate, sendOnFailure bool) bool {
+func isOwner(m *commandContext, sendOnFailure bool) bool {
 	if config.Owner != m.Author.ID && sendOnFailure {
-		_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+", you need to be bot owner to use this command.")
+		erro := m.reply(m.Author.Mention() + ", you need to be bot owner to use this command.")
 		if erro != nil {
 			loglevels.Errorf("Failed to send error message to user %v: %v", m.Author.ID, erro)
 		}
@@ -236,7 +371,7 @@ func isOwner(m *discordgo.MessageCreate, sendOnFailure bool) bool {
 	return config.Owner == m.Author.ID
 }
 
-func printUserWorlds(m *discordgo.MessageCreate, userID string) {
+func printUserWorlds(m *commandContext, userID string) {
 	userID = trimMention(userID)
 
 	allowed := false
@@ -249,27 +384,49 @@ func printUserWorlds(m *discordgo.MessageCreate, userID string) {
 		if err == nil {
 			allowed = true
 		} else {
-			_, _ = dg.ChannelMessageSend(m.ChannelID, "<@"+userID+"> is not a user in your discord server.")
+			_ = m.reply("<@" + userID + "> is not a user in your discord server.")
 		}
 	}
 	if !allowed {
-		_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+", you have not enough permissions to use this command.")
+		erro := m.reply(m.Author.Mention() + ", you have not enough permissions to use this command.")
 		if erro != nil {
 			loglevels.Errorf("Failed to send error message to user %v: %v", m.Author.ID, erro)
 		}
 		return
 	}
 
-	data, err := getAccountData(struct {
+	start := time.Now()
+	data, err := getAccountData(context.Background(), struct {
 		string
 		bool
 	}{string: userID, bool: true})
 
 	worldNames := ""
+	lastKnown := ""
 	worldRanks := ""
+	teamNames := ""
+	guildNames := ""
+	highestRank := 0
 	for _, world := range data.Worlds {
-		worldNames += " | " + currentWorlds[world.ID].Name
+		if world.rank > highestRank {
+			highestRank = world.rank
+		}
+		worldNames += " | " + getWorldName(world.ID)
 		worldRanks += " | " + fmt.Sprintf("%v", world.rank)
+		if world.Checked.Before(start) {
+			lastKnown += fmt.Sprintf("\nlast known data of %v from %v", world.Account, world.Checked.UTC().Format("2006-01-02 15:04 MST"))
+		}
+		if world.Team != 0 {
+			teamNames += " | " + getWorldName(world.Team)
+		}
+		if world.WvWGuild != "" {
+			guild, erro := getCachedGw2Guild(context.Background(), world.WvWGuild)
+			if erro != nil {
+				guildNames += " | " + world.WvWGuild
+			} else {
+				guildNames += " | " + guild.Name + " [" + guild.Tag + "]"
+			}
+		}
 	}
 	if len(worldNames) >= 3 {
 		worldNames = worldNames[3:]
@@ -277,6 +434,20 @@ func printUserWorlds(m *discordgo.MessageCreate, userID string) {
 	if len(worldRanks) >= 3 {
 		worldRanks = worldRanks[3:]
 	}
+	if len(teamNames) >= 3 {
+		teamNames = teamNames[3:]
+	}
+	if len(guildNames) >= 3 {
+		guildNames = guildNames[3:]
+	}
+
+	rankRole := ""
+	if m.GuildID != "" {
+		options, erro := getGuildSettings(m.GuildID)
+		if erro == nil && len(options.RankRoles) > 0 {
+			rankRole = "\nrank role: " + describeRankTier(m.GuildID, options, highestRank)
+		}
+	}
 
 	errMes := "nil"
 	if err != nil {
@@ -290,15 +461,24 @@ func printUserWorlds(m *discordgo.MessageCreate, userID string) {
 	}
 
 	mention := us.Mention()
-	_, erro := dg.ChannelMessageSend(m.ChannelID, mention+"\naccount names: "+data.Name+"\nworlds: "+worldNames+"\nranks: "+worldRanks+"\nerr: "+errMes)
+	erro := m.reply(mention + "\naccount names: " + data.Name + "\nworlds: " + worldNames + "\nteams: " + teamNames + "\nwvw guilds: " + guildNames + "\nranks: " + worldRanks + rankRole + lastKnown + "\nerr: " + errMes)
 	if erro != nil {
 		loglevels.Errorf("Failed to send info message to user %v: %v", m.Author.ID, erro)
 	}
 }
 
-func commandVerifyUser(m *discordgo.MessageCreate, userID string) {
+func commandVerifyUser(m *commandContext, userID string) {
 	if len(userID) == 0 {
 		userID = m.Author.ID
+		if m.GuildID == "" {
+			// direct message, verify on all servers
+			updateUserChannel <- struct {
+				string
+				bool
+			}{string: userID, bool: true}
+			sendSuccess(m)
+			return
+		}
 	} else {
 		_, allowed := isManagerOfRoles(m, true)
 		if !allowed {
@@ -308,14 +488,13 @@ func commandVerifyUser(m *discordgo.MessageCreate, userID string) {
 
 	userID = trimMention(userID)
 
-	member, err := dg.State.Member(m.GuildID, userID)
+	member, err := getMember(m.GuildID, userID)
 	if err != nil {
 		sendError(m)
 		return
 	}
 
-	member.GuildID = m.GuildID
-	err = updateUserInGuild(member)
+	err = updateUserInGuild(context.Background(), member, triggerVerifyCommand)
 	if err != nil {
 		sendErrorMes(m, err.Error())
 		return
@@ -323,7 +502,7 @@ func commandVerifyUser(m *discordgo.MessageCreate, userID string) {
 	sendSuccess(m)
 }
 
-func commandAddServer(m *discordgo.MessageCreate, server string) {
+func commandAddServer(m *commandContext, server string) {
 	_, allowed := isManagerOfRoles(m, true)
 	if !allowed {
 		return
@@ -346,7 +525,7 @@ func commandAddServer(m *discordgo.MessageCreate, server string) {
 	sendSuccess(m)
 }
 
-func commandDeleteAllData(m *discordgo.MessageCreate) {
+func commandDeleteAllData(m *commandContext) {
 	err := deleteAllData(m.Author.ID)
 	if err != nil {
 		sendError(m)
@@ -355,23 +534,33 @@ func commandDeleteAllData(m *discordgo.MessageCreate) {
 	sendSuccess(m)
 }
 
-func sendError(m *discordgo.MessageCreate) {
-	_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+" Internal error, please try again or contact me.")
+func sendError(m *commandContext) {
+	erro := m.reply(m.Author.Mention() + " Internal error, please try again or contact me.")
 	if erro != nil {
 		loglevels.Errorf("Failed to send error message to user %v: %v", m.Author.ID, erro)
 	}
 }
 
-func sendErrorMes(m *discordgo.MessageCreate, mes string) {
-	_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+" "+mes)
+func sendErrorMes(m *commandContext, mes string) {
+	erro := m.reply(m.Author.Mention() + " " + mes)
 	if erro != nil {
 		loglevels.Errorf("Failed to send error message to user %v: %v", m.Author.ID, erro)
 	}
 }
 
-func sendSuccess(m *discordgo.MessageCreate) {
-	_, erro := dg.ChannelMessageSend(m.ChannelID, m.Author.Mention()+" Success")
+func sendSuccess(m *commandContext) {
+	erro := m.reply(m.Author.Mention() + " Success")
 	if erro != nil {
 		loglevels.Errorf("Failed to send success message to user %v: %v", m.Author.ID, erro)
 	}
 }
+
+// replyMessages sends the lines in as many messages as needed
+func replyMessages(m *commandContext, lines []string) (err error) {
+	for _, message := range splitMessage(lines, 1900) {
+		if err = m.reply(message); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+// copyRedisToStore copies the redis dataset into the target store.
+// Sessions and cache are not copied, users only have to log in to the dashboard again.
+// The migrations of old datasets need the running bot, so those have to be migrated with the redis storage first.
+// nolint: gocyclo
+func copyRedisToStore(target Store) (err error) {
+	if _, ok := target.(*redisStore); ok {
+		return errors.New("the configured storage is redis already")
+	}
+
+	// only copy data in the latest format
+	versionPool := newPool(dbTypeVersion)
+	version, err := getRedisVersion(versionPool)
+	if erro := versionPool.Close(); erro != nil {
+		loglevels.Errorf("Error closing redis version pool: %v\n", erro)
+	}
+	if err != nil {
+		return
+	}
+	if version != 0 && version != currentRedisVersion {
+		return fmt.Errorf("the redis dataset has version %v, start the bot with the redis storage once to migrate it to version %v", version, currentRedisVersion)
+	}
+
+	source := newRedisStore()
+	defer func() {
+		if erro := source.Close(); erro != nil {
+			loglevels.Errorf("Error closing redis pools: %v\n", erro)
+		}
+	}()
+
+	// remember the first error but copy as much as possible
+	fail := func(e error, format string, a ...interface{}) {
+		loglevels.Errorf(format, a...)
+		if err == nil {
+			err = e
+		}
+	}
+
+	users, erro := source.IterateUsers(func(user string) {
+		keys, e := source.GetAPIKeys(user)
+		if e != nil {
+			fail(e, "Error getting api keys of user %v: %v\n", user, e)
+			return
+		}
+		for _, key := range keys {
+			if e = target.AddAPIKey(user, key); e != nil {
+				fail(e, "Error copying api key of user %v: %v\n", user, e)
+			}
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating users: %v\n", erro)
+	}
+	loglevels.Infof("Copied %v users", users)
+
+	guilds, erro := source.IterateGuilds(func(guild string) {
+		settings, e := source.GetGuildSettings(guild)
+		if e != nil {
+			fail(e, "Error getting settings of guild %v: %v\n", guild, e)
+			return
+		}
+		if e = target.SaveGuildSettings(guild, settings); e != nil {
+			fail(e, "Error copying settings of guild %v: %v\n", guild, e)
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating guilds: %v\n", erro)
+	}
+	loglevels.Infof("Copied %v guilds", guilds)
+
+	roles, erro := source.iterate(source.guildRoles, func(guild string) {
+		managed, e := source.GetManagedRoles(guild)
+		if e != nil {
+			fail(e, "Error getting managed roles of guild %v: %v\n", guild, e)
+			return
+		}
+		for _, role := range managed {
+			if e = target.AddManagedRole(guild, role); e != nil {
+				fail(e, "Error copying managed role %v of guild %v: %v\n", role.ID, guild, e)
+			}
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating managed roles: %v\n", erro)
+	}
+	loglevels.Infof("Copied managed roles of %v guilds", roles)
+
+	accounts, erro := source.iterate(source.uniqueUsers, func(account string) {
+		user, e := source.GetAccountOwner(account)
+		if e != nil {
+			fail(e, "Error getting owner of account %v: %v\n", account, e)
+			return
+		}
+		if e = target.SetAccountOwner(account, user); e != nil {
+			fail(e, "Error copying owner of account %v: %v\n", account, e)
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating account owners: %v\n", erro)
+	}
+	loglevels.Infof("Copied %v account owners", accounts)
+
+	verifies, erro := source.iterate(source.guildVerifies, func(guild string) {
+		worlds, e := source.GetAdditionalWorlds(guild)
+		if e != nil {
+			fail(e, "Error getting additional worlds of guild %v: %v\n", guild, e)
+			return
+		}
+		ttl, e := redis.Int(source.do(source.guildVerifies, "TTL", guild))
+		if e != nil || ttl <= 0 {
+			// already expired or not expiring at all
+			return
+		}
+		for _, world := range worlds {
+			if e = target.AddAdditionalWorld(guild, world, time.Duration(ttl)*time.Second); e != nil {
+				fail(e, "Error copying additional world %v of guild %v: %v\n", world, guild, e)
+			}
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating additional worlds: %v\n", erro)
+	}
+	loglevels.Infof("Copied additional worlds of %v guilds", verifies)
+
+	muted, erro := source.iterate(source.mutedUsers, func(user string) {
+		if e := target.SetNotificationsMuted(user, true); e != nil {
+			fail(e, "Error copying muted notifications of user %v: %v\n", user, e)
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating muted users: %v\n", erro)
+	}
+	loglevels.Infof("Copied %v muted users", muted)
+
+	links, erro := source.iterate(source.worldLinks, func(world string) {
+		id, e := strconv.Atoi(world)
+		if e != nil {
+			fail(e, "Error parsing linked world %v: %v\n", world, e)
+			return
+		}
+		linked, e := source.GetLinkedWorlds(id)
+		if e != nil {
+			fail(e, "Error getting linked worlds of world %v: %v\n", world, e)
+			return
+		}
+		if e = target.SetLinkedWorlds(id, linked); e != nil {
+			fail(e, "Error copying linked worlds of world %v: %v\n", world, e)
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating linked worlds: %v\n", erro)
+	}
+	loglevels.Infof("Copied linked worlds of %v worlds", links)
+
+	snapshots, erro := redis.Strings(source.do(source.worldSnapshots, "ZRANGE", worldSnapshotsKey, 0, -1, "WITHSCORES"))
+	if erro != nil {
+		fail(erro, "Error getting world snapshots: %v\n", erro)
+	}
+	// snapshots alternate between the snapshot and its unix start time
+	for i := 0; i+1 < len(snapshots); i += 2 {
+		start, e := strconv.ParseInt(snapshots[i+1], 10, 64)
+		if e != nil {
+			fail(e, "Error parsing world snapshot start: %v\n", e)
+			continue
+		}
+		if e = target.SaveWorldSnapshot(time.Unix(start, 0), snapshots[i]); e != nil {
+			fail(e, "Error copying world snapshot of %v: %v\n", time.Unix(start, 0), e)
+		}
+	}
+	loglevels.Infof("Copied %v world snapshots", len(snapshots)/2)
+
+	logs, erro := source.iterate(source.auditLog, func(guild string) {
+		entries, e := redis.Strings(source.do(source.auditLog, "ZRANGE", guild, 0, -1, "WITHSCORES"))
+		if e != nil {
+			fail(e, "Error getting audit log of guild %v: %v\n", guild, e)
+			return
+		}
+		// entries alternate between the entry and its unix nano time
+		for i := 0; i+1 < len(entries); i += 2 {
+			at, e := strconv.ParseInt(entries[i+1], 10, 64)
+			if e != nil {
+				fail(e, "Error parsing audit log time of guild %v: %v\n", guild, e)
+				continue
+			}
+			if e = target.AddAuditEntry(guild, time.Unix(0, at), entries[i], auditRetention()); e != nil {
+				fail(e, "Error copying audit log of guild %v: %v\n", guild, e)
+			}
+		}
+	})
+	if erro != nil {
+		fail(erro, "Error iterating audit logs: %v\n", erro)
+	}
+	loglevels.Infof("Copied audit logs of %v guilds", logs)
+
+	return
+}
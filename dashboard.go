@@ -2,19 +2,26 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/gw2api"
 )
 
-func getDashboardTemplate(guildID, userID, state string) (db dashboardTemplate, err error) {
+// newRankRoleRows is the number of empty rows for new rank roles on the dashboard
+const newRankRoleRows = 3
+
+func getDashboardTemplate(guildID, userID, csrf string) (db dashboardTemplate, err error) {
 	settings, err := getGuildSettings(guildID)
 	if err != nil {
 		return
 	}
 
-	worlds := getCurrentWorlds(settings.Gw2ServerID)
+	worlds := getCurrentWorlds(settings.Gw2ServerID, false)
+	teams := getCurrentWorlds(settings.Gw2TeamID, true)
 
-	guilds, err := getDiscordServersTemplate(userID, guildID, state)
+	guilds, err := getDiscordServersTemplate(userID, guildID)
 	if err != nil {
 		return
 	}
@@ -24,13 +31,74 @@ func getDashboardTemplate(guildID, userID, state string) (db dashboardTemplate,
 		return
 	}
 
-	return mergeToDashboardTemplate(settings, worlds, guilds, accounts), err
+	db = mergeToDashboardTemplate(settings, worlds, teams, guilds, accounts)
+	db.CSRFToken = csrf
+	db.AuditChannels = getAuditChannels(guildID, settings.AuditChannelID)
+	db.VerifiedRoles = getRoleChoices(guildID, settings.VerifiedRoleID)
+	db.LinkedRoles = getRoleChoices(guildID, settings.LinkedRoleID)
+	db.NicknameExemptRoles = getRoleChoices(guildID, settings.NicknameExemptRoleID)
+	db.UnverifiedRoles = getRoleChoices(guildID, settings.UnverifiedRoleID)
+	db.VerificationChannels = getAuditChannels(guildID, settings.VerificationChannelID)
+	for _, r := range settings.RankRoles {
+		db.RankRoles = append(db.RankRoles, rankRoleTemplate{
+			MinimumRank: strconv.Itoa(r.MinimumRank),
+			Name:        r.Name,
+			Roles:       getRoleChoices(guildID, r.RoleID),
+		})
+	}
+	for i := 0; i < newRankRoleRows; i++ {
+		db.RankRoles = append(db.RankRoles, rankRoleTemplate{Roles: getRoleChoices(guildID, "")})
+	}
+	for _, r := range settings.AccessRoles {
+		db.AccessRoles = append(db.AccessRoles, accessRoleTemplate{
+			Accesses: getAccessChoices(r.Access),
+			Name:     r.Name,
+			Roles:    getRoleChoices(guildID, r.RoleID),
+		})
+	}
+	for len(db.AccessRoles) < len(accessChoices) {
+		db.AccessRoles = append(db.AccessRoles, accessRoleTemplate{
+			Accesses: getAccessChoices(""),
+			Roles:    getRoleChoices(guildID, ""),
+		})
+	}
+
+	entries, err := getAuditLog(guildID, "", auditDisplayLimit)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		db.AuditLog = append(db.AuditLog, entry.format(memberName(guildID)))
+	}
+	return
+}
+
+// getAuditChannels lists the text channels of the discord server the audit log can be sent to
+func getAuditChannels(guildID, activeID string) (st []serversTemplate) {
+	guild, err := dg.State.Guild(guildID)
+	if err != nil {
+		return
+	}
+	for _, channel := range guild.Channels {
+		if channel.Type != discordgo.ChannelTypeGuildText {
+			continue
+		}
+		st = append(st, serversTemplate{
+			ID:     channel.ID,
+			Name:   channel.Name,
+			Active: channel.ID == activeID,
+		})
+	}
+	return
 }
 
-// getCurrentWorlds uses currentWorlds and builds a []serversTemplate
-func getCurrentWorlds(worldID int) (st []serversTemplate) {
+// getCurrentWorlds uses currentWorlds and builds a []serversTemplate of either the worlds or the teams
+func getCurrentWorlds(worldID int, teams bool) (st []serversTemplate) {
 	st = make([]serversTemplate, 0, len(currentWorlds))
 	for _, world := range currentWorlds {
+		if gw2api.IsTeam(world.ID) != teams {
+			continue
+		}
 		st = append(st, serversTemplate{
 			ID:     fmt.Sprintf("%v", world.ID),
 			Name:   world.Name,
@@ -40,7 +108,7 @@ func getCurrentWorlds(worldID int) (st []serversTemplate) {
 	return
 }
 
-func getDiscordServersTemplate(user, guildID, state string) (st []serversTemplate, err error) {
+func getDiscordServersTemplate(user, guildID string) (st []serversTemplate, err error) {
 	servers, err := getDiscordServers(user)
 	if err != nil {
 		return
@@ -53,7 +121,6 @@ func getDiscordServersTemplate(user, guildID, state string) (st []serversTemplat
 				ID:     server.ID,
 				Name:   server.Name,
 				Active: server.ID == guildID,
-				State:  state,
 			})
 		}
 	}
@@ -70,7 +137,7 @@ func getGw2Accounts(user, activeKey string) (at []accountTemplate, err error) {
 
 	at = make([]accountTemplate, 0, len(keys)+1)
 	ownsActiveKey := false
-	var account gw2Account
+	var account gw2api.Account
 
 	for _, key := range keys {
 		if key == activeKey {
@@ -104,11 +171,41 @@ func getGw2Accounts(user, activeKey string) (at []accountTemplate, err error) {
 	return
 }
 
-func mergeToDashboardTemplate(options *guildOptions, worlds, guilds []serversTemplate, accounts []accountTemplate) dashboardTemplate {
+// getPreviewTemplate builds the preview page of a plan
+func getPreviewTemplate(plan *guildPlan, csrf string) (pt previewTemplate) {
+	pt = previewTemplate{
+		CSRFToken: csrf,
+		GuildID:   plan.GuildID,
+		PlanID:    plan.ID,
+		NewRoles:  plan.NewRoles,
+		Members:   make([]memberPreviewTemplate, 0, len(plan.Members)),
+	}
+	for _, m := range plan.Members {
+		name := m.Member.Nick
+		if name == "" {
+			name = m.Member.User.Username
+		}
+		member := memberPreviewTemplate{
+			Name:     name,
+			Nickname: m.Nickname,
+		}
+		for _, role := range m.Add {
+			member.Add = append(member.Add, role.Name)
+		}
+		for _, role := range m.Remove {
+			member.Remove = append(member.Remove, role.Name)
+		}
+		pt.Members = append(pt.Members, member)
+	}
+	return
+}
+
+func mergeToDashboardTemplate(options *guildOptions, worlds, teams, guilds []serversTemplate, accounts []accountTemplate) dashboardTemplate {
 	return dashboardTemplate{
 		Accounts:       accounts,
 		DiscordServers: guilds,
 		Gw2Servers:     worlds,
+		Gw2Teams:       teams,
 		AllowLinked:    options.AllowLinked,
 		CreateRoles:    options.CreateRoles,
 		DeleteLinked:   options.DeleteLinked,
@@ -116,5 +213,25 @@ func mergeToDashboardTemplate(options *guildOptions, worlds, guilds []serversTem
 		RenameUsers:    options.RenameUsers,
 		VerifyOnly:     options.VerifyOnly,
 		MinimumRank:    options.MinimumRank,
+		WvWGuilds:      strings.Join(options.WvWGuildIDs, ", "),
+		Gw2Guilds:      strings.Join(options.Gw2GuildIDs, ", "),
+		GuildRankRoles: options.GuildRankRoles,
+
+		MinimumAccountAge:     options.MinimumAccountAge,
+		MinimumDailyAP:        options.MinimumDailyAP,
+		MinimumMonthlyAP:      options.MinimumMonthlyAP,
+		MinimumFractalLevel:   options.MinimumFractalLevel,
+		RevokedKeyGracePeriod: options.RevokedKeyGracePeriod,
+		RemovalConfirmations:  options.RemovalConfirmations,
+		RemovalGracePeriod:    options.RemovalGracePeriod,
+		RefuseFreeToPlay:      options.RefuseFreeToPlay,
+
+		VerifiedRoleName:   options.VerifiedRoleName,
+		LinkedRoleName:     options.LinkedRoleName,
+		WorldRoleName:      options.WorldRoleName,
+		GiveUnverifiedRole: options.GiveUnverifiedRole,
+		UnverifiedRoleName: options.UnverifiedRoleName,
+		NicknameTemplate:   options.NicknameTemplate,
+		NicknameAccount:    options.NicknameAccount,
 	}
 }
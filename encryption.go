@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptionKeysEnv overrides config.EncryptionKeys when set. Keys are separated by commas
+const encryptionKeysEnv = "WVWBOT_ENCRYPTION_KEYS"
+
+// encryptedPrefix marks a stored value as encrypted. Values without it are plain text
+const encryptedPrefix = "enc1:"
+
+// keyring holds the keys to encrypt api keys at rest.
+// The first key encrypts, every key decrypts. It is empty if encryption is disabled
+var keyring []encryptionKey
+
+type encryptionKey struct {
+	// id identifies the key in the stored value so old keys can be rotated out
+	id   string
+	aead cipher.AEAD
+}
+
+// initializeEncryption loads the keyring from the environment or the config
+func initializeEncryption() (err error) {
+	keys := config.EncryptionKeys
+	if env := os.Getenv(encryptionKeysEnv); env != "" {
+		keys = strings.Split(env, ",")
+	}
+
+	keyring = make([]encryptionKey, 0, len(keys))
+	for i, encoded := range keys {
+		var raw []byte
+		raw, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("encryption key %v is not valid base64: %v", i, err)
+		}
+		if len(raw) != 32 {
+			return fmt.Errorf("encryption key %v has %v bytes instead of 32", i, len(raw))
+		}
+
+		var block cipher.Block
+		block, err = aes.NewCipher(raw)
+		if err != nil {
+			return
+		}
+		var aead cipher.AEAD
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return
+		}
+
+		sum := sha256.Sum256(raw)
+		keyring = append(keyring, encryptionKey{
+			id:   hex.EncodeToString(sum[:4]),
+			aead: aead,
+		})
+	}
+	return
+}
+
+// encrypt seals the value with the current key. Returns the value unchanged if encryption is disabled
+func encrypt(value string) (string, error) {
+	if len(keyring) == 0 {
+		return value, nil
+	}
+	key := keyring[0]
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(value), []byte(key.id))
+	return encryptedPrefix + key.id + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a value sealed by encrypt with any key of the keyring. Plain text values are returned unchanged
+func decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range keyring {
+		if key.id != parts[0] {
+			continue
+		}
+		if len(sealed) < key.aead.NonceSize() {
+			return "", errors.New("malformed encrypted value")
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, []byte(key.id))
+		if err != nil {
+			return "", err
+		}
+		return string(plain), nil
+	}
+	return "", fmt.Errorf("value is encrypted with unknown key %v", parts[0])
+}
+
+// needsEncryption reports whether a stored value is not encrypted with the current key
+func needsEncryption(value string) bool {
+	if len(keyring) == 0 {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedPrefix+keyring[0].id+":")
+}
+
+// hashKey returns a stable representation of an api key that can be used in key names of the storage
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
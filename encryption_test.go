@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testEncryptionKey returns a base64 encoded 32 byte key filled with the byte
+func testEncryptionKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// useEncryptionKeys loads the keys into the keyring, the first one encrypts
+func useEncryptionKeys(t *testing.T, keys ...string) {
+	previousKeys, previousEnv := config.EncryptionKeys, os.Getenv(encryptionKeysEnv)
+	defer func() {
+		config.EncryptionKeys = previousKeys
+		os.Setenv(encryptionKeysEnv, previousEnv)
+	}()
+	config.EncryptionKeys = keys
+	os.Unsetenv(encryptionKeysEnv)
+	if err := initializeEncryption(); err != nil {
+		t.Fatalf("initializing encryption: %v", err)
+	}
+}
+
+// resetKeyring disables encryption for the following tests
+func resetKeyring() {
+	keyring = nil
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	defer resetKeyring()
+	useEncryptionKeys(t, testEncryptionKey(1))
+
+	encrypted, err := encrypt("api-key")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	if prefix := encryptedPrefix + keyring[0].id + ":"; !strings.HasPrefix(encrypted, prefix) {
+		t.Errorf("got %q, expected the prefix %q", encrypted, prefix)
+	}
+	if strings.Contains(encrypted, "api-key") {
+		t.Errorf("got %q, expected the key to be sealed", encrypted)
+	}
+	if again, _ := encrypt("api-key"); again == encrypted {
+		t.Error("expected a new nonce for every encryption")
+	}
+	if needsEncryption(encrypted) {
+		t.Error("expected a value of the current key to not need encryption")
+	}
+
+	decrypted, err := decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("decrypting: %v", err)
+	}
+	if decrypted != "api-key" {
+		t.Errorf("got %q, expected %q", decrypted, "api-key")
+	}
+}
+
+func TestEncryptionPlainText(t *testing.T) {
+	defer resetKeyring()
+	resetKeyring()
+
+	value, err := encrypt("api-key")
+	if err != nil || value != "api-key" {
+		t.Errorf("got %q, %v without keys, expected the value unchanged", value, err)
+	}
+	if needsEncryption("api-key") {
+		t.Error("expected no encryption without keys")
+	}
+
+	useEncryptionKeys(t, testEncryptionKey(1))
+	value, err = decrypt("api-key")
+	if err != nil || value != "api-key" {
+		t.Errorf("got %q, %v for plain text, expected the value unchanged", value, err)
+	}
+	if !needsEncryption("api-key") {
+		t.Error("expected plain text to need encryption")
+	}
+}
+
+func TestDecryptInvalidValues(t *testing.T) {
+	defer resetKeyring()
+	useEncryptionKeys(t, testEncryptionKey(1))
+	encrypted, err := encrypt("api-key")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	sealed := strings.TrimPrefix(encrypted, encryptedPrefix+keyring[0].id+":")
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	raw[len(raw)-1] ^= 1
+	tampered := base64.RawURLEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"unknown key id", encryptedPrefix + "deadbeef:" + sealed},
+		{"missing key id", encryptedPrefix + sealed},
+		{"invalid base64", encryptedPrefix + keyring[0].id + ":!!!"},
+		{"too short", encryptedPrefix + keyring[0].id + ":AAAA"},
+		{"tampered", encryptedPrefix + keyring[0].id + ":" + tampered},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if value, err := decrypt(test.value); err == nil {
+				t.Errorf("got %q, expected an error", value)
+			}
+		})
+	}
+}
+
+func TestEncryptionRotation(t *testing.T) {
+	defer resetKeyring()
+	useEncryptionKeys(t, testEncryptionKey(1))
+	old, err := encrypt("api-key")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+
+	useEncryptionKeys(t, testEncryptionKey(2), testEncryptionKey(1))
+	if !needsEncryption(old) {
+		t.Error("expected a value of the old key to need encryption")
+	}
+	if value, erro := decrypt(old); erro != nil || value != "api-key" {
+		t.Errorf("got %q, %v with the old key second, expected %q", value, erro, "api-key")
+	}
+
+	useEncryptionKeys(t, testEncryptionKey(2))
+	if _, err = decrypt(old); err == nil {
+		t.Error("expected an error after the old key was removed")
+	}
+}
+
+func TestEncryptStoredKeys(t *testing.T) {
+	previousDatabase := database
+	defer func() { database = previousDatabase }()
+	defer resetKeyring()
+	database = newMemoryStore()
+
+	useEncryptionKeys(t, testEncryptionKey(1))
+	old, err := encrypt("old-key")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	if err = database.AddAPIKey("user", old); err != nil {
+		t.Fatalf("adding api key: %v", err)
+	}
+	if err = database.AddAPIKey("user", "plain-key"); err != nil {
+		t.Fatalf("adding api key: %v", err)
+	}
+	if err = database.SaveGuildSettings("guild", &guildOptions{Gw2AccountKey: "guild-key"}); err != nil {
+		t.Fatalf("saving guild settings: %v", err)
+	}
+
+	useEncryptionKeys(t, testEncryptionKey(2), testEncryptionKey(1))
+	if err = encryptStoredKeys(); err != nil {
+		t.Fatalf("encrypting stored keys: %v", err)
+	}
+
+	stored, err := database.GetAPIKeys("user")
+	if err != nil {
+		t.Fatalf("getting api keys: %v", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("got %v stored keys, expected 2", len(stored))
+	}
+	for _, value := range stored {
+		if needsEncryption(value) {
+			t.Errorf("got %q, expected it to be encrypted with the current key", value)
+		}
+	}
+	keys, err := getAPIKeys("user")
+	if err != nil {
+		t.Fatalf("getting api keys: %v", err)
+	}
+	if !equalStrings(keys, []string{"old-key", "plain-key"}) {
+		t.Errorf("got keys %v, expected old-key and plain-key", keys)
+	}
+
+	settings, err := database.GetGuildSettings("guild")
+	if err != nil {
+		t.Fatalf("getting guild settings: %v", err)
+	}
+	if needsEncryption(settings.Gw2AccountKey) {
+		t.Errorf("got guild key %q, expected it to be encrypted with the current key", settings.Gw2AccountKey)
+	}
+	if settings, err = getGuildSettings("guild"); err != nil {
+		t.Fatalf("getting guild settings: %v", err)
+	}
+	if settings.Gw2AccountKey != "guild-key" {
+		t.Errorf("got guild key %q, expected %q", settings.Gw2AccountKey, "guild-key")
+	}
+}
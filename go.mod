@@ -3,7 +3,10 @@ module github.com/greaka/discordwvwbot
 go 1.14
 
 require (
-	github.com/bwmarrin/discordgo v0.21.1
+	github.com/bwmarrin/discordgo v0.28.1
 	github.com/gomodule/redigo v1.8.2
+	github.com/lib/pq v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.5
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 )
@@ -1,86 +1,122 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"net/http"
-	"strings"
+	"net/url"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/greaka/discordwvwbot/gw2api"
 	"github.com/greaka/discordwvwbot/loglevels"
 )
 
-func getTokenInfo(key string) (token tokenInfo, err error) {
+func getTokenInfo(key string) (token gw2api.TokenInfo, err error) {
 	retries := 0
-	err = gw2Request("/tokeninfo?access_token="+key, &token)
+	token, err = gw2Client.TokenInfo(context.Background(), key)
 	for err != nil && retries < 3 {
-		err = gw2Request("/tokeninfo?access_token="+key, &token)
+		token, err = gw2Client.TokenInfo(context.Background(), key)
 		retries += 1
 	}
 	return
 }
 
 // used by migration
-func getCheckedGw2Account(key string, userID struct {
+func getCheckedGw2Account(ctx context.Context, key string, userID struct {
 	string
 	bool
-}) (account gw2Account, err error) {
+}) (account gw2api.Account, err error) {
 	retries := 0
 	var erro error
-	account, erro = getCachedGw2Account(key)
+	account, erro = getCachedGw2Account(ctx, key)
 	if erro != nil {
 		invalid := func() bool {
-			return strings.Contains(erro.Error(), "invalid key") || strings.Contains(erro.Error(), "Invalid access token")
+			return errors.Is(erro, gw2api.ErrInvalidKey)
+		}
+		// keys that are known to be invalid are not retried until they are deleted
+		if invalid() && !keyRevokedSince(key).IsZero() {
+			retries = 5
 		}
 
-		for (userID.bool || invalid()) && retries < 5 {
+		for (userID.bool || invalid()) && retries < 5 && ctx.Err() == nil {
 			retries++
-			<-time.After(delayBetweenUsers)
-			account, erro = getCachedGw2Account(key)
+			select {
+			case <-time.After(delayBetweenUsers):
+			case <-ctx.Done():
+			}
+			account, erro = getCachedGw2Account(ctx, key)
 			if erro == nil {
+				keyValid(key, account.Name)
 				return
 			}
 		}
-		// if the key got revoked, delete it
+		// if the key got revoked, notify the user and delete it after the grace period
 		if invalid() {
 			loglevels.Infof("Encountered invalid key at %v", userID.string)
-			redisConn := usersDatabase.Get()
-			_, erro = redisConn.Do("SREM", userID.string, key)
-			closeConnection(redisConn)
-			if erro != nil {
-				loglevels.Errorf("Error deleting api key from redis: %v", erro)
-			}
+			keyRevoked(userID.string, key)
 			return
 		}
 		loglevels.Warningf("Error getting account info: %v\n", erro)
 		// unexpected error, don't revoke discord roles because of a server error
 		err = erro
+		return
 	}
+	keyValid(key, account.Name)
 	return
 }
 
-func getGw2Account(key string) (account gw2Account, err error) {
-	err = gw2Request("/account?access_token="+key, &account)
-	return
+func getGw2Account(key string) (account gw2api.Account, err error) {
+	return gw2Client.Account(context.Background(), key)
 }
 
-func getCachedGw2Account(key string) (account gw2Account, err error) {
+func getCachedGw2Account(ctx context.Context, key string) (account gw2api.Account, err error) {
 	expire := int(delayBetweenFullUpdates.Seconds()) // delayBetweenFullUpdates will be set after the first run
 	if expire == 0 {
 		expire = 15 * 60 // 15 min
 	}
-	err = cacheGw2Request("/account?access_token="+key, key, "gw2Account", expire, &account)
+	err = cacheGw2Request(ctx, "/account", key, "gw2Account", expire, &account)
+	return
+}
+
+func getCachedGw2AccountWvW(ctx context.Context, key string) (wvw gw2api.AccountWvW, err error) {
+	expire := int(delayBetweenFullUpdates.Seconds())
+	if expire == 0 {
+		expire = 15 * 60 // 15 min
+	}
+	err = cacheGw2Request(ctx, "/account/wvw", key, "gw2AccountWvW", expire, &wvw)
+	return
+}
+
+// getCachedGw2TokenInfo returns the name and permissions of the key
+func getCachedGw2TokenInfo(ctx context.Context, key string) (token gw2api.TokenInfo, err error) {
+	// the permissions of a key never change
+	err = cacheGw2Request(ctx, "/tokeninfo", key, "gw2TokenInfo", 24*60*60, &token)
+	return
+}
+
+func getCachedGw2Guild(ctx context.Context, id string) (guild gw2api.Guild, err error) {
+	// guild names rarely change
+	err = cacheGw2Request(ctx, "/guild/"+url.PathEscape(id), "", "gw2Guild"+id, 24*60*60, &guild)
+	return
+}
+
+// getCachedGw2GuildMembers returns the members of the guild, the key has to belong to a leader of the guild
+func getCachedGw2GuildMembers(ctx context.Context, id, key string) (members []gw2api.GuildMember, err error) {
+	expire := int(delayBetweenFullUpdates.Seconds())
+	if expire == 0 {
+		expire = 15 * 60 // 15 min
+	}
+	err = cacheGw2Request(ctx, "/guild/"+url.PathEscape(id)+"/members", key, "gw2GuildMembers"+id, expire, &members)
 	return
 }
 
-func cacheGw2Request(endpoint, token, cache string, seconds int, result interface{}) (err error) {
-	c := cacheDatabase.Get()
-	defer closeConnection(c)
-	resultstring, err := redis.String(c.Do("GET", cache+token))
+// cacheGw2Request returns the cached response of the endpoint for the key or requests it.
+// The key only shows up hashed in the cache key names
+func cacheGw2Request(ctx context.Context, endpoint, key, cache string, seconds int, result interface{}) (err error) {
+	token := hashKey(key)
+	resultstring, err := database.GetCache(cache + token)
 	if err != nil {
-		if !strings.Contains(err.Error(), "nil returned") {
+		if err != errNotFound {
 			loglevels.Errorf("Error getting cache %v: %v\n", token, err)
 		}
 	} else {
@@ -92,9 +128,9 @@ func cacheGw2Request(endpoint, token, cache string, seconds int, result interfac
 		return
 	}
 
-	err = gw2Request(endpoint, &result)
+	err = gw2Client.Get(ctx, endpoint, key, result)
 	if err != nil {
-		loglevels.Warningf("Error getting %v: %v\n", endpoint[:22], err)
+		loglevels.Warningf("Error getting %v: %v\n", endpoint, err)
 		return
 	}
 
@@ -103,7 +139,7 @@ func cacheGw2Request(endpoint, token, cache string, seconds int, result interfac
 		loglevels.Warningf("Error marshaling cache: %v\n", erro)
 		return
 	}
-	_, erro = c.Do("SET", cache+token, string(resultbytes), "EX", seconds)
+	erro = database.SetCache(cache+token, string(resultbytes), time.Duration(seconds)*time.Second)
 	if erro != nil {
 		loglevels.Warningf("Error setting cache: %v", erro)
 		return
@@ -112,65 +148,10 @@ func cacheGw2Request(endpoint, token, cache string, seconds int, result interfac
 	return
 }
 
-func getCurrentMatches() (matches []matchOverview, err error) {
-	err = gw2Request("/wvw/matches/overview?ids=all", &matches)
-	return
-}
-
-func getWorlds() (worlds []worldStruct, err error) {
-	err = gw2Request("/worlds?ids=all", &worlds)
-	return
+func getCurrentMatches(ctx context.Context) (matches []gw2api.MatchOverview, err error) {
+	return gw2Client.MatchesOverview(ctx)
 }
 
-func gw2Request(endpoint string, result interface{}) (err error) {
-	var resx *http.Response
-	for {
-		// get data
-		var res *http.Response
-		<-bucket
-		res, err = http.Get(gw2APIURL + endpoint)
-		if err != nil {
-			loglevels.Errorf("Error getting %v: %v\n", endpoint, err)
-			return
-		}
-		defer func() {
-			if erro := res.Body.Close(); erro != nil {
-				loglevels.Errorf("Error closing response body: %v\n", erro)
-			}
-		}()
-
-		if res.StatusCode >= 300 {
-			errorString, _ := ioutil.ReadAll(res.Body) // nolint: gosec
-			if res.StatusCode == 429 {
-				loglevels.Warning("hit rate limit")
-				for {
-					select {
-					case <-bucket:
-					default:
-						<-bucket
-						break
-					}
-				}
-				continue
-			}
-			err = errors.New(string(errorString))
-			return
-		}
-
-		resx = res
-		break
-	}
-
-	// parse
-	jsonParser := json.NewDecoder(resx.Body)
-	err = jsonParser.Decode(result)
-	if err != nil {
-		if resx.StatusCode >= 500 {
-			loglevels.Warningf("Internal api server error: %v\n", resx.Status)
-		} else {
-			loglevels.Errorf("Error parsing json to %v data: %v\n", endpoint, err)
-		}
-		return
-	}
-	return
+func getWorlds(ctx context.Context) (worlds []gw2api.World, err error) {
+	return gw2Client.Worlds(ctx)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/gw2api/gw2apitest"
+)
+
+func TestGetAccountData(t *testing.T) {
+	server := gw2apitest.NewServer()
+	defer server.Close()
+
+	account := gw2api.Account{
+		ID:      "account-id",
+		Name:    "Verified.1234",
+		World:   2201,
+		Access:  []string{gw2api.AccessGuildWars2},
+		Created: "2015-08-28T12:00:00Z",
+	}
+	account.WvW.TeamID = 12001
+	account.WvW.Rank = 150
+
+	previousDatabase, previousClient := database, gw2Client
+	defer func() {
+		database, gw2Client = previousDatabase, previousClient
+	}()
+	gw2Client = server.NewClient()
+
+	tests := []struct {
+		name string
+		// setup runs after the key of the user was added
+		setup   func(t *testing.T)
+		err     bool
+		worlds  []int
+		revoked bool
+		keys    int
+	}{
+		{"valid key", func(t *testing.T) {
+			server.AddKey("key", gw2api.TokenInfo{Name: "wvwbot"}, account)
+		}, false, []int{2201}, false, 1},
+		{"api down", func(t *testing.T) {
+			server.AddKey("key", gw2api.TokenInfo{Name: "wvwbot"}, account)
+			server.SetStatus(http.StatusServiceUnavailable)
+		}, true, nil, false, 1},
+		{"api down with last known data", func(t *testing.T) {
+			server.AddKey("key", gw2api.TokenInfo{Name: "wvwbot"}, account)
+			rememberAccount("key", account, gw2api.AccountWvW{Team: 12001}, nil)
+			server.SetStatus(http.StatusServiceUnavailable)
+		}, false, []int{2201}, false, 1},
+		// invalid keys are retried a few times before they count as revoked
+		{"revoked key", func(t *testing.T) {
+			server.RevokeKey("key")
+		}, false, nil, true, 1},
+		{"account of another user", func(t *testing.T) {
+			server.AddKey("key", gw2api.TokenInfo{Name: "wvwbot"}, account)
+			if err := database.SetAccountOwner(account.ID, "other"); err != nil {
+				t.Fatalf("setting account owner: %v", err)
+			}
+		}, false, nil, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			defer server.SetStatus(0)
+			if err := database.AddAPIKey("user", "key"); err != nil {
+				t.Fatalf("adding api key: %v", err)
+			}
+			test.setup(t)
+
+			data, err := getAccountData(context.Background(), struct {
+				string
+				bool
+			}{string: "user"})
+			if (err != nil) != test.err {
+				t.Errorf("got error %v, expected an error: %v", err, test.err)
+			}
+			var worlds []int
+			for _, world := range data.Worlds {
+				worlds = append(worlds, world.ID)
+				if world.Team != 12001 || world.rank != 150 || world.Account != account.Name {
+					t.Errorf("got account data %+v of %+v", world, account)
+				}
+			}
+			if !sameWorlds(worlds, test.worlds) {
+				t.Errorf("got worlds %v, expected %v", worlds, test.worlds)
+			}
+			if data.Revoked != test.revoked || (data.Revoked && data.RevokedSince.IsZero()) {
+				t.Errorf("got revoked %v since %v, expected %v", data.Revoked, data.RevokedSince, test.revoked)
+			}
+			if keys, _ := database.GetAPIKeys("user"); len(keys) != test.keys {
+				t.Errorf("got %v api keys left, expected %v", len(keys), test.keys)
+			}
+		})
+	}
+}
+
+func TestGetKnownAccountData(t *testing.T) {
+	account := gw2api.Account{
+		ID:    "account-id",
+		Name:  "Verified.1234",
+		World: 2201,
+	}
+
+	previousDatabase := database
+	defer func() {
+		database = previousDatabase
+	}()
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T)
+		err     bool
+		worlds  []int
+		revoked bool
+	}{
+		{"known account", func(t *testing.T) {
+			rememberAccount("key", account, gw2api.AccountWvW{Team: 12001}, nil)
+		}, false, []int{2201}, false},
+		{"unknown account", func(t *testing.T) {}, true, nil, false},
+		{"revoked key", func(t *testing.T) {
+			rememberAccount("key", account, gw2api.AccountWvW{Team: 12001}, nil)
+			saveKeyState("key", keyState{Account: account.Name, RevokedSince: time.Now().Add(-time.Hour)})
+		}, false, nil, true},
+		{"account of another user", func(t *testing.T) {
+			rememberAccount("key", account, gw2api.AccountWvW{Team: 12001}, nil)
+			if err := database.SetAccountOwner(account.ID, "other"); err != nil {
+				t.Fatalf("setting account owner: %v", err)
+			}
+		}, false, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			if err := database.AddAPIKey("user", "key"); err != nil {
+				t.Fatalf("adding api key: %v", err)
+			}
+			test.setup(t)
+
+			data, err := getKnownAccountData("user")
+			if (err != nil) != test.err {
+				t.Errorf("got error %v, expected an error: %v", err, test.err)
+			}
+			var worlds []int
+			for _, world := range data.Worlds {
+				worlds = append(worlds, world.ID)
+			}
+			if !sameWorlds(worlds, test.worlds) {
+				t.Errorf("got worlds %v, expected %v", worlds, test.worlds)
+			}
+			if data.Revoked != test.revoked {
+				t.Errorf("got revoked %v, expected %v", data.Revoked, test.revoked)
+			}
+			// previews must never remove keys
+			if keys, _ := database.GetAPIKeys("user"); len(keys) != 1 {
+				t.Errorf("got %v api keys left, expected the key to stay", len(keys))
+			}
+		})
+	}
+}
+
+func TestGetAccountDataPermissions(t *testing.T) {
+	server := gw2apitest.NewServer()
+	defer server.Close()
+
+	account := gw2api.Account{ID: "account-id", Name: "Verified.1234", World: 2201}
+
+	previousDatabase, previousClient := database, gw2Client
+	defer func() {
+		database, gw2Client = previousDatabase, previousClient
+	}()
+	gw2Client = server.NewClient()
+
+	tests := []struct {
+		name        string
+		permissions []string
+		// down lets the gw2 api fail after the last known data of the key was saved
+		down    bool
+		missing bool
+	}{
+		{"progression", []string{"account", "progression"}, false, false},
+		{"no progression", []string{"account"}, false, true},
+		{"no progression while the api is down", []string{"account"}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			defer server.SetStatus(0)
+			if err := database.AddAPIKey("user", "key"); err != nil {
+				t.Fatalf("adding api key: %v", err)
+			}
+			server.AddKey("key", gw2api.TokenInfo{Name: "wvwbot", Permissions: test.permissions}, account)
+			if test.down {
+				rememberAccount("key", account, gw2api.AccountWvW{}, test.permissions)
+				server.SetStatus(http.StatusServiceUnavailable)
+			}
+
+			data, err := getAccountData(context.Background(), struct {
+				string
+				bool
+			}{string: "user"})
+			if err != nil {
+				t.Fatalf("getting account data: %v", err)
+			}
+			if len(data.Worlds) != 1 {
+				t.Fatalf("got worlds %+v, expected one account", data.Worlds)
+			}
+			if data.Worlds[0].MissingProgression != test.missing {
+				t.Errorf("got missing progression %v, expected %v", data.Worlds[0].MissingProgression, test.missing)
+			}
+		})
+	}
+}
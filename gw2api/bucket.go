@@ -0,0 +1,78 @@
+package gw2api
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket to stay below the rate limit of the api
+type Bucket struct {
+	tokens chan struct{}
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewBucket creates a full bucket with size tokens that refills refillPerSecond tokens every second
+func NewBucket(size, refillPerSecond int) *Bucket {
+	b := &Bucket{
+		tokens: make(chan struct{}, size),
+		stop:   make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		b.tokens <- struct{}{}
+	}
+	go b.fill(refillPerSecond)
+	return b
+}
+
+func (b *Bucket) fill(refillPerSecond int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		for i := 0; i < refillPerSecond; i++ {
+			select {
+			case b.tokens <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Take waits until a token is available or the context is done
+func (b *Bucket) Take(ctx context.Context) error {
+	select {
+	case <-b.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain removes every available token, used after hitting the rate limit anyway
+func (b *Bucket) Drain() {
+	for {
+		select {
+		case <-b.tokens:
+		default:
+			return
+		}
+	}
+}
+
+// Available returns the number of tokens left
+func (b *Bucket) Available() int {
+	return len(b.tokens)
+}
+
+// Stop stops refilling the bucket
+func (b *Bucket) Stop() {
+	b.once.Do(func() {
+		close(b.stop)
+	})
+}
@@ -0,0 +1,172 @@
+// Package gw2api is a client for the parts of the Guild Wars 2 api the bot uses
+package gw2api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the official api
+	DefaultBaseURL = "https://api.guildwars2.com/v2"
+
+	// DefaultSchemaVersion is the schema all types of this package are written for
+	DefaultSchemaVersion = "2024-07-20T01:00:00.000Z"
+
+	// rateLimitRetries is how often a request is retried after hitting the rate limit
+	rateLimitRetries = 3
+)
+
+// Client sends requests to the api
+type Client struct {
+	// BaseURL is the url including the version, without trailing slash
+	BaseURL string
+
+	// HTTPClient sends the requests
+	HTTPClient *http.Client
+
+	// Limiter is taken from before every request. No rate limiting happens if it is nil
+	Limiter *Bucket
+
+	// Language is sent as Accept-Language, it changes names like world names
+	Language string
+
+	// SchemaVersion is sent as X-Schema-Version
+	SchemaVersion string
+}
+
+// NewClient creates a client for the official api that stays below its rate limit of 600 requests per minute
+func NewClient() *Client {
+	return &Client{
+		BaseURL:       DefaultBaseURL,
+		HTTPClient:    &http.Client{Timeout: 30 * time.Second},
+		Limiter:       NewBucket(600, 10),
+		Language:      "en",
+		SchemaVersion: DefaultSchemaVersion,
+	}
+}
+
+// Get requests the endpoint and decodes the json response into result.
+// The key is sent as bearer token if it is not empty, so it never shows up in urls
+func (c *Client) Get(ctx context.Context, endpoint, key string, result interface{}) (err error) {
+	for retries := 0; ; retries++ {
+		if c.Limiter != nil {
+			if err = c.Limiter.Take(ctx); err != nil {
+				return
+			}
+		}
+
+		var res *http.Response
+		res, err = c.do(ctx, endpoint, key)
+		if err != nil {
+			return
+		}
+
+		if res.StatusCode == http.StatusTooManyRequests && retries < rateLimitRetries {
+			closeBody(res)
+			// we hit the limit anyway, so make everyone wait for the bucket to refill
+			if c.Limiter != nil {
+				c.Limiter.Drain()
+			}
+			continue
+		}
+
+		if res.StatusCode >= 300 {
+			err = newAPIError(res)
+			closeBody(res)
+			return
+		}
+
+		err = json.NewDecoder(res.Body).Decode(result)
+		closeBody(res)
+		return
+	}
+}
+
+func (c *Client) do(ctx context.Context, endpoint, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if c.Language != "" {
+		req.Header.Set("Accept-Language", c.Language)
+	}
+	if c.SchemaVersion != "" {
+		req.Header.Set("X-Schema-Version", c.SchemaVersion)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+func newAPIError(res *http.Response) *APIError {
+	body, _ := ioutil.ReadAll(res.Body) // nolint: errcheck, gosec
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		Text:       string(body),
+	}
+	// the api answers with {"text": "..."} on most errors
+	var text struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(body, &text) == nil && text.Text != "" {
+		apiErr.Text = text.Text
+	}
+	return apiErr
+}
+
+func closeBody(res *http.Response) {
+	_ = res.Body.Close() // nolint: errcheck, gosec
+}
+
+// TokenInfo returns the permissions and name of the key
+func (c *Client) TokenInfo(ctx context.Context, key string) (token TokenInfo, err error) {
+	err = c.Get(ctx, "/tokeninfo", key, &token)
+	return
+}
+
+// Account returns the account the key belongs to
+func (c *Client) Account(ctx context.Context, key string) (account Account, err error) {
+	err = c.Get(ctx, "/account", key, &account)
+	return
+}
+
+// AccountWvW returns the team and the selected wvw guild of the account the key belongs to
+func (c *Client) AccountWvW(ctx context.Context, key string) (wvw AccountWvW, err error) {
+	err = c.Get(ctx, "/account/wvw", key, &wvw)
+	return
+}
+
+// Guild returns the public data of a guild
+func (c *Client) Guild(ctx context.Context, id string) (guild Guild, err error) {
+	err = c.Get(ctx, "/guild/"+url.PathEscape(id), "", &guild)
+	return
+}
+
+// GuildMembers returns the members of a guild, the key has to belong to a leader of the guild
+func (c *Client) GuildMembers(ctx context.Context, id, key string) (members []GuildMember, err error) {
+	err = c.Get(ctx, "/guild/"+url.PathEscape(id)+"/members", key, &members)
+	return
+}
+
+// Worlds returns all worlds
+func (c *Client) Worlds(ctx context.Context) (worlds []World, err error) {
+	err = c.Get(ctx, "/worlds?ids=all", "", &worlds)
+	return
+}
+
+// MatchesOverview returns all current wvw matches
+func (c *Client) MatchesOverview(ctx context.Context) (matches []MatchOverview, err error) {
+	err = c.Get(ctx, "/wvw/matches/overview?ids=all", "", &matches)
+	return
+}
@@ -0,0 +1,95 @@
+package gw2api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/gw2api/gw2apitest"
+)
+
+func TestClientAgainstFakeServer(t *testing.T) {
+	server := gw2apitest.NewServer()
+	defer server.Close()
+	client := server.NewClient()
+	ctx := context.Background()
+
+	account := gw2api.Account{
+		ID:          "account-id",
+		Name:        "Leader.1234",
+		World:       2201,
+		GuildLeader: []string{"leader-guild"},
+	}
+	account.WvW.TeamID = 12001
+	server.AddKey("leader", gw2api.TokenInfo{Name: "wvwbot"}, account)
+	server.AddKey("member", gw2api.TokenInfo{Name: "wvwbot"}, gw2api.Account{ID: "member-id", Name: "Member.1234", World: 2202})
+	server.SetGuildMembers("leader-guild", []gw2api.GuildMember{{Name: "Leader.1234", Rank: "Leader"}})
+
+	got, err := client.Account(ctx, "leader")
+	if err != nil {
+		t.Fatalf("getting account: %v", err)
+	}
+	if got.ID != account.ID || got.World != 2201 {
+		t.Errorf("got account %+v, expected %+v", got, account)
+	}
+	wvw, err := client.AccountWvW(ctx, "leader")
+	if err != nil || wvw.Team != 12001 {
+		t.Errorf("got wvw %+v (%v), expected team 12001", wvw, err)
+	}
+	members, err := client.GuildMembers(ctx, "leader-guild", "leader")
+	if err != nil || len(members) != 1 {
+		t.Errorf("got guild members %v (%v) as leader", members, err)
+	}
+
+	tests := []struct {
+		name        string
+		status      int
+		request     func() error
+		invalidKey  bool
+		rateLimited bool
+		serverError bool
+	}{
+		{"unknown key", 0, func() error {
+			_, err := client.Account(ctx, "unknown")
+			return err
+		}, true, false, false},
+		{"guild members of a non leader", 0, func() error {
+			_, err := client.GuildMembers(ctx, "leader-guild", "member")
+			return err
+		}, false, false, false},
+		{"rate limited", http.StatusTooManyRequests, func() error {
+			_, err := client.Account(ctx, "leader")
+			return err
+		}, false, true, false},
+		{"server down", http.StatusServiceUnavailable, func() error {
+			_, err := client.Account(ctx, "leader")
+			return err
+		}, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.SetStatus(test.status)
+			defer server.SetStatus(0)
+			err := test.request()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := errors.Is(err, gw2api.ErrInvalidKey); got != test.invalidKey {
+				t.Errorf("ErrInvalidKey: got %v for %v, expected %v", got, err, test.invalidKey)
+			}
+			if got := errors.Is(err, gw2api.ErrRateLimited); got != test.rateLimited {
+				t.Errorf("ErrRateLimited: got %v for %v, expected %v", got, err, test.rateLimited)
+			}
+			if got := errors.Is(err, gw2api.ErrServerError); got != test.serverError {
+				t.Errorf("ErrServerError: got %v for %v, expected %v", got, err, test.serverError)
+			}
+		})
+	}
+
+	server.RevokeKey("leader")
+	if _, err = client.Account(ctx, "leader"); !errors.Is(err, gw2api.ErrInvalidKey) {
+		t.Errorf("got %v for a revoked key, expected ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,48 @@
+package gw2api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidKey matches errors caused by a revoked or malformed api key, not by missing permissions
+	ErrInvalidKey = errors.New("gw2api: invalid key")
+
+	// ErrRateLimited matches errors caused by hitting the rate limit of the api
+	ErrRateLimited = errors.New("gw2api: rate limited")
+
+	// ErrServerError matches errors caused by the api being down or failing internally
+	ErrServerError = errors.New("gw2api: server error")
+)
+
+// APIError is returned for every response with an unsuccessful status code.
+// Use errors.Is with ErrInvalidKey, ErrRateLimited or ErrServerError to check the reason
+type APIError struct {
+	StatusCode int
+	// Text holds the error text returned by the api
+	Text string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gw2api: status %v: %v", e.StatusCode, e.Text)
+}
+
+// Is implements the matching of the sentinel errors for errors.Is
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidKey:
+		// 403 is also returned for missing permissions, like guild members for keys of non-leaders, so only the text counts there
+		if e.StatusCode == 401 {
+			return true
+		}
+		text := strings.ToLower(e.Text)
+		return e.StatusCode >= 400 && e.StatusCode < 500 && (strings.Contains(text, "invalid key") || strings.Contains(text, "invalid access token"))
+	case ErrRateLimited:
+		return e.StatusCode == 429
+	case ErrServerError:
+		return e.StatusCode >= 500
+	}
+	return false
+}
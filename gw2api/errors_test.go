@@ -0,0 +1,40 @@
+package gw2api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAPIErrorIs(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         *APIError
+		invalidKey  bool
+		rateLimited bool
+		serverError bool
+	}{
+		{"unauthorized", &APIError{StatusCode: 401, Text: "Invalid access token"}, true, false, false},
+		{"old invalid key", &APIError{StatusCode: 400, Text: "invalid key"}, true, false, false},
+		{"invalid access token", &APIError{StatusCode: 400, Text: "Invalid access token"}, true, false, false},
+		{"missing permission", &APIError{StatusCode: 403, Text: "access restricted to guild leaders"}, false, false, false},
+		{"missing scope", &APIError{StatusCode: 403, Text: "requires scope guilds"}, false, false, false},
+		{"not found", &APIError{StatusCode: 404, Text: "no such id"}, false, false, false},
+		{"rate limited", &APIError{StatusCode: 429, Text: "too many requests"}, false, true, false},
+		{"server error", &APIError{StatusCode: 500, Text: "ErrInternal"}, false, false, true},
+		{"unavailable with key text", &APIError{StatusCode: 503, Text: "invalid key"}, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error = test.err
+			if got := errors.Is(err, ErrInvalidKey); got != test.invalidKey {
+				t.Errorf("ErrInvalidKey: got %v, expected %v", got, test.invalidKey)
+			}
+			if got := errors.Is(err, ErrRateLimited); got != test.rateLimited {
+				t.Errorf("ErrRateLimited: got %v, expected %v", got, test.rateLimited)
+			}
+			if got := errors.Is(err, ErrServerError); got != test.serverError {
+				t.Errorf("ErrServerError: got %v, expected %v", got, test.serverError)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Package gw2apitest provides a fake Guild Wars 2 api to run the bot and its verification offline
+package gw2apitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+)
+
+// Server is a fake api answering the endpoints of gw2api.Client from the data added to it
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	tokens   map[string]gw2api.TokenInfo
+	accounts map[string]gw2api.Account
+	wvw      map[string]gw2api.AccountWvW
+	guilds   map[string]gw2api.Guild
+	members  map[string][]gw2api.GuildMember
+	worlds   []gw2api.World
+	matches  []gw2api.MatchOverview
+	// status overrides the response of every request when not 0
+	status int
+}
+
+// NewServer starts a fake api without any data. Close it when done
+func NewServer() *Server {
+	s := &Server{
+		tokens:   make(map[string]gw2api.TokenInfo),
+		accounts: make(map[string]gw2api.Account),
+		wvw:      make(map[string]gw2api.AccountWvW),
+		guilds:   make(map[string]gw2api.Guild),
+		members:  make(map[string][]gw2api.GuildMember),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/tokeninfo", s.authenticated(func(key string) interface{} {
+		return s.tokens[key]
+	}))
+	mux.HandleFunc("/v2/account", s.authenticated(func(key string) interface{} {
+		return s.accounts[key]
+	}))
+	mux.HandleFunc("/v2/account/wvw", s.authenticated(func(key string) interface{} {
+		return s.wvw[key]
+	}))
+	mux.HandleFunc("/v2/guild/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/v2/guild/")
+		if strings.HasSuffix(id, "/members") {
+			s.guildMembers(strings.TrimSuffix(id, "/members"))(w, r)
+			return
+		}
+		s.mutex.Lock()
+		guild, ok := s.guilds[id]
+		s.mutex.Unlock()
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"text": "no such id"})
+			return
+		}
+		s.public(func() interface{} {
+			return guild
+		})(w, r)
+	})
+	mux.HandleFunc("/v2/worlds", s.public(func() interface{} {
+		return s.worlds
+	}))
+	mux.HandleFunc("/v2/wvw/matches/overview", s.public(func() interface{} {
+		return s.matches
+	}))
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// NewClient returns a client for this server without rate limiting
+func (s *Server) NewClient() *gw2api.Client {
+	return &gw2api.Client{
+		BaseURL:       s.URL + "/v2",
+		HTTPClient:    s.Client(),
+		Language:      "en",
+		SchemaVersion: gw2api.DefaultSchemaVersion,
+	}
+}
+
+// AddKey makes the key valid and lets it return the token info and account.
+// The team of /v2/account/wvw is taken from the account without a selected wvw guild
+func (s *Server) AddKey(key string, token gw2api.TokenInfo, account gw2api.Account) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[key] = token
+	s.accounts[key] = account
+	s.wvw[key] = gw2api.AccountWvW{Team: account.WvW.TeamID}
+}
+
+// SetAccountWvW sets the response of /v2/account/wvw for a key added with AddKey
+func (s *Server) SetAccountWvW(key string, wvw gw2api.AccountWvW) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.wvw[key] = wvw
+}
+
+// AddGuild makes the guild available at /v2/guild/:id
+func (s *Server) AddGuild(guild gw2api.Guild) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.guilds[guild.ID] = guild
+}
+
+// SetGuildMembers sets the response of /v2/guild/:id/members.
+// Only keys of accounts with the guild in GuildLeader get the members
+func (s *Server) SetGuildMembers(id string, members []gw2api.GuildMember) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.members[id] = members
+}
+
+// RevokeKey makes the key invalid
+func (s *Server) RevokeKey(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.tokens, key)
+	delete(s.accounts, key)
+	delete(s.wvw, key)
+}
+
+// SetWorlds sets the response of /v2/worlds
+func (s *Server) SetWorlds(worlds []gw2api.World) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.worlds = worlds
+}
+
+// SetMatches sets the response of /v2/wvw/matches/overview
+func (s *Server) SetMatches(matches []gw2api.MatchOverview) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.matches = matches
+}
+
+// SetStatus makes every request fail with the status code, for example 429 or 503.
+// Setting it to 0 answers normally again
+func (s *Server) SetStatus(status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+func (s *Server) public(data func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.status != 0 {
+			writeJSON(w, s.status, map[string]string{"text": http.StatusText(s.status)})
+			return
+		}
+		writeJSON(w, http.StatusOK, data())
+	}
+}
+
+func (s *Server) authenticated(data func(key string) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		key, ok := s.checkKey(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, data(key))
+	}
+}
+
+// checkKey answers with an error if the request should fail or its key is invalid. The mutex has to be locked
+func (s *Server) checkKey(w http.ResponseWriter, r *http.Request) (key string, ok bool) {
+	if s.status != 0 {
+		writeJSON(w, s.status, map[string]string{"text": http.StatusText(s.status)})
+		return
+	}
+
+	key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		key = r.URL.Query().Get("access_token")
+	}
+	if _, ok = s.tokens[key]; !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"text": "Invalid access token"})
+	}
+	return
+}
+
+func (s *Server) guildMembers(id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		key, ok := s.checkKey(w, r)
+		if !ok {
+			return
+		}
+		for _, guild := range s.accounts[key].GuildLeader {
+			if guild == id {
+				writeJSON(w, http.StatusOK, s.members[id])
+				return
+			}
+		}
+		writeJSON(w, http.StatusForbidden, map[string]string{"text": "access restricted to guild leaders"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v) // nolint: errcheck, gosec
+}
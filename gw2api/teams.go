@@ -0,0 +1,55 @@
+package gw2api
+
+import "fmt"
+
+// teamIDOffset separates team ids of the world restructuring from the ids of the classic worlds
+const teamIDOffset = 10000
+
+// teamNames holds the names of the wvw teams as shown ingame, the api does not provide them
+var teamNames = map[int]string{
+	11001: "Moogooloo",
+	11002: "Rall's Rest",
+	11003: "Domain of Torment",
+	11004: "Yohlon Haven",
+	11005: "Tombs of Drascir",
+	11006: "Hall of Judgment",
+	11007: "Throne of Balthazar",
+	11008: "Dwayna's Temple",
+	11009: "Abaddon's Prison",
+	11010: "Cathedral of Blood",
+	11011: "Lutgardis Conservatory",
+	11012: "Mosswood",
+
+	12001: "Skrittsburgh",
+	12002: "Fortune's Vale",
+	12003: "Silent Woods",
+	12004: "Ettin's Back",
+	12005: "Domain of Anguish",
+	12006: "Palawadan",
+	12007: "Bloodstone Gulch",
+	12008: "Frost Citadel",
+	12009: "Dragrimmar",
+	12010: "Grenth's Door",
+	12011: "Mirror of Lyssa",
+	12012: "Melandru's Dome",
+	12013: "Kormir's Library",
+	12014: "Great House Aviary",
+	12015: "Bava Nisos",
+}
+
+// IsTeam reports whether the id is a team of the world restructuring instead of a classic world
+func IsTeam(id int) bool {
+	return id > teamIDOffset
+}
+
+// TeamName returns the ingame name of a team or a generic one for unknown teams
+func TeamName(id int) string {
+	if name, ok := teamNames[id]; ok {
+		return name
+	}
+	region := "NA"
+	if id/1000 == 12 {
+		region = "EU"
+	}
+	return fmt.Sprintf("%v Team %v", region, id%1000)
+}
@@ -0,0 +1,116 @@
+package gw2api
+
+import "time"
+
+// Account holds the data returned by the /v2/account endpoint
+type Account struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	World  int      `json:"world"`
+	Guilds []string `json:"guilds"`
+	// GuildLeader is only returned with the guilds permission
+	GuildLeader []string `json:"guild_leader"`
+	Access      []string `json:"access"`
+	Created     string   `json:"created"`
+
+	FractalLevel int `json:"fractal_level"`
+	DailyAP      int `json:"daily_ap"`
+	MonthlyAP    int `json:"monthly_ap"`
+	// WvWRank is only returned by schemas before the world restructuring, use Rank
+	WvWRank int `json:"wvw_rank"`
+
+	// WvW is only returned by schemas since the world restructuring
+	WvW struct {
+		TeamID int `json:"team_id"`
+		Rank   int `json:"rank"`
+	} `json:"wvw"`
+}
+
+// values of Account.Access
+const (
+	AccessPlayForFree   = "PlayForFree"
+	AccessGuildWars2    = "GuildWars2"
+	AccessHeartOfThorns = "HeartOfThorns"
+	AccessPathOfFire    = "PathOfFire"
+	AccessEndOfDragons  = "EndOfDragons"
+)
+
+// FreeToPlay reports whether the account is a free to play account that was never upgraded
+func (a Account) FreeToPlay() bool {
+	free, core := false, false
+	for _, access := range a.Access {
+		switch access {
+		case AccessPlayForFree:
+			free = true
+		case AccessGuildWars2:
+			core = true
+		}
+	}
+	return free && !core
+}
+
+// Rank returns the wvw rank independent of the schema version
+func (a Account) Rank() int {
+	if a.WvW.Rank != 0 {
+		return a.WvW.Rank
+	}
+	return a.WvWRank
+}
+
+// AccountWvW holds the data returned by the /v2/account/wvw endpoint
+type AccountWvW struct {
+	// Team is the id of the team the account plays for this matchup
+	Team int `json:"team"`
+	// Guild is the id of the selected wvw guild, it is empty if none is selected
+	Guild string `json:"guild"`
+}
+
+// Guild holds the public data returned by the /v2/guild/:id endpoint
+type Guild struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Tag  string `json:"tag"`
+}
+
+// GuildMember holds an entry of the /v2/guild/:id/members endpoint
+type GuildMember struct {
+	// Name is the account name
+	Name string `json:"name"`
+	// Rank is the name of the guild rank
+	Rank   string    `json:"rank"`
+	Joined time.Time `json:"joined"`
+}
+
+// World holds the data returned by the /v2/worlds endpoint
+type World struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// MatchOverview holds the data returned by the /v2/wvw/matches/overview endpoint
+type MatchOverview struct {
+	ID string `json:"id"`
+
+	// nolint: megacheck
+	Worlds struct {
+		Red   int `json:"red"`
+		Blue  int `json:"blue"`
+		Green int `json:"green"`
+	} `json:"worlds"`
+
+	AllWorlds struct {
+		Red   []int `json:"red"`
+		Blue  []int `json:"blue"`
+		Green []int `json:"green"`
+	} `json:"all_worlds"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// TokenInfo holds the data returned by the /v2/tokeninfo endpoint
+type TokenInfo struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// defaultAdminListenAddress is used if config.AdminListenAddress is not set
+	defaultAdminListenAddress = "localhost:4041"
+
+	// worldDataMaxAge is how old the world data can get. Worlds are updated on every reset, which are at most a week apart
+	worldDataMaxAge = 7*24*time.Hour + time.Hour
+)
+
+var (
+	// worldsUpdated holds the time currentWorlds was last updated successfully
+	worldsUpdated time.Time
+)
+
+// healthCheck is a single check of a health endpoint
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+func checkDiscord() error {
+	if dg == nil || !dg.DataReady {
+		return errors.New("not connected to the discord gateway")
+	}
+	return nil
+}
+
+func checkStorage() error {
+	return database.Ping()
+}
+
+func checkWorlds() error {
+	if worldsUpdated.IsZero() {
+		return errors.New("worlds were not loaded yet")
+	}
+	if age := time.Since(worldsUpdated); age > worldDataMaxAge {
+		return fmt.Errorf("world data is %v old", age.Round(time.Minute))
+	}
+	return nil
+}
+
+// writeHealth runs the checks and answers with 503 if one of them fails
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status := http.StatusOK
+	report := ""
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			report += fmt.Sprintf("%v: %v\n", c.name, err)
+		} else {
+			report += c.name + ": ok\n"
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	writeToResponse(w, "%v", report)
+}
+
+// handleHealthz reports if the bot is alive, which it is not without the discord gateway
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, []healthCheck{
+		{name: "discord", check: checkDiscord},
+	})
+}
+
+// handleReadyz reports if the bot is able to verify users
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, []healthCheck{
+		{name: "discord", check: checkDiscord},
+		{name: "storage", check: checkStorage},
+		{name: "worlds", check: checkWorlds},
+	})
+}
+
+// startAdminListener serves metrics and health endpoints apart from the public website
+func startAdminListener() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+
+	addr := config.AdminListenAddress
+	if addr == "" {
+		addr = defaultAdminListenAddress
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	loglevels.Infof("starting up admin listener on %v...", addr)
+	loglevels.Errorf("Error serving admin listener: %v\n", srv.ListenAndServe())
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"strconv"
 	"strings"
 	"unicode"
+
+	"github.com/greaka/discordwvwbot/gw2api"
 )
 
 // indexOfString is a helper function to get an index based on a value in a [index]string
@@ -51,6 +54,17 @@ func getWorldByName(s string) int {
 	return -1
 }
 
+// getWorldName returns the name of the world or team, or its id if it is not active
+func getWorldName(id int) string {
+	if world, ok := currentWorlds[id]; ok && world.Name != "" {
+		return world.Name
+	}
+	if gw2api.IsTeam(id) {
+		return gw2api.TeamName(id)
+	}
+	return strconv.Itoa(id)
+}
+
 func trimMention(userID string) string {
 	f := func(c rune) bool {
 		return !unicode.IsNumber(c)
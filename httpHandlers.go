@@ -1,16 +1,16 @@
 package main
 
 import (
-	b64 "encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/greaka/discordwvwbot/loglevels"
 	"io"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // redirectToTLS is the handler function for http calls to get redirected to https
@@ -29,34 +29,13 @@ func handleRootRequest(w http.ResponseWriter, r *http.Request) {
 // nolint: gocyclo
 func handleDashboard(w http.ResponseWriter, r *http.Request) {
 	addHeaders(w, r)
-	state := r.FormValue("state")
 
-	if state == "" {
-		http.Redirect(w, r, "/login?key=dashboard", http.StatusTemporaryRedirect)
-		return
-	}
-
-	stateString, err := b64.URLEncoding.DecodeString(state)
-	if err != nil {
-		loglevels.Errorf("Error decoding base64 %v: %v\n", state, err)
-		writeToResponse(w, "Internal error, please try again or contact me.")
-		return
-	}
-
-	var oauthReason oauthState
-	err = json.Unmarshal(stateString, &oauthReason)
-	if err != nil {
-		loglevels.Errorf("Error deserializing json %v: %v\n", stateString, err)
-		writeToResponse(w, "Internal error, please try again or contact me.")
-		return
-	}
-
-	userid, err := checkSession(oauthReason.Data)
+	session, err := getSession(w, r)
 	if err != nil {
-		loglevels.Warningf("Invalid session: %v\n", err)
-		writeToResponse(w, "Session expired.")
+		http.Redirect(w, r, "/login?key=dashboard", http.StatusTemporaryRedirect)
 		return
 	}
+	userid := session.UserID
 
 	guild := r.FormValue("guild")
 	guilds, err := getDiscordServers(userid) // nolint: vetshadow
@@ -84,7 +63,7 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	dashboard, err := getDashboardTemplate(guild, userid, state)
+	dashboard, err := getDashboardTemplate(guild, userid, session.CSRFToken)
 	if err != nil {
 		loglevels.Errorf("Error getting dashboard template for user %v and guild %v: %v\n", userid, guild, err)
 		writeToResponse(w, "Internal error, please try again or contact me.")
@@ -103,28 +82,11 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 func handleSubmitDashboard(w http.ResponseWriter, r *http.Request) {
 	addHeaders(w, r)
 
-	state := r.FormValue("state")
-	stateString, err := b64.URLEncoding.DecodeString(state)
-	if err != nil {
-		loglevels.Errorf("Error decoding base64 %v: %v\n", state, err)
-		writeToResponse(w, "Internal error, please try again or contact me.")
-		return
-	}
-
-	var oauthReason oauthState
-	err = json.Unmarshal(stateString, &oauthReason)
-	if err != nil {
-		loglevels.Errorf("Error deserializing json %v: %v\n", stateString, err)
-		writeToResponse(w, "Internal error, please try again or contact me.")
-		return
-	}
-
-	user, err := checkSession(oauthReason.Data)
-	if err != nil {
-		loglevels.Warningf("Invalid session: %v\n", err)
-		writeToResponse(w, "Session expired.")
+	session, ok := checkFormSession(w, r)
+	if !ok {
 		return
 	}
+	user := session.UserID
 	guild := r.FormValue("guild")
 	loglevels.Infof("saving dashboard from user %v for guild %v...\n", user, guild)
 
@@ -135,6 +97,10 @@ func handleSubmitDashboard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	isMember := checkUserIsMember(guild, servers)
+	if isMember && r.FormValue("preview") != "" {
+		previewSubmitData(w, r, session, guild)
+		return
+	}
 	if isMember {
 		err = processSubmitData(r)
 		if err != nil {
@@ -160,9 +126,30 @@ func checkUserIsMember(id string, servers []discordgo.UserGuild) (isMember bool)
 	return false
 }
 
-// nolint: gocyclo
 func processSubmitData(r *http.Request) (err error) {
-	options := &guildOptions{
+	options, err := parseSubmitData(r)
+	if err != nil {
+		return
+	}
+
+	// r.FormValue("guild") is not empty because of the permissions check before
+	guildID := r.FormValue("guild")
+	previous, err := getGuildSettings(guildID)
+	if err != nil {
+		return errors.New("unexpected error while saving your settings")
+	}
+	err = saveGuildSettings(guildID, options)
+	if err != nil {
+		return errors.New("unexpected error while saving your settings")
+	}
+	go updateVerificationMessage(guildID, previous.VerificationChannelID)
+	return
+}
+
+// parseSubmitData reads the settings of the dashboard form
+// nolint: gocyclo
+func parseSubmitData(r *http.Request) (options *guildOptions, err error) {
+	options = &guildOptions{
 		RenameUsers:  false,
 		CreateRoles:  false,
 		AllowLinked:  false,
@@ -183,6 +170,21 @@ func processSubmitData(r *http.Request) (err error) {
 	}
 	options.MinimumRank = rank
 
+	for field, value := range map[string]*int{
+		"min-account-age":   &options.MinimumAccountAge,
+		"min-daily-ap":      &options.MinimumDailyAP,
+		"min-monthly-ap":    &options.MinimumMonthlyAP,
+		"min-fractal-level": &options.MinimumFractalLevel,
+		"revoked-key-grace": &options.RevokedKeyGracePeriod,
+		"removal-confirm":   &options.RemovalConfirmations,
+		"removal-grace":     &options.RemovalGracePeriod,
+	} {
+		*value, err = formInt(r, field)
+		if err != nil {
+			return
+		}
+	}
+
 	if r.FormValue("rename-users") == "on" {
 		options.RenameUsers = true
 	}
@@ -203,14 +205,16 @@ func processSubmitData(r *http.Request) (err error) {
 		options.DeleteLinked = true
 	}
 
-	options.Gw2AccountKey = r.FormValue("account")
-	if options.Mode == userBased {
-		if options.Gw2AccountKey == "" {
-			err = errors.New("you have to choose an account for user based mode to work")
-			return
-		}
+	if r.FormValue("rank-roles") == "on" {
+		options.GuildRankRoles = true
 	}
 
+	if r.FormValue("refuse-free-to-play") == "on" {
+		options.RefuseFreeToPlay = true
+	}
+
+	options.Gw2AccountKey = r.FormValue("account")
+
 	serverString := r.FormValue("server")
 	if serverString != "" {
 		var serv int
@@ -221,26 +225,322 @@ func processSubmitData(r *http.Request) (err error) {
 		}
 
 		options.Gw2ServerID = serv
-	} else {
-		if options.Mode == oneServer {
-			err = errors.New("you have to choose a server for server based mode to work")
+	}
+
+	teamString := r.FormValue("team")
+	if teamString != "" {
+		var team int
+		team, err = strconv.Atoi(teamString)
+		if err != nil {
+			loglevels.Errorf("Error converting team id %v from dashboard submit: %v\n", teamString, err)
 			return
 		}
+
+		options.Gw2TeamID = team
 	}
 
-	// r.FormValue("guild") is not empty because of the permissions check before
-	err = saveGuildSettings(r.FormValue("guild"), options)
+	for _, id := range strings.Split(r.FormValue("wvw-guilds"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			options.WvWGuildIDs = append(options.WvWGuildIDs, id)
+		}
+	}
+
+	for _, id := range strings.Split(r.FormValue("gw2-guilds"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			options.Gw2GuildIDs = append(options.Gw2GuildIDs, id)
+		}
+	}
+
+	options.AuditChannelID = r.FormValue("audit-channel")
+	options.VerificationChannelID = r.FormValue("verification-channel")
+
+	options.VerifiedRoleID = r.FormValue("verified-role")
+	options.LinkedRoleID = r.FormValue("linked-role")
+	options.VerifiedRoleName = strings.TrimSpace(r.FormValue("verified-role-name"))
+	options.LinkedRoleName = strings.TrimSpace(r.FormValue("linked-role-name"))
+	options.WorldRoleName = strings.TrimSpace(r.FormValue("world-role-name"))
+	options.GiveUnverifiedRole = r.FormValue("give-unverified-role") == "on"
+	options.UnverifiedRoleID = r.FormValue("unverified-role")
+	options.UnverifiedRoleName = strings.TrimSpace(r.FormValue("unverified-role-name"))
+	keepRoleBindings(r.FormValue("guild"), options)
+
+	options.NicknameTemplate = strings.TrimSpace(r.FormValue("nickname-template"))
+	options.NicknameAccount = nicknameAccount(r.FormValue("nickname-account"))
+	options.NicknameExemptRoleID = r.FormValue("nickname-exempt-role")
+
+	options.RankRoles, err = parseRankRoles(r)
 	if err != nil {
-		err = errors.New("unexpected error while saving your settings")
+		return
+	}
+
+	options.AccessRoles, err = parseAccessRoles(r)
+	if err != nil {
+		return
+	}
+
+	err = validateGuildOptions(r.FormValue("guild"), options)
+	return
+}
+
+// validateGuildOptions checks that the settings are complete for the chosen mode
+// nolint: gocyclo
+func validateGuildOptions(guildID string, options *guildOptions) (err error) {
+	switch {
+	case options.Mode < allServers || options.Mode > guildMember:
+		return errors.New("unknown mode")
+	case options.Mode == userBased && options.Gw2AccountKey == "":
+		return errors.New("you have to choose an account for user based mode to work")
+	case options.Mode == guildMember && options.GuildRankRoles && options.Gw2AccountKey == "":
+		return errors.New("you have to choose the account of a guild leader for guild rank roles to work")
+	case options.Mode == oneServer && options.Gw2ServerID == 0:
+		return errors.New("you have to choose a server for server based mode to work")
+	case options.Mode == oneTeam && options.Gw2TeamID == 0:
+		return errors.New("you have to choose a team for team based mode to work")
+	case options.Mode == wvwGuild && len(options.WvWGuildIDs) == 0:
+		return errors.New("you have to enter at least one guild id for wvw guild based mode to work")
+	case options.Mode == guildMember && len(options.Gw2GuildIDs) == 0:
+		return errors.New("you have to enter at least one guild id for guild member based mode to work")
+	}
+
+	if options.AuditChannelID != "" {
+		channel, erro := dg.State.Channel(options.AuditChannelID)
+		if erro != nil || channel.GuildID != guildID {
+			return errors.New("the audit log channel has to be a channel of this discord server")
+		}
+	}
+	if options.VerificationChannelID != "" {
+		channel, erro := dg.State.Channel(options.VerificationChannelID)
+		if erro != nil || channel.GuildID != guildID {
+			return errors.New("the verification channel has to be a channel of this discord server")
+		}
+	}
+	if err = validateRoleSettings(guildID, options); err != nil {
+		return
+	}
+	if err = validateNicknameSettings(guildID, options); err != nil {
+		return
+	}
+	if err = validateRequirements(options); err != nil {
+		return
+	}
+	if err = validateGracePeriod(options); err != nil {
+		return
+	}
+	if err = validateRemovalDelay(options); err != nil {
+		return
+	}
+	if err = validateRankRoles(guildID, options); err != nil {
+		return
+	}
+	return validateAccessRoles(guildID, options)
+}
+
+// formInt reads an optional number of the dashboard form, empty fields are 0
+func formInt(r *http.Request, field string) (value int, err error) {
+	s := strings.TrimSpace(r.FormValue(field))
+	if s == "" {
+		return
+	}
+	value, err = strconv.Atoi(s)
+	if err != nil {
+		err = errors.New("the account requirements have to be numbers")
+	}
+	return
+}
+
+// parseAccessRoles reads the access roles of the dashboard form, rows without access are skipped
+func parseAccessRoles(r *http.Request) (accessRoles []accessRole, err error) {
+	accesses := r.Form["access-role-access"]
+	roleIDs := r.Form["access-role-role"]
+	names := r.Form["access-role-name"]
+	if len(roleIDs) != len(accesses) || len(names) != len(accesses) {
+		err = errors.New("the access roles are incomplete, please reload the dashboard")
+		return
+	}
+	for i, access := range accesses {
+		if access == "" {
+			continue
+		}
+		accessRoles = append(accessRoles, accessRole{
+			Access: access,
+			RoleID: roleIDs[i],
+			Name:   strings.TrimSpace(names[i]),
+		})
+	}
+	return
+}
+
+// parseRankRoles reads the rank tiers of the dashboard form, rows without minimum rank are skipped
+func parseRankRoles(r *http.Request) (rankRoles []rankRole, err error) {
+	ranks := r.Form["rank-role-rank"]
+	roleIDs := r.Form["rank-role-role"]
+	names := r.Form["rank-role-name"]
+	if len(roleIDs) != len(ranks) || len(names) != len(ranks) {
+		err = errors.New("the rank roles are incomplete, please reload the dashboard")
+		return
+	}
+	for i, rankString := range ranks {
+		if strings.TrimSpace(rankString) == "" {
+			continue
+		}
+		rank, erro := strconv.Atoi(strings.TrimSpace(rankString))
+		if erro != nil {
+			err = errors.New("the minimum rank of rank roles has to be a number")
+			return
+		}
+		rankRoles = append(rankRoles, rankRole{
+			MinimumRank: rank,
+			RoleID:      roleIDs[i],
+			Name:        strings.TrimSpace(names[i]),
+		})
 	}
 	return
 }
 
+// previewSubmitData shows the role changes of the submitted settings before saving them
+func previewSubmitData(w http.ResponseWriter, r *http.Request, session dashboardSession, guild string) {
+	user := session.UserID
+	options, err := parseSubmitData(r)
+	if err != nil {
+		writeToResponse(w, "%v", err)
+		return
+	}
+
+	plan, err := newGuildPlan(guild, user, options)
+	if err != nil {
+		writeToResponse(w, "Internal error, please try again or contact me.")
+		return
+	}
+	plan.Trigger = triggerPreview
+	plan.SaveOptions = true
+	plan.startComputing(false, false)
+
+	writePreview(w, plan, session, planComputeWait)
+}
+
+// handlePreview shows a preview of previewSubmitData once it is computed
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+
+	session, err := getSession(w, r)
+	if err != nil {
+		writeToResponse(w, "Session expired.")
+		return
+	}
+	plan, err := getPlan(r.FormValue("plan"), r.FormValue("guild"), session.UserID)
+	if err != nil {
+		writeToResponse(w, "%v", err)
+		return
+	}
+	writePreview(w, plan, session, 0)
+}
+
+// writePreview waits up to timeout for the plan and shows it, or a page that reloads until it is computed
+func writePreview(w http.ResponseWriter, plan *guildPlan, session dashboardSession, timeout time.Duration) {
+	var preview previewTemplate
+	switch err := plan.waitComputed(timeout); err {
+	case nil:
+		preview = getPreviewTemplate(plan, session.CSRFToken)
+	case errPlanComputing:
+		preview = previewTemplate{
+			GuildID: plan.GuildID,
+			PlanID:  plan.ID,
+			Pending: true,
+		}
+	default:
+		writeToResponse(w, "Internal error, please try again or contact me.")
+		return
+	}
+
+	err := dbTemplate.ExecuteTemplate(w, "preview", preview)
+	if err != nil {
+		loglevels.Errorf("Error executing preview template for user %v and guild %v: %v\n", session.UserID, plan.GuildID, err)
+		writeToResponse(w, "Internal error, please try again or contact me.")
+	}
+}
+
+// handleApplyPlan saves the settings and applies the role changes of a preview
+func handleApplyPlan(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+
+	session, ok := checkFormSession(w, r)
+	if !ok {
+		return
+	}
+	user := session.UserID
+	guild := r.FormValue("guild")
+
+	servers, err := getDiscordServers(user)
+	if err != nil {
+		writeToResponse(w, "Something went wrong. Try again later or contact me.")
+		return
+	}
+	if !checkUserIsMember(guild, servers) {
+		writeToResponse(w, "You are missing permissions to manage roles. Your settings were not saved.")
+		return
+	}
+
+	plan, err := takePlan(r.FormValue("plan"), guild, user)
+	if err != nil {
+		writeToResponse(w, "%v", err)
+		return
+	}
+
+	err = applyPlan(plan)
+	if err != nil {
+		loglevels.Warningf("Error applying plan %v in guild %v: %v", plan.ID, guild, err)
+		writeToResponse(w, "Completed with errors.")
+		return
+	}
+	writeToResponse(w, "Success")
+	loglevels.Infof("dashboard saved by user %v for guild %v\n", user, guild)
+}
+
+// checkFormSession checks the session and the csrf token of a dashboard form and writes the error if one of them is invalid
+func checkFormSession(w http.ResponseWriter, r *http.Request) (session dashboardSession, ok bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := getSession(w, r)
+	if err != nil {
+		loglevels.Warningf("Invalid session: %v\n", err)
+		writeToResponse(w, "Session expired.")
+		return
+	}
+	if !session.checkCSRF(r) {
+		loglevels.Warningf("Invalid csrf token of user %v\n", session.UserID)
+		w.WriteHeader(http.StatusForbidden)
+		writeToResponse(w, "This form expired. Please reload the dashboard.")
+		return
+	}
+	return session, true
+}
+
+// handleLogout ends the dashboard session
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+
+	session, ok := checkFormSession(w, r)
+	if !ok {
+		return
+	}
+	_ = endSession(w, session) // nolint: errcheck, gosec
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 // handleAuthCallback is listening to returning oauth requests to discord
 // nolint: gocyclo
 func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 	addHeaders(w, r)
-	state := r.FormValue("state")
+	// check the state before using the code, callbacks from other browsers are forged
+	oauthReason, err := takeOAuthState(w, r)
+	if err != nil {
+		loglevels.Warningf("Error checking oauth state: %v\n", err)
+		writeToResponse(w, "This login expired or was started in another browser. Please try again.")
+		return
+	}
+
 	// request oauth access with the issue data sent by discord
 	token, err := getOAuthToken(r, w)
 	if err != nil {
@@ -256,16 +556,7 @@ func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	loglevels.Infof("got dicsord user id %v", user.ID)
-
-	var oauthReason oauthState
-	err = json.Unmarshal([]byte(state), &oauthReason)
-	if err != nil {
-		loglevels.Info("error unmarshaling state string")
-		loglevels.Errorf("Error deserializing json %v: %v\n", state, err)
-		writeToResponse(w, "Internal error, please try again or contact me.")
-		return
-	}
-	loglevels.Infof("unmarshaled state string. request reason: %v\nReasons: 1=addUser	2=syncUser 3=deleteKeys 4=useDashboard", oauthReason.Reason)
+	loglevels.Infof("request reason: %v\nReasons: 1=addUser	2=syncUser 3=deleteKeys 4=useDashboard", oauthReason.Reason)
 
 	switch oauthReason.Reason {
 
@@ -299,18 +590,13 @@ func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 		}
 	case useDashboard:
 		loglevels.Infof("Dashboard for user %v requested", user.ID)
-		oauthReason.Data, err = newSession(user.ID)
+		err = newSession(w, user.ID)
 		if err != nil {
 			writeToResponse(w, "Something went seriously wrong. If this happens again, please contact me.")
 			return
 		}
-		stateBytes, err := json.Marshal(oauthReason) // nolint: vetshadow
-		if err != nil {
-			loglevels.Errorf("Error stringifying state: %v", oauthReason)
-			writeToResponse(w, "Something went seriously wrong. If this happens again, please contact me.")
-			return
-		}
-		http.Redirect(w, r, "https://"+r.Host+"/dashboard?state="+b64.URLEncoding.EncodeToString(stateBytes), http.StatusTemporaryRedirect)
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
 	default:
 		loglevels.Errorf("malformed state: %v", oauthReason)
 	}
@@ -329,7 +615,17 @@ func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
 // nolint: gocyclo
 func handleAuthRequest(w http.ResponseWriter, r *http.Request) {
 	addHeaders(w, r)
-	key := strings.Trim(r.FormValue("key"), " \t\n\r")
+	// api keys in links end up in the browser history and in the logs of proxies, so they are only accepted from a form.
+	// The dashboard redirects here with the dashboard keyword, which is no secret
+	key := strings.Trim(r.PostFormValue("key"), " \t\n\r")
+	if query := r.URL.Query().Get("key"); query != "" {
+		if query != "dashboard" || key != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeToResponse(w, "Please enter your API key in the form on the main page instead of the link.")
+			return
+		}
+		key = query
+	}
 
 	state := oauthState{}
 
@@ -346,22 +642,27 @@ func handleAuthRequest(w http.ResponseWriter, r *http.Request) {
 		state.Data = key
 	}
 
-	stateString, err := json.Marshal(state)
+	// the state stays on the server, discord only sees a random nonce
+	nonce, err := newOAuthState(w, state)
 	if err != nil {
-		loglevels.Errorf("Error stringifying state: %v", state)
 		writeToResponse(w, "Something went seriously wrong. If this happens again, please contact me.")
 		return
 	}
 
-	// redirect to discord login
-	// we can use the key as state here because we are not vulnerable to csrf (change my mind)
-	http.Redirect(w, r, oauthConfig.AuthCodeURL(string(stateString)), http.StatusTemporaryRedirect)
+	// redirect to discord login, see other makes the browser follow a form with a get request
+	http.Redirect(w, r, oauthConfig.AuthCodeURL(nonce), http.StatusSeeOther)
+}
+
+// handleStylesheet serves the stylesheet of the dashboard next to the dashboard template
+func handleStylesheet(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+	http.ServeFile(w, r, filepath.Join(filepath.Dir(config.TemplatePath), "master.css"))
 }
 
 // handleInvite responds with a discord URL to invite this bot to a discord server
 func handleInvite(w http.ResponseWriter, r *http.Request) {
 	addHeaders(w, r)
-	http.Redirect(w, r, "https://discordapp.com/oauth2/authorize?client_id="+config.DiscordClientID+"&scope=bot&permissions=402680832", http.StatusPermanentRedirect)
+	http.Redirect(w, r, "https://discordapp.com/oauth2/authorize?client_id="+config.DiscordClientID+"&scope=bot%20applications.commands&permissions=402746368", http.StatusPermanentRedirect)
 }
 
 // addHeaders adds the standard headers to the http.ResponseWriter
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestHandleAuthRequest(t *testing.T) {
+	previousDatabase, previousOAuth := database, oauthConfig
+	defer func() { database, oauthConfig = previousDatabase, previousOAuth }()
+	oauthConfig = &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://discord.test/authorize"},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   string
+		status int
+		// reason and data are the oauth state of the login, if it is started
+		reason authReason
+		data   string
+	}{
+		{"key in the form", http.MethodPost, "", "key=+api-key%0A", http.StatusSeeOther, addUser, "api-key"},
+		{"delete data", http.MethodPost, "", "key=deletemydata", http.StatusSeeOther, deleteKeys, ""},
+		{"sync", http.MethodPost, "", "key=syncnow", http.StatusSeeOther, syncUser, ""},
+		{"dashboard link", http.MethodGet, "key=dashboard", "", http.StatusSeeOther, useDashboard, ""},
+		{"key in the link", http.MethodGet, "key=api-key", "", http.StatusBadRequest, 0, ""},
+		{"form to a link with a key", http.MethodPost, "key=api-key", "key=other-key", http.StatusBadRequest, 0, ""},
+		{"form to the dashboard link", http.MethodPost, "key=dashboard", "key=api-key", http.StatusBadRequest, 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			r := httptest.NewRequest(test.method, "/login?"+test.query, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			handleAuthRequest(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %v, expected %v", w.Code, test.status)
+			}
+			if test.status != http.StatusSeeOther {
+				if cookies := w.Result().Cookies(); len(cookies) != 0 {
+					t.Errorf("got cookies %v, expected no login to start", cookies)
+				}
+				return
+			}
+
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("parsing the redirect: %v", err)
+			}
+			if strings.Contains(location.String(), "key") {
+				t.Errorf("got redirect %v, expected the key to stay on the server", location)
+			}
+
+			// the callback from discord comes back with the nonce of the state cookie
+			callback := httptest.NewRequest(http.MethodGet, "/callback?state="+url.QueryEscape(location.Query().Get("state")), nil)
+			for _, cookie := range w.Result().Cookies() {
+				callback.AddCookie(cookie)
+			}
+			state, err := takeOAuthState(httptest.NewRecorder(), callback)
+			if err != nil {
+				t.Fatalf("taking the oauth state: %v", err)
+			}
+			if state.Reason != test.reason || state.Data != test.data {
+				t.Errorf("got state %+v, expected reason %v with data %q", state, test.reason, test.data)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"github.com/greaka/discordwvwbot/loglevels"
 	"strings"
 )
 
@@ -48,12 +47,7 @@ If you wish to verify this discord account instead, then create a new api key, n
 		}
 	} else if user != userID && userID != "" {
 		// remove key
-		redisConn := usersDatabase.Get()
-		_, erro := redisConn.Do("SREM", userID, key)
-		closeConnection(redisConn)
-		if erro != nil {
-			loglevels.Errorf("Error deleting api key from redis: %v", erro)
-		}
+		_ = removeAPIKey(userID, key) // nolint: errcheck, gosec
 	}
 	return
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+// linkResetChannel holds the discord servers whose linked role is reset, see resetLinkedRoles
+var linkResetChannel = make(chan linkReset, 100)
+
+// linkReset is a discord server whose world changed its links
+type linkReset struct {
+	guildID  string
+	options  *guildOptions
+	world    int
+	previous []int
+	current  []int
+}
+
+// verifyWorld returns the world or team the discord server verifies for, it is 0 for modes without one.
+// In user based mode it is the world of the account of the api key of the discord server
+func (o *guildOptions) verifyWorld(ctx context.Context) int {
+	switch o.Mode {
+	case oneServer:
+		return o.Gw2ServerID
+	case oneTeam:
+		return o.Gw2TeamID
+	case userBased:
+		owner, err := getCachedGw2Account(ctx, o.Gw2AccountKey)
+		if err != nil {
+			return 0
+		}
+		return owner.World
+	}
+	return 0
+}
+
+// sameWorlds reports whether both lists contain the same worlds
+func sameWorlds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, world := range a {
+		if indexOfInt(world, b) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// describeWorlds lists the names of the worlds
+func describeWorlds(worlds []int) string {
+	names := make([]string, 0, len(worlds))
+	for _, world := range worlds {
+		names = append(names, getWorldName(world))
+	}
+	return strings.Join(names, ", ")
+}
+
+// handleLinkChanges compares the linked worlds with the ones saved at the last world update. Discord servers that
+// chose DeleteLinked get their linked role reset by resetLinkedRoles if the links of their world changed.
+// The links are saved afterwards, so that changes during a restart are handled as well
+func handleLinkChanges(ctx context.Context) {
+	changes := make(map[int][]int)
+	var unknown []int
+	for id, world := range currentWorlds {
+		previous, err := database.GetLinkedWorlds(id)
+		if err == errNotFound {
+			unknown = append(unknown, id)
+			continue
+		}
+		if err != nil {
+			loglevels.Errorf("Error getting linked worlds of world %v: %v\n", id, err)
+			continue
+		}
+		if !sameWorlds(previous, world.Linked) {
+			changes[id] = previous
+		}
+	}
+
+	if len(changes) > 0 {
+		var guilds []string
+		_, err := database.IterateGuilds(func(guildID string) {
+			guilds = append(guilds, guildID)
+		})
+		if err != nil {
+			loglevels.Errorf("Error iterating guilds for link changes: %v\n", err)
+		}
+		for _, guildID := range guilds {
+			options, erro := getGuildSettings(guildID)
+			if erro != nil || !options.DeleteLinked || options.VerifyOnly {
+				continue
+			}
+			world := options.verifyWorld(ctx)
+			previous, changed := changes[world]
+			if !changed {
+				continue
+			}
+			select {
+			case linkResetChannel <- linkReset{guildID, options, world, previous, currentWorlds[world].Linked}:
+			default:
+				loglevels.Warningf("Too many linked roles to reset, skipping guild %v\n", guildID)
+			}
+		}
+	}
+
+	for id, world := range currentWorlds {
+		if _, changed := changes[id]; !changed && indexOfInt(id, unknown) == -1 {
+			continue
+		}
+		if err := database.SetLinkedWorlds(id, world.Linked); err != nil {
+			loglevels.Errorf("Error saving linked worlds of world %v: %v\n", id, err)
+		}
+	}
+}
+
+// findLinkedRole returns the managed linked role of the discord server, like the purge of linked roles finds it
+func findLinkedRole(guildID string, options *guildOptions, world int) (linked guildRole, ok bool) {
+	guildRoles, err := dg.GuildRoles(guildID)
+	if err != nil {
+		loglevels.Errorf("Error getting guild roles: %v\n", err)
+		return
+	}
+	roles, err := getGuildRoles(guildID, guildRoles)
+	if err != nil {
+		return
+	}
+	linkedName := options.linkedRoleName(getWorldName(world))
+	for _, role := range roles {
+		if role.ID == options.LinkedRoleID || (options.LinkedRoleID == "" && role.Name == linkedName) {
+			return role, true
+		}
+	}
+	return
+}
+
+// onlyRole returns the roles with the id
+func onlyRole(roles []guildRole, id string) (filtered []guildRole) {
+	for _, role := range roles {
+		if role.ID == id {
+			filtered = append(filtered, role)
+		}
+	}
+	return
+}
+
+// resetLinkedRoles resets the linked roles of the queued discord servers one after another until ctx is done,
+// so that large discord servers don't hold up the world updates
+func resetLinkedRoles(ctx context.Context) {
+	for {
+		select {
+		case reset := <-linkResetChannel:
+			resetLinkedRole(ctx, reset)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resetLinkedRole updates the linked role on the discord server after the links of its world changed.
+// Members unknown to the bot lose it as well, they got it by hand. Everything else is left to the scheduled updates
+func resetLinkedRole(ctx context.Context, reset linkReset) {
+	guildID, options := reset.guildID, reset.options
+	linked, ok := findLinkedRole(guildID, options, reset.world)
+	if !ok {
+		return
+	}
+
+	plan, err := computeGuildPlan(ctx, guildID, "", options, true, true)
+	if err != nil {
+		loglevels.Errorf("Error computing the linked role changes of guild %v: %v\n", guildID, err)
+		return
+	}
+	plan.Trigger = triggerLinksChanged
+	plan.NewRoles, plan.ManagedRoles, plan.RoleBindings = nil, nil, nil
+	for _, m := range plan.Members {
+		m.Add = onlyRole(m.Add, linked.ID)
+		m.Remove = onlyRole(m.Remove, linked.ID)
+		m.Nickname = ""
+	}
+	plan.confirmRemovals()
+	added, removed := 0, 0
+	for _, m := range plan.Members {
+		added += len(m.Add)
+		removed += len(m.Remove)
+	}
+	plan.removeEmpty()
+	if err = applyPlan(plan); err != nil {
+		loglevels.Warningf("Error applying the linked role changes of guild %v: %v\n", guildID, err)
+	}
+
+	summary := fmt.Sprintf("The links of %v changed from %v to %v. Removed `%v` from %v members and gave it to %v members.",
+		getWorldName(reset.world), describeWorlds(reset.previous), describeWorlds(reset.current), linked.Name, removed, added)
+	loglevels.Infof("Guild %v: %v", guildID, summary)
+	if options.AuditChannelID == "" {
+		return
+	}
+	_, err = dg.ChannelMessageSendComplex(options.AuditChannelID, &discordgo.MessageSend{
+		Content:         summary,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		loglevels.Warningf("Error sending link change summary to channel %v of guild %v: %v\n", options.AuditChannelID, guildID, err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/gw2api/gw2apitest"
+)
+
+func TestVerifyWorld(t *testing.T) {
+	server := gw2apitest.NewServer()
+	defer server.Close()
+	server.AddKey("owner", gw2api.TokenInfo{Name: "wvwbot"}, gw2api.Account{ID: "owner-id", Name: "Owner.1234", World: 2202})
+
+	previousDatabase, previousClient := database, gw2Client
+	defer func() {
+		database, gw2Client = previousDatabase, previousClient
+	}()
+	database = newMemoryStore()
+	gw2Client = server.NewClient()
+
+	tests := []struct {
+		name     string
+		options  guildOptions
+		expected int
+	}{
+		{"one server", guildOptions{Mode: oneServer, Gw2ServerID: 2201}, 2201},
+		{"one team", guildOptions{Mode: oneTeam, Gw2TeamID: 12001}, 12001},
+		{"user based", guildOptions{Mode: userBased, Gw2AccountKey: "owner"}, 2202},
+		{"user based with an unknown key", guildOptions{Mode: userBased, Gw2AccountKey: "unknown"}, 0},
+		{"all servers", guildOptions{Mode: allServers}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if world := test.options.verifyWorld(context.Background()); world != test.expected {
+				t.Errorf("got world %v, expected %v", world, test.expected)
+			}
+		})
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/greaka/discordwvwbot/gw2api"
 	"github.com/greaka/discordwvwbot/webhooklogger"
 
 	"github.com/bwmarrin/discordgo"
@@ -17,8 +23,12 @@ import (
 	"golang.org/x/oauth2"
 )
 
-const discordAPIURL string = "https://discordapp.com/api"
-const gw2APIURL string = "https://api.guildwars2.com/v2"
+const (
+	discordAPIURL string = "https://discordapp.com/api"
+
+	// shutdownTimeout is how long running requests and queued updates get to finish when shutting down
+	shutdownTimeout = 30 * time.Second
+)
 
 var (
 	// oauthConfig saves the oauth config for the discord login
@@ -29,16 +39,31 @@ var (
 
 	// dbTemplate is the template to render the dashboard
 	dbTemplate *template.Template
+
+	// copyRedis copies the redis dataset into the configured storage and exits instead of starting the bot
+	copyRedis = flag.Bool("copyredis", false, "copy the redis dataset into the configured sql storage and exit")
+
+	// stopping is done when the bot shuts down
+	stopping, stopBot = context.WithCancel(context.Background())
+
+	// failures receives the error that shuts the bot down with exit code 1
+	failures = make(chan error, 1)
 )
 
-// main is the entry point and fires up everything
-// nolint: gocyclo
+// main is the entry point, it exits after everything is closed
 func main() {
+	flag.Parse()
+	os.Exit(run())
+}
 
+// run fires up everything and returns the exit code after shutting down
+// nolint: gocyclo
+func run() (exitCode int) {
 	// open log file to write to it
 	f, err := os.OpenFile("botlog", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		log.Fatalf("error opening log file: %v", err)
+		log.Printf("error opening log file: %v", err)
+		return 1
 	}
 	defer func() {
 		if err = f.Close(); err != nil {
@@ -56,7 +81,7 @@ func main() {
 	conf, err := os.Open("config.json")
 	if err != nil {
 		loglevels.Errorf("Error opening config file: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	defer func() {
 		if err = conf.Close(); err != nil {
@@ -66,14 +91,14 @@ func main() {
 	jsonParser := json.NewDecoder(conf)
 	if err = jsonParser.Decode(&config); err != nil {
 		loglevels.Errorf("Error parsing config file: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
 	// connect to the discord bot api
 	dg, err = discordgo.New("Bot " + config.BotToken)
 	if err != nil {
 		loglevels.Errorf("Error connecting to discord: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
 	var webhookLoggerInfo webhooklogger.WebhookLogger
@@ -101,14 +126,49 @@ func main() {
 		loglevels.SetWriter(loglevels.LevelError, w)
 	}
 
-	initializeRedisPools()
+	gw2Client = gw2api.NewClient()
+	if config.Gw2APIURL != "" {
+		gw2Client.BaseURL = config.Gw2APIURL
+	}
 
-	if err = migrateRedis(); err != nil {
-		os.Exit(1)
+	database, err = openStore()
+	if err != nil {
+		loglevels.Errorf("Error opening storage: %v\n", err)
+		return 1
 	}
 
-	// starting up the bot part
-	go startBot()
+	if err = initializeEncryption(); err != nil {
+		loglevels.Errorf("Error loading encryption keys: %v\n", err)
+		return 1
+	}
+
+	defer func() {
+		if err = database.Close(); err != nil {
+			loglevels.Errorf("Error closing storage: %v\n", err)
+		}
+	}()
+
+	instrumentClients()
+
+	if *copyRedis {
+		if err = copyRedisToStore(database); err != nil {
+			loglevels.Errorf("Error copying redis dataset: %v\n", err)
+			return 1
+		}
+		loglevels.Info("Finished copying the redis dataset")
+		return 0
+	}
+
+	// migrations only exist for the redis storage
+	if _, ok := database.(*redisStore); ok {
+		if err = migrateRedis(); err != nil {
+			return 1
+		}
+	}
+
+	if err = encryptStoredKeys(); err != nil {
+		return 1
+	}
 
 	oauthConfig = &oauth2.Config{
 		ClientID:     config.DiscordClientID,
@@ -125,7 +185,7 @@ func main() {
 	htmlFile, err := ioutil.ReadFile(config.HTMLPath)
 	if err != nil {
 		loglevels.Errorf("Error opening html file: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	mainpage = string(htmlFile)
 
@@ -133,9 +193,13 @@ func main() {
 	htmlFile, err = ioutil.ReadFile(config.TemplatePath)
 	if err != nil {
 		loglevels.Errorf("Error opening template file: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	dbTemplate, err = template.New("dashboard").Parse(string(htmlFile))
+	if err != nil {
+		loglevels.Errorf("Error parsing template file: %v\n", err)
+		return 1
+	}
 
 	// setting up https server
 	mux := http.NewServeMux()
@@ -146,13 +210,111 @@ func main() {
 	mux.HandleFunc("/invite", handleInvite)
 	mux.HandleFunc("/dashboard", handleDashboard)
 	mux.HandleFunc("/submit", handleSubmitDashboard)
-	
+	mux.HandleFunc("/preview", handlePreview)
+	mux.HandleFunc("/apply", handleApplyPlan)
+	mux.HandleFunc("/links", handleLinkHistory)
+	mux.HandleFunc("/logout", handleLogout)
+	mux.HandleFunc(apiPrefix, handleAPI)
+	mux.HandleFunc(apiPrefix+"openapi.json", handleOpenAPI)
+	mux.HandleFunc("/master.css", handleStylesheet)
+
+	tlsConfig, redirectHandler, err := newTLSConfig()
+	if err != nil {
+		loglevels.Errorf("Error loading tls config: %v\n", err)
+		return 1
+	}
+
+	// starting up the bot part, after everything that can fail so that returning never leaves updates running
+	// work is only canceled if the queued updates take too long after stopping
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	botDone := make(chan struct{})
+	go func() {
+		startBot(stopping, work)
+		close(botDone)
+	}()
+	go startAdminListener()
+
 	srv := &http.Server{
-		Addr:         ":4040",
-		Handler:      mux,
+		Addr:      listenAddress(),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	servers := []*http.Server{srv}
+
+	if tlsConfig != nil && config.RedirectListenAddress != "" {
+		redirectSrv := &http.Server{
+			Addr:    config.RedirectListenAddress,
+			Handler: redirectHandler,
+		}
+		servers = append(servers, redirectSrv)
+		go serve(redirectSrv, "http redirect", redirectSrv.ListenAndServe)
+	}
+
+	if tlsConfig != nil {
+		// the certificates come from the tls config
+		go serve(srv, "https", func() error { return srv.ListenAndServeTLS("", "") })
+	} else {
+		loglevels.Warning("No certificate configured, serving plain http")
+		go serve(srv, "http", srv.ListenAndServe)
 	}
 
-	loglevels.Info("starting up https listener...")
-	loglevels.Error(srv.ListenAndServe())
-	os.Exit(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		loglevels.Infof("Received %v, shutting down...", sig)
+	case err = <-failures:
+		loglevels.Errorf("Shutting down because of: %v\n", err)
+		exitCode = 1
+	}
+	signal.Stop(signals)
+	stopBot()
+
+	shutdown(servers, botDone, cancelWork)
+	return
+}
+
+// fail shuts the bot down with exit code 1
+func fail(err error) {
+	select {
+	case failures <- err:
+	default:
+		// the bot is already shutting down because of another failure
+	}
+}
+
+// serve runs the listener and shuts the bot down if it fails
+func serve(srv *http.Server, name string, listen func() error) {
+	loglevels.Infof("starting up %v listener on %v...", name, srv.Addr)
+	if err := listen(); err != http.ErrServerClosed {
+		loglevels.Errorf("Error serving %v listener: %v\n", name, err)
+		fail(err)
+	}
+}
+
+// shutdown stops accepting requests and waits for the running requests and the queued updates.
+// Updates still running after shutdownTimeout get canceled
+func shutdown(servers []*http.Server, botDone <-chan struct{}, cancelWork context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			loglevels.Errorf("Error shutting down listener %v: %v\n", srv.Addr, err)
+		}
+	}
+
+	select {
+	case <-botDone:
+	case <-ctx.Done():
+		loglevels.Warning("Canceling the remaining updates")
+		cancelWork()
+		<-botDone
+	}
+
+	if gw2Client.Limiter != nil {
+		gw2Client.Limiter.Stop()
+	}
+	loglevels.Info("Shut down")
 }
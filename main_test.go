@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+func TestMain(m *testing.M) {
+	// the loggers are set up in main
+	for _, level := range []loglevels.Level{loglevels.LevelInfo, loglevels.LevelWarning, loglevels.LevelError} {
+		loglevels.SetWriter(level, ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestFail(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	// the second failure must not block while the bot is shutting down
+	fail(first)
+	fail(second)
+
+	select {
+	case err := <-failures:
+		if err != first {
+			t.Errorf("got %v, expected the first failure", err)
+		}
+	default:
+		t.Fatal("expected a failure")
+	}
+	select {
+	case err := <-failures:
+		t.Errorf("got %v, expected only the first failure", err)
+	default:
+	}
+}
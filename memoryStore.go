@@ -0,0 +1,403 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore implements Store in memory. Nothing is persisted across restarts.
+// Expiring keys behave like their redis counterparts and are dropped lazily.
+type memoryStore struct {
+	mutex sync.Mutex
+
+	users         map[string]map[string]struct{}
+	guilds        map[string]guildOptions
+	guildRoles    map[string]map[guildRole]struct{}
+	uniqueUsers   map[string]string
+	guildVerifies map[string]*memoryWorlds
+	sessions      map[string]memoryValue
+	cache         map[string]memoryValue
+	auditLog      map[string][]memoryAuditEntry
+	mutedUsers    map[string]struct{}
+	worldLinks    map[int][]int
+	// worldSnapshots are sorted by their start
+	worldSnapshots []memorySnapshot
+
+	// lastSweep holds the time expired sessions and cache entries were last dropped
+	lastSweep time.Time
+}
+
+// memoryValue is a string value with an expiry
+type memoryValue struct {
+	value   string
+	expires time.Time
+}
+
+// memoryAuditEntry is an entry of an audit log
+type memoryAuditEntry struct {
+	entry string
+	at    time.Time
+}
+
+// memorySnapshot is a world snapshot with its start
+type memorySnapshot struct {
+	snapshot string
+	start    time.Time
+}
+
+// memoryWorlds is a set of worlds that expires as a whole
+type memoryWorlds struct {
+	worlds  map[int]struct{}
+	expires time.Time
+}
+
+// sweepInterval is the minimum duration between two sweeps of expired keys
+const sweepInterval = time.Minute
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:         make(map[string]map[string]struct{}),
+		guilds:        make(map[string]guildOptions),
+		guildRoles:    make(map[string]map[guildRole]struct{}),
+		uniqueUsers:   make(map[string]string),
+		guildVerifies: make(map[string]*memoryWorlds),
+		sessions:      make(map[string]memoryValue),
+		cache:         make(map[string]memoryValue),
+		auditLog:      make(map[string][]memoryAuditEntry),
+		mutedUsers:    make(map[string]struct{}),
+		worldLinks:    make(map[int][]int),
+		lastSweep:     time.Now(),
+	}
+}
+
+// getValue returns a value if it exists and is not expired. The caller has to hold the mutex
+func getValue(values map[string]memoryValue, key string) (string, error) {
+	v, ok := values[key]
+	if !ok {
+		return "", errNotFound
+	}
+	if time.Now().After(v.expires) {
+		delete(values, key)
+		return "", errNotFound
+	}
+	return v.value, nil
+}
+
+// setValue saves a value and drops expired values of all expiring namespaces once in a while.
+// The caller has to hold the mutex
+func (s *memoryStore) setValue(values map[string]memoryValue, key, value string, expire time.Duration) {
+	now := time.Now()
+	values[key] = memoryValue{
+		value:   value,
+		expires: now.Add(expire),
+	}
+
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for _, namespace := range []map[string]memoryValue{s.sessions, s.cache} {
+		for k, v := range namespace {
+			if now.After(v.expires) {
+				delete(namespace, k)
+			}
+		}
+	}
+	for k, v := range s.guildVerifies {
+		if now.After(v.expires) {
+			delete(s.guildVerifies, k)
+		}
+	}
+}
+
+func (s *memoryStore) GetAPIKeys(userID string) (keys []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range s.users[userID] {
+		keys = append(keys, key)
+	}
+	return
+}
+
+func (s *memoryStore) AddAPIKey(userID, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		s.users[userID] = make(map[string]struct{})
+	}
+	s.users[userID][key] = struct{}{}
+	return nil
+}
+
+func (s *memoryStore) RemoveAPIKey(userID, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.users[userID], key)
+	// like redis, an empty set does not exist anymore
+	if len(s.users[userID]) == 0 {
+		delete(s.users, userID)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.users, userID)
+	return nil
+}
+
+func (s *memoryStore) IterateUsers(processValue func(string)) (count int, err error) {
+	// copy the keys so processValue can use the store while iterating
+	s.mutex.Lock()
+	users := make([]string, 0, len(s.users))
+	for user := range s.users {
+		users = append(users, user)
+	}
+	s.mutex.Unlock()
+
+	for _, user := range users {
+		processValue(user)
+	}
+	return len(users), nil
+}
+
+func (s *memoryStore) GuildExists(guildID string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.guilds[guildID]
+	return ok, nil
+}
+
+func (s *memoryStore) GetGuildSettings(guildID string) (*guildOptions, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	options, ok := s.guilds[guildID]
+	if !ok {
+		return nil, errNotFound
+	}
+	// return a copy so callers can not change the saved settings without saving them
+	return &options, nil
+}
+
+func (s *memoryStore) SaveGuildSettings(guildID string, options *guildOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.guilds[guildID] = *options
+	return nil
+}
+
+func (s *memoryStore) IterateGuilds(processValue func(string)) (count int, err error) {
+	s.mutex.Lock()
+	guilds := make([]string, 0, len(s.guilds))
+	for guild := range s.guilds {
+		guilds = append(guilds, guild)
+	}
+	s.mutex.Unlock()
+
+	for _, guild := range guilds {
+		processValue(guild)
+	}
+	return len(guilds), nil
+}
+
+func (s *memoryStore) GetManagedRoles(guildID string) (roles []guildRole, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for role := range s.guildRoles[guildID] {
+		roles = append(roles, role)
+	}
+	return
+}
+
+func (s *memoryStore) AddManagedRole(guildID string, role guildRole) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.guildRoles[guildID]; !ok {
+		s.guildRoles[guildID] = make(map[guildRole]struct{})
+	}
+	s.guildRoles[guildID][role] = struct{}{}
+	return nil
+}
+
+func (s *memoryStore) RemoveManagedRole(guildID string, role guildRole) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.guildRoles[guildID], role)
+	return nil
+}
+
+func (s *memoryStore) GetAccountOwner(accountID string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	userID, ok := s.uniqueUsers[accountID]
+	if !ok {
+		return "", errNotFound
+	}
+	return userID, nil
+}
+
+func (s *memoryStore) SetAccountOwner(accountID, userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.uniqueUsers[accountID] = userID
+	return nil
+}
+
+func (s *memoryStore) GetAdditionalWorlds(guildID string) (worlds []int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	additional, ok := s.guildVerifies[guildID]
+	if !ok {
+		return
+	}
+	if time.Now().After(additional.expires) {
+		delete(s.guildVerifies, guildID)
+		return
+	}
+	for world := range additional.worlds {
+		worlds = append(worlds, world)
+	}
+	return
+}
+
+func (s *memoryStore) AddAdditionalWorld(guildID string, world int, expire time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	additional, ok := s.guildVerifies[guildID]
+	if !ok || time.Now().After(additional.expires) {
+		additional = &memoryWorlds{worlds: make(map[int]struct{})}
+		s.guildVerifies[guildID] = additional
+	}
+	additional.worlds[world] = struct{}{}
+	additional.expires = time.Now().Add(expire)
+	return nil
+}
+
+func (s *memoryStore) GetSession(key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return getValue(s.sessions, key)
+}
+
+func (s *memoryStore) SetSession(key, value string, expire time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setValue(s.sessions, key, value, expire)
+	return nil
+}
+
+func (s *memoryStore) DeleteSession(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, key)
+	return nil
+}
+
+func (s *memoryStore) GetCache(key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return getValue(s.cache, key)
+}
+
+func (s *memoryStore) SetCache(key, value string, expire time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setValue(s.cache, key, value, expire)
+	return nil
+}
+
+func (s *memoryStore) NotificationsMuted(userID string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, muted := s.mutedUsers[userID]
+	return muted, nil
+}
+
+func (s *memoryStore) SetNotificationsMuted(userID string, muted bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if muted {
+		s.mutedUsers[userID] = struct{}{}
+	} else {
+		delete(s.mutedUsers, userID)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetLinkedWorlds(world int) ([]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	linked, ok := s.worldLinks[world]
+	if !ok {
+		return nil, errNotFound
+	}
+	return append([]int(nil), linked...), nil
+}
+
+func (s *memoryStore) SetLinkedWorlds(world int, linked []int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.worldLinks[world] = append([]int(nil), linked...)
+	return nil
+}
+
+func (s *memoryStore) SaveWorldSnapshot(start time.Time, snapshot string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := sort.Search(len(s.worldSnapshots), func(i int) bool {
+		return !s.worldSnapshots[i].start.Before(start)
+	})
+	if i < len(s.worldSnapshots) && s.worldSnapshots[i].start.Equal(start) {
+		s.worldSnapshots[i].snapshot = snapshot
+		return nil
+	}
+	s.worldSnapshots = append(s.worldSnapshots, memorySnapshot{})
+	copy(s.worldSnapshots[i+1:], s.worldSnapshots[i:])
+	s.worldSnapshots[i] = memorySnapshot{snapshot: snapshot, start: start}
+	return nil
+}
+
+func (s *memoryStore) GetWorldSnapshots(before time.Time, limit int) (snapshots []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := len(s.worldSnapshots) - 1; i >= 0 && len(snapshots) < limit; i-- {
+		if !s.worldSnapshots[i].start.After(before) {
+			snapshots = append(snapshots, s.worldSnapshots[i].snapshot)
+		}
+	}
+	return
+}
+
+func (s *memoryStore) AddAuditEntry(guildID string, at time.Time, entry string, retention time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cutoff := at.Add(-retention)
+	entries := s.auditLog[guildID][:0]
+	for _, e := range s.auditLog[guildID] {
+		if !e.at.Before(cutoff) {
+			entries = append(entries, e)
+		}
+	}
+	s.auditLog[guildID] = append(entries, memoryAuditEntry{entry: entry, at: at})
+	return nil
+}
+
+func (s *memoryStore) GetAuditEntries(guildID string, limit int) (entries []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	log := s.auditLog[guildID]
+	for i := len(log) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, log[i].entry)
+	}
+	return
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are written in the prometheus text format, see https://prometheus.io/docs/instrumenting/exposition_formats/
+var (
+	gw2APIRequests        = newCounterVec()
+	gw2APIDurationSeconds = newCounterVec()
+	discordRequests       = newCounterVec()
+	redisErrors           = newCounterVec()
+
+	// lastFullUpdate holds the duration of the last full user update cycle
+	lastFullUpdate time.Duration
+)
+
+// counterVec holds counters by their labels
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]float64)}
+}
+
+// add increases the counter of the labels, labels are pairs of name and value
+func (c *counterVec) add(value float64, labels ...string) {
+	key := formatLabels(labels)
+	c.mutex.Lock()
+	c.values[key] += value
+	c.mutex.Unlock()
+}
+
+// write writes every counter of c as name
+func (c *counterVec) write(w io.Writer, name string) {
+	c.mutex.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", name, key, formatValue(c.values[key])) // nolint: errcheck, gosec
+	}
+	c.mutex.Unlock()
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeMetric writes a metric with its help and type
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, kind, name, formatValue(value)) // nolint: errcheck, gosec
+}
+
+// writeCounterVec writes the counters of c with their help and type
+func writeCounterVec(w io.Writer, name, help string, c *counterVec) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", name, help, name) // nolint: errcheck, gosec
+	c.write(w, name)
+}
+
+// handleMetrics serves all metrics of the bot
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	tokens := 0
+	if gw2Client != nil && gw2Client.Limiter != nil {
+		tokens = gw2Client.Limiter.Available()
+	}
+	worldsTimestamp := int64(0)
+	if !worldsUpdated.IsZero() {
+		worldsTimestamp = worldsUpdated.Unix()
+	}
+	paused := 0
+	if removalsPaused() {
+		paused = 1
+	}
+	guilds := 0
+	if dg != nil && dg.State != nil {
+		dg.State.RLock()
+		guilds = len(dg.State.Guilds)
+		dg.State.RUnlock()
+	}
+
+	writeMetric(w, "wvwbot_update_queue_length", "gauge", "Users waiting in the update queue.", float64(len(updateUserChannel)))
+	writeMetric(w, "wvwbot_gw2api_tokens_available", "gauge", "Tokens left in the gw2 api rate limit bucket.", float64(tokens))
+	writeMetric(w, "wvwbot_full_update_delay_seconds", "gauge", "Delay between full user update cycles.", delayBetweenFullUpdates.Seconds())
+	writeMetric(w, "wvwbot_last_full_update_duration_seconds", "gauge", "Duration of the last full user update cycle.", lastFullUpdate.Seconds())
+	writeMetric(w, "wvwbot_users", "gauge", "Users known to the bot as of the last full update cycle.", float64(userCount))
+	writeMetric(w, "wvwbot_guilds", "gauge", "Discord servers the bot is on.", float64(guilds))
+	writeMetric(w, "wvwbot_worlds_updated_timestamp_seconds", "gauge", "Time of the last successful world update.", float64(worldsTimestamp))
+	writeMetric(w, "wvwbot_role_removals_paused", "gauge", "Whether role removals are paused because the gw2 api fails.", float64(paused))
+	writeCounterVec(w, "wvwbot_gw2api_requests_total", "Requests to the gw2 api by endpoint and status code.", gw2APIRequests)
+	writeCounterVec(w, "wvwbot_gw2api_request_duration_seconds_total", "Time spent on requests to the gw2 api by endpoint.", gw2APIDurationSeconds)
+	writeCounterVec(w, "wvwbot_discord_requests_total", "Requests to the discord rest api by method and status code.", discordRequests)
+	writeCounterVec(w, "wvwbot_redis_errors_total", "Failed redis commands by command.", redisErrors)
+}
+
+// instrumentedTransport counts the requests of an http client
+type instrumentedTransport struct {
+	next    http.RoundTripper
+	observe func(r *http.Request, code string, duration time.Duration)
+}
+
+func (t instrumentedTransport) RoundTrip(r *http.Request) (res *http.Response, err error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	start := time.Now()
+	res, err = next.RoundTrip(r)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	t.observe(r, code, time.Since(start))
+	return
+}
+
+// instrumentClients counts the requests to the gw2 api and to discord
+func instrumentClients() {
+	gw2Client.HTTPClient.Transport = instrumentedTransport{
+		next: gw2Client.HTTPClient.Transport,
+		observe: func(r *http.Request, code string, duration time.Duration) {
+			endpoint := gw2Endpoint(r.URL.Path)
+			gw2APIRequests.add(1, "endpoint", endpoint, "code", code)
+			observeGw2Response(code)
+			gw2APIDurationSeconds.add(duration.Seconds(), "endpoint", endpoint)
+		},
+	}
+	dg.Client.Transport = instrumentedTransport{
+		next: dg.Client.Transport,
+		observe: func(r *http.Request, code string, _ time.Duration) {
+			discordRequests.add(1, "method", r.Method, "code", code)
+		},
+	}
+}
+
+// gw2Endpoint strips the version and ids from the path so that every endpoint has one label
+func gw2Endpoint(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 0 && parts[0] == "v2" {
+		parts = parts[1:]
+	}
+	// guild ids are part of the path of guild endpoints
+	if len(parts) > 1 && parts[0] == "guild" {
+		parts[1] = ":id"
+	}
+	return "/" + strings.Join(parts, "/")
+}
@@ -1,21 +1,19 @@
 package main
 
 import (
+	"context"
 	"github.com/gomodule/redigo/redis"
 	"github.com/greaka/discordwvwbot/loglevels"
 	"time"
 )
 
-// nolint: ineffassign
-func migrateRedis() (err error) {
-	versionPool := newPool(dbTypeVersion)
-	guildsPool := newPool(dbTypeGuilds)
-	usersPool := newPool(dbTypeUsers)
-	uniquePool := newPool(dbGw2UsersToDiscordUsers)
+// currentRedisVersion is the version of the redis dataset after all migrations
+const currentRedisVersion = 5
 
+// getRedisVersion returns the version of the redis dataset. It is 0 for datasets created without migrations
+func getRedisVersion(versionPool *redis.Pool) (version int, err error) {
 	vc := versionPool.Get()
 	defer closeConnection(vc)
-	version := 0
 	versionExists, err := redis.Bool(vc.Do("EXISTS", "version"))
 	if err != nil {
 		loglevels.Errorf("Error checking for existing version in redis version db while trying to migrate: %v\n", err)
@@ -26,18 +24,27 @@ func migrateRedis() (err error) {
 		guildsExists, err := redis.Bool(vc.Do("EXISTS", "guilds")) // nolint: vetshadow
 		if err != nil {
 			loglevels.Errorf("Error checking for existing guilds in redis version db while trying to migrate: %v\n", err)
-			return err
+			return version, err
 		}
 		if guildsExists {
 			version = 1
 		}
-	} else {
-		version, err = redis.Int(vc.Do("GET", "version"))
-		if err != nil {
-			return
-		}
+		return version, nil
+	}
+	return redis.Int(vc.Do("GET", "version"))
+}
+
+// nolint: ineffassign
+func migrateRedis() (err error) {
+	versionPool := newPool(dbTypeVersion)
+	guildsPool := newPool(dbTypeGuilds)
+	usersPool := newPool(dbTypeUsers)
+	uniquePool := newPool(dbGw2UsersToDiscordUsers)
+
+	version, err := getRedisVersion(versionPool)
+	if err != nil {
+		return
 	}
-	closeConnection(vc)
 
 	if version == 1 {
 		version, err = migrateRedisFrom1To2(usersPool, guildsPool, versionPool)
@@ -64,8 +71,8 @@ func migrateRedis() (err error) {
 		}
 	}
 
-	vc = versionPool.Get()
-
+	vc := versionPool.Get()
+	defer closeConnection(vc)
 	_, err = vc.Do("SET", "version", version)
 	if err != nil {
 		loglevels.Errorf("Error setting version while migrating: %v\n", err)
@@ -141,7 +148,7 @@ func migrateRedisFrom2To3(gp *redis.Pool) (version int, err error) {
 	}
 
 	for _, guild := range guilds {
-		if err = saveNewGuild(gc, guild); err != nil {
+		if err = saveNewGuild(guild); err != nil {
 			return
 		}
 	}
@@ -172,7 +179,7 @@ func migrateRedisFrom3To4(usp, unp *redis.Pool) (version int, err error) {
 		for i < len(keys)-1 {
 			i++
 			key := keys[i]
-			acc, erro := getCheckedGw2Account(key, struct {
+			acc, erro := getCheckedGw2Account(context.Background(), key, struct {
 				string
 				bool
 			}{string: user, bool: true})
@@ -183,12 +190,7 @@ func migrateRedisFrom3To4(usp, unp *redis.Pool) (version int, err error) {
 			userID, erro := checkUnique(acc.ID, user, false)
 			if erro != nil && erro.Error() == AlreadyTaken {
 				// remove key
-				redisConn := usersDatabase.Get()
-				_, erro = redisConn.Do("SREM", user, key)
-				closeConnection(redisConn)
-				if erro != nil {
-					loglevels.Errorf("Error deleting api key from redis: %v", erro)
-				}
+				_ = removeAPIKey(user, key) // nolint: errcheck, gosec
 				// notify user
 				ch, erro := dg.UserChannelCreate(user)
 				if erro != nil {
@@ -227,8 +229,10 @@ func migrateRedisFrom4To5(gp *redis.Pool) (version int, err error) {
 		}
 	}
 
-	iterateDatabase(gc, processValue)
-
+	_, erro := iterateDatabase(gc, processValue)
+	if erro != nil {
+		err = erro
+	}
 	if err != nil {
 		return
 	}
@@ -237,6 +241,147 @@ func migrateRedisFrom4To5(gp *redis.Pool) (version int, err error) {
 	return
 }
 
+// encryptStoredKeys encrypts every stored api key that is not encrypted with the current encryption key.
+// It runs on every start for every storage, so putting a new key first in the keyring rotates all data.
+// nolint: gocyclo
+func encryptStoredKeys() (err error) {
+	if len(keyring) == 0 {
+		return
+	}
+
+	keyCount := 0
+	processUser := func(user string) {
+		stored, erro := database.GetAPIKeys(user)
+		if erro != nil {
+			loglevels.Errorf("Error getting api keys of user %v while trying to encrypt: %v\n", user, erro)
+			err = erro
+			return
+		}
+		for _, value := range stored {
+			if !needsEncryption(value) {
+				continue
+			}
+			key, erro := decrypt(value)
+			if erro != nil {
+				loglevels.Errorf("Error decrypting api key of user %v while trying to encrypt: %v\n", user, erro)
+				err = erro
+				continue
+			}
+			encrypted, erro := encrypt(key)
+			if erro != nil {
+				err = erro
+				return
+			}
+			// add first to not lose the key if removing fails
+			if erro = database.AddAPIKey(user, encrypted); erro != nil {
+				loglevels.Errorf("Error saving encrypted api key of user %v: %v\n", user, erro)
+				err = erro
+				continue
+			}
+			if erro = database.RemoveAPIKey(user, value); erro != nil {
+				loglevels.Errorf("Error removing old api key of user %v: %v\n", user, erro)
+				err = erro
+				continue
+			}
+			keyCount++
+		}
+	}
+	if _, erro := database.IterateUsers(processUser); erro != nil {
+		loglevels.Errorf("Error iterating users while trying to encrypt: %v\n", erro)
+		err = erro
+	}
+
+	guildCount := 0
+	processGuild := func(guild string) {
+		settings, erro := database.GetGuildSettings(guild)
+		if erro != nil {
+			loglevels.Errorf("Error getting guild %v while trying to encrypt: %v\n", guild, erro)
+			err = erro
+			return
+		}
+		if settings.Gw2AccountKey == "" || !needsEncryption(settings.Gw2AccountKey) {
+			return
+		}
+		settings.Gw2AccountKey, erro = decrypt(settings.Gw2AccountKey)
+		if erro != nil {
+			loglevels.Errorf("Error decrypting api key of guild %v while trying to encrypt: %v\n", guild, erro)
+			err = erro
+			return
+		}
+		// saveGuildSettings encrypts with the current key
+		if erro = saveGuildSettings(guild, settings); erro != nil {
+			err = erro
+			return
+		}
+		guildCount++
+	}
+	if _, erro := database.IterateGuilds(processGuild); erro != nil {
+		loglevels.Errorf("Error iterating guilds while trying to encrypt: %v\n", erro)
+		err = erro
+	}
+
+	if keyCount > 0 || guildCount > 0 {
+		loglevels.Infof("Encrypted %v api keys and %v guild api keys with key %v", keyCount, guildCount, keyring[0].id)
+	}
+	if err != nil {
+		loglevels.Warning("Exiting to prevent damage on the database. Check the error log!")
+	}
+	return
+}
+
+// migrateRoleBindings binds the managed roles of every discord server that were found by their names before.
+// It needs the current worlds for the names of the world roles
+func migrateRoleBindings() {
+	roleBindingsMutex.Lock()
+	defer roleBindingsMutex.Unlock()
+
+	count := 0
+	processGuild := func(guildID string) {
+		options, err := getGuildSettings(guildID)
+		if err != nil {
+			return
+		}
+		roles, err := database.GetManagedRoles(guildID)
+		if err != nil {
+			loglevels.Errorf("Error getting managed roles of guild %v while binding roles: %v\n", guildID, err)
+			return
+		}
+
+		changed := false
+		bind := func(slot, roleID string) {
+			if options.roleID(slot) == "" {
+				options.setRoleID(slot, roleID)
+				changed = true
+			}
+		}
+		for _, role := range roles {
+			switch role.Name {
+			case defaultVerifiedRoleName:
+				bind(roleSlotVerified, role.ID)
+			case defaultLinkedRoleName:
+				bind(roleSlotLinked, role.ID)
+			}
+			for _, world := range currentWorlds {
+				if world.Name != "" && world.Name == role.Name {
+					bind(worldRoleSlot(world.ID), role.ID)
+				}
+			}
+		}
+		if !changed {
+			return
+		}
+		if err = saveGuildSettings(guildID, options); err == nil {
+			count++
+		}
+	}
+	if _, err := database.IterateGuilds(processGuild); err != nil {
+		loglevels.Errorf("Error iterating guilds while binding roles: %v\n", err)
+	}
+	if count > 0 {
+		loglevels.Infof("Bound the managed roles of %v guilds to their role ids", count)
+	}
+}
+
 func dumpRestoreAndDEL(source, target *redis.Pool, key string) (err error) {
 	sc := source.Get()
 	defer closeConnection(sc)
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxNicknameLength is the longest nickname discord allows
+	maxNicknameLength = 32
+
+	// maxNicknameTemplateLength limits templates, they are cut off after rendering anyway
+	maxNicknameTemplateLength = 100
+
+	// defaultNicknameTemplate is used if the discord server did not set its own
+	defaultNicknameTemplate = "{accountName}"
+)
+
+// nicknameAccount chooses the accounts shown in the nickname of users with several api keys
+type nicknameAccount string
+
+const (
+	// nicknameAllAccounts shows every account, separated by " | "
+	nicknameAllAccounts nicknameAccount = ""
+	// nicknameFirstAccount shows the first account by name, since not every storage keeps the order of api keys
+	nicknameFirstAccount nicknameAccount = "first"
+	// nicknameHighestRank shows the account with the highest wvw rank
+	nicknameHighestRank nicknameAccount = "rank"
+)
+
+// nicknamePlaceholders are replaced in nickname templates
+var nicknamePlaceholders = []string{"{discordName}", "{accountName}", "{world}", "{worldAbbrev}", "{rank}"}
+
+// nickname renders the nickname template of the discord server for the member, it is empty if there is no account to show
+func (o *guildOptions) nickname(displayName string, data gw2AccountData) string {
+	var accounts []worldWithRank
+	for _, world := range data.Worlds {
+		if world.Account != "" {
+			accounts = append(accounts, world)
+		}
+	}
+	if len(accounts) == 0 {
+		return ""
+	}
+
+	switch o.NicknameAccount {
+	case nicknameFirstAccount:
+		first := accounts[0]
+		for _, account := range accounts[1:] {
+			if account.Account < first.Account {
+				first = account
+			}
+		}
+		accounts = []worldWithRank{first}
+	case nicknameHighestRank:
+		highest := accounts[0]
+		for _, account := range accounts[1:] {
+			if account.rank > highest.rank {
+				highest = account
+			}
+		}
+		accounts = []worldWithRank{highest}
+	}
+
+	var names, worlds, abbrevs, ranks []string
+	for _, account := range accounts {
+		names = append(names, account.Account)
+		ranks = append(ranks, strconv.Itoa(account.rank))
+		world := getWorldName(account.ID)
+		if indexOfString(world, worlds) == -1 {
+			worlds = append(worlds, world)
+			abbrevs = append(abbrevs, worldAbbrev(world))
+		}
+	}
+
+	template := o.NicknameTemplate
+	if template == "" {
+		template = defaultNicknameTemplate
+	}
+	nickname := strings.NewReplacer(
+		"{discordName}", displayName,
+		"{accountName}", strings.Join(names, " | "),
+		"{world}", strings.Join(worlds, "/"),
+		"{worldAbbrev}", strings.Join(abbrevs, "/"),
+		"{rank}", strings.Join(ranks, "/"),
+	).Replace(template)
+	return truncateNickname(strings.TrimSpace(nickname))
+}
+
+// discordName returns the display name of the discord user for {discordName}, the username if there is no global name
+func discordName(user *discordgo.User) string {
+	if user.GlobalName != "" {
+		return user.GlobalName
+	}
+	return user.Username
+}
+
+// worldAbbrev abbreviates world names with their initials, like SoS for Sea of Sorrows.
+// Single word names are shortened to their first three letters
+func worldAbbrev(world string) string {
+	words := strings.FieldsFunc(world, func(c rune) bool {
+		return !unicode.IsLetter(c) && c != '\''
+	})
+	if len(words) == 1 {
+		runes := []rune(words[0])
+		if len(runes) > 3 {
+			runes = runes[:3]
+		}
+		return string(runes)
+	}
+	abbrev := ""
+	for _, word := range words {
+		r, _ := utf8.DecodeRuneInString(word)
+		abbrev += string(r)
+	}
+	return abbrev
+}
+
+// truncateNickname shortens the nickname to the length discord allows
+func truncateNickname(nickname string) string {
+	runes := []rune(nickname)
+	if len(runes) <= maxNicknameLength {
+		return nickname
+	}
+	return strings.TrimSpace(string(runes[:maxNicknameLength-1])) + "…"
+}
+
+// nicknameExempt reports whether the member keeps their nickname
+func (o *guildOptions) nicknameExempt(memberRoles []string) bool {
+	return o.NicknameExemptRoleID != "" && indexOfString(o.NicknameExemptRoleID, memberRoles) != -1
+}
+
+// validateNicknameSettings checks the nickname template and the exempt role
+func validateNicknameSettings(guildID string, options *guildOptions) (err error) {
+	switch options.NicknameAccount {
+	case nicknameAllAccounts, nicknameFirstAccount, nicknameHighestRank:
+	default:
+		return errors.New("unknown choice of the account shown in nicknames")
+	}
+
+	template := options.NicknameTemplate
+	for _, placeholder := range nicknamePlaceholders {
+		template = strings.Replace(template, placeholder, "", -1)
+	}
+	if strings.ContainsAny(template, "{}") {
+		return errors.New("the nickname template can only use " + strings.Join(nicknamePlaceholders, ", "))
+	}
+	if len(options.NicknameTemplate) > maxNicknameTemplateLength {
+		return errors.New("the nickname template can not be longer than 100 characters")
+	}
+
+	if options.NicknameExemptRoleID != "" {
+		if _, erro := dg.State.Role(guildID, options.NicknameExemptRoleID); erro != nil {
+			return errors.New("the role that keeps nicknames has to be a role of this discord server")
+		}
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestDiscordName(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     discordgo.User
+		expected string
+	}{
+		{"global name", discordgo.User{Username: "user", GlobalName: "Display Name"}, "Display Name"},
+		{"no global name", discordgo.User{Username: "user"}, "user"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if name := discordName(&test.user); name != test.expected {
+				t.Errorf("got %q, expected %q", name, test.expected)
+			}
+		})
+	}
+}
+
+func TestNickname(t *testing.T) {
+	previousWorlds := currentWorlds
+	defer func() { currentWorlds = previousWorlds }()
+	currentWorlds = map[int]*linkInfo{
+		1001: {ID: 1001, Name: "Sea of Sorrows"},
+		1002: {ID: 1002, Name: "Kodash"},
+	}
+
+	single := gw2AccountData{Worlds: []worldWithRank{{ID: 1001, rank: 250, Account: "Verified.1234"}}}
+	several := gw2AccountData{Worlds: []worldWithRank{
+		{ID: 1001, rank: 250, Account: "Zeta.1234"},
+		{ID: 1002, rank: 1200, Account: "Alpha.5678"},
+		{ID: 1001, rank: 10, Account: "Beta.9012"},
+	}}
+
+	tests := []struct {
+		name     string
+		template string
+		account  nicknameAccount
+		data     gw2AccountData
+		expected string
+	}{
+		{"default template", "", nicknameAllAccounts, single, "Verified.1234"},
+		{"discord name", "{discordName} [{accountName}]", nicknameAllAccounts, single, "Display [Verified.1234]"},
+		{"world", "{accountName} - {world}", nicknameAllAccounts, single, "Verified.1234 - Sea of Sorrows"},
+		{"world abbreviation", "{accountName} - {worldAbbrev}", nicknameAllAccounts, single, "Verified.1234 - SoS"},
+		{"rank", "{accountName} ({rank})", nicknameAllAccounts, single, "Verified.1234 (250)"},
+		{"surrounding spaces", "  {accountName}  ", nicknameAllAccounts, single, "Verified.1234"},
+		{"all accounts", "{accountName}", nicknameAllAccounts, several, "Zeta.1234 | Alpha.5678 | Beta.9…"},
+		{"worlds of all accounts", "{worldAbbrev} {rank}", nicknameAllAccounts, several, "SoS/Kod 250/1200/10"},
+		{"first account", "{accountName} {rank}", nicknameFirstAccount, several, "Alpha.5678 1200"},
+		{"highest rank", "{accountName} {worldAbbrev}", nicknameHighestRank, several, "Alpha.5678 Kod"},
+		{"no account", "{discordName}", nicknameAllAccounts, gw2AccountData{Worlds: []worldWithRank{{ID: 1001}}}, ""},
+		{"too long", "{discordName} {accountName} {world}", nicknameAllAccounts, single, "Display Verified.1234 Sea of So…"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := guildOptions{NicknameTemplate: test.template, NicknameAccount: test.account}
+			if nickname := options.nickname("Display", test.data); nickname != test.expected {
+				t.Errorf("got %q, expected %q", nickname, test.expected)
+			}
+		})
+	}
+}
+
+func TestTruncateNickname(t *testing.T) {
+	tests := []struct {
+		name     string
+		nickname string
+		expected string
+	}{
+		{"short", "Verified.1234", "Verified.1234"},
+		{"exactly the limit", strings.Repeat("a", maxNicknameLength), strings.Repeat("a", maxNicknameLength)},
+		{"one rune too long", strings.Repeat("a", maxNicknameLength+1), strings.Repeat("a", maxNicknameLength-1) + "…"},
+		{"multibyte runes at the limit", strings.Repeat("ä", maxNicknameLength), strings.Repeat("ä", maxNicknameLength)},
+		{"multibyte runes", strings.Repeat("ä", 40), strings.Repeat("ä", maxNicknameLength-1) + "…"},
+		{"space before the cut", strings.Repeat("a", maxNicknameLength-2) + " bc", strings.Repeat("a", maxNicknameLength-2) + "…"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nickname := truncateNickname(test.nickname)
+			if nickname != test.expected {
+				t.Errorf("got %q, expected %q", nickname, test.expected)
+			}
+			if length := utf8.RuneCountInString(nickname); length > maxNicknameLength {
+				t.Errorf("got %v runes, expected at most %v", length, maxNicknameLength)
+			}
+		})
+	}
+}
@@ -3,48 +3,119 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/gomodule/redigo/redis"
 	"github.com/greaka/discordwvwbot/loglevels"
 	"golang.org/x/oauth2"
 )
 
-func newSession(user string) (code string, err error) {
-	key := [32]byte{}
-	_, err = rand.Read(key[:])
+const (
+	// oauthStateExpiration is how long a login with discord can take
+	oauthStateExpiration = 10 * time.Minute
+
+	// oauthStatePrefix separates oauth states from other sessions
+	oauthStatePrefix = "oauthState:"
+
+	// oauthStateCookie binds the oauth state to the browser that started the login
+	oauthStateCookie = "oauth_state"
+)
+
+// errInvalidOAuthState is returned for callbacks that were not started by the same browser or expired
+var errInvalidOAuthState = errors.New("invalid or expired oauth state")
+
+// randomToken returns 32 random bytes encoded for urls and cookies
+func randomToken() (token string, err error) {
+	random := [32]byte{}
+	_, err = rand.Read(random[:])
 	if err != nil {
 		loglevels.Errorf("error getting random: %v\n", err)
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(random[:]), nil
+}
+
+// newOAuthState saves the pending action of an oauth request and returns the nonce to send as oauth state.
+// The nonce is also set as cookie, so that only the browser that started the request can finish it
+func newOAuthState(w http.ResponseWriter, state oauthState) (nonce string, err error) {
+	nonce, err = randomToken()
+	if err != nil {
+		return
 	}
-	code = base64.URLEncoding.EncodeToString(key[:])
-	c := sessionsDatabase.Get()
-	_, err = c.Do("SET", code, user, "EX", "3600")
-	closeConnection(c)
+
+	// the data can be an api key
+	state.Data, err = encrypt(state.Data)
+	if err != nil {
+		loglevels.Errorf("Error encrypting oauth state: %v\n", err)
+		return
+	}
+	stateBytes, err := json.Marshal(state)
 	if err != nil {
-		loglevels.Errorf("Error setting session for user %v: %v\n", user, err)
+		loglevels.Errorf("Error stringifying state: %v\n", err)
 		return
 	}
+	err = database.SetSession(oauthStatePrefix+nonce, string(stateBytes), oauthStateExpiration)
+	if err != nil {
+		loglevels.Errorf("Error saving oauth state: %v\n", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    nonce,
+		Path:     config.RedirectURL,
+		MaxAge:   int(oauthStateExpiration.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		// lax, because the cookie has to be sent when discord redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
 	return
 }
 
-func checkSession(session string) (user string, err error) {
-	c := sessionsDatabase.Get()
-	user, err = redis.String(c.Do("GET", session))
-	closeConnection(c)
+// takeOAuthState returns the pending action of the oauth callback and removes it, so that every state is used at most once
+func takeOAuthState(w http.ResponseWriter, r *http.Request) (state oauthState, err error) {
+	nonce := r.FormValue("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || nonce == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(nonce)) != 1 {
+		err = errInvalidOAuthState
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oauthStateCookie,
+		Path:   config.RedirectURL,
+		MaxAge: -1,
+	})
+
+	stateString, err := database.GetSession(oauthStatePrefix + nonce)
 	if err != nil {
-		if strings.Contains(err.Error(), "nil returned") {
-			loglevels.Infof("Invalid session %v.\n", session)
-		} else {
-			loglevels.Errorf("Error getting session for user: %v\n", err)
+		if err != errNotFound {
+			loglevels.Errorf("Error getting oauth state: %v\n", err)
 		}
+		err = errInvalidOAuthState
+		return
+	}
+	if erro := database.DeleteSession(oauthStatePrefix + nonce); erro != nil {
+		loglevels.Errorf("Error deleting oauth state: %v\n", erro)
+	}
+
+	err = json.Unmarshal([]byte(stateString), &state)
+	if err != nil {
+		loglevels.Errorf("Error deserializing oauth state: %v\n", err)
 		return
 	}
+	state.Data, err = decrypt(state.Data)
+	if err != nil {
+		loglevels.Errorf("Error decrypting oauth state: %v\n", err)
+	}
 	return
 }
 
@@ -82,9 +153,7 @@ func setDiscordUser(token string) (user *discordgo.User, err error) {
 		return
 	}
 
-	c := sessionsDatabase.Get()
-	_, err = c.Do("SET", user.ID, token, "EX", "3600")
-	closeConnection(c)
+	err = database.SetSession(user.ID, token, time.Hour)
 	if err != nil {
 		loglevels.Errorf("Error setting session for user %v: %v\n", user.ID, err)
 		return
@@ -104,9 +173,7 @@ func getDiscordUser(userID string) (user *discordgo.User, err error) {
 }
 
 func getToken(userid string) (token string, err error) {
-	c := sessionsDatabase.Get()
-	token, err = redis.String(c.Do("GET", userid))
-	closeConnection(c)
+	token, err = database.GetSession(userid)
 	if err != nil {
 		loglevels.Warningf("Error getting token for user %v: %v\n", userid, err)
 		return
@@ -115,12 +182,9 @@ func getToken(userid string) (token string, err error) {
 }
 
 func cacheRequest(endpoint, token, cache string, seconds int, result interface{}) (err error) {
-	c := cacheDatabase.Get()
-	defer closeConnection(c)
-
-	resultstring, err := redis.String(c.Do("GET", cache+token))
+	resultstring, err := database.GetCache(cache + token)
 	if err != nil {
-		if !strings.Contains(err.Error(), "nil returned") {
+		if err != errNotFound {
 			loglevels.Errorf("Error getting cache%v: %v\n", token, err)
 		}
 	} else {
@@ -144,7 +208,7 @@ func cacheRequest(endpoint, token, cache string, seconds int, result interface{}
 		return
 	}
 
-	_, erro = c.Do("SET", cache+token, string(resultbytes), "EX", seconds)
+	erro = database.SetCache(cache+token, string(resultbytes), time.Duration(seconds)*time.Second)
 	if erro != nil {
 		loglevels.Warningf("Error setting cache: %v", erro)
 		return
@@ -163,38 +227,36 @@ func getDiscordServers(userID string) (result []discordgo.UserGuild, err error)
 		return
 	}
 
-	var guilds []discordgo.UserGuild
-	err = cacheRequest("/users/@me/guilds", token, "guildsCache", 900, &guilds)
+	result, err = getDiscordServersOfToken(token)
 	if err != nil {
 		loglevels.Errorf("Error getting guilds for user %v: %v\n", userID, err)
-		return
 	}
+	return
+}
 
-	c := guildsDatabase.Get()
-	keys, err := redis.Values(c.Do("KEYS", "*"))
-	closeConnection(c)
+// getDiscordServersOfToken returns the discord servers of the owner of the oauth token that the bot is on
+func getDiscordServersOfToken(token string) (result []discordgo.UserGuild, err error) {
+	var guilds []discordgo.UserGuild
+	err = cacheRequest("/users/@me/guilds", token, "guildsCache", 900, &guilds)
 	if err != nil {
-		loglevels.Errorf("Error getting keys * from redis: %v\n", err)
 		return
 	}
 
-	// convert returned string to []string
-	//todo performance
-	var guildIds []string
-	err = redis.ScanSlice(keys, &guildIds)
-	if err != nil {
-		loglevels.Errorf("Error converting keys * to []string: %v\n", err)
-		return
+	userGuilds := make(map[string]discordgo.UserGuild, len(guilds))
+	for _, g := range guilds {
+		userGuilds[g.ID] = g
 	}
 
-	for _, gi := range guildIds {
-		for _, g := range guilds {
-			if gi == g.ID {
-				result = append(result, g)
-				break
-			}
+	processValue := func(guildID string) {
+		if g, ok := userGuilds[guildID]; ok {
+			result = append(result, g)
 		}
 	}
+	_, err = database.IterateGuilds(processValue)
+	if err != nil {
+		loglevels.Errorf("Error iterating guilds from database: %v\n", err)
+		return
+	}
 
 	return
 }
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// planExpiration is how long a plan can be applied after computing it
+	planExpiration = 15 * time.Minute
+
+	// plannedRolePrefix marks the ids of roles that are created when applying a plan
+	plannedRolePrefix = "planned:"
+
+	// planComputeTimeout limits computing a preview, it stays below the 15 minutes discord accepts answers to commands
+	planComputeTimeout = 10 * time.Minute
+
+	// planComputeWait is how long a preview is waited for before answering that it is computed in the background
+	planComputeWait = 10 * time.Second
+)
+
+var (
+	// plans holds the computed plans until they are applied or expire.
+	// They are only kept in memory because they contain the unencrypted settings of the discord server
+	plans      = make(map[string]*guildPlan)
+	plansMutex sync.Mutex
+
+	errPlanNotFound  = errors.New("this plan does not exist or expired")
+	errPlanComputing = errors.New("this plan is still being computed, try again in a minute")
+)
+
+// guildPlan holds the role changes on a discord server computed without applying them
+type guildPlan struct {
+	ID      string
+	GuildID string
+	// UserID is the discord user that computed the plan, only they can apply it
+	UserID string
+	// Options are the settings the plan is computed with
+	Options *guildOptions
+	// SaveOptions saves Options when applying the plan, used for plans of changed settings
+	SaveOptions bool
+	// NewRoles are the names of roles that are created
+	NewRoles []string
+	// ManagedRoles are existing discord roles that the bot starts to manage
+	ManagedRoles []guildRole
+	// RoleBindings are the role ids by slot that are saved into the settings, see findSlotRole
+	RoleBindings map[string]string
+	Members      []*memberPlan
+	Expires      time.Time
+	// Trigger is what caused the changes, it is written to the audit log
+	Trigger string
+
+	// computed is closed once a plan of startComputing is computed, computeErr is the error of computing it
+	computed   chan struct{}
+	computeErr error
+	// guildRoles caches the roles of the discord server while computing, see discordRoles
+	guildRoles []*discordgo.Role
+}
+
+// memberPlan holds the changes of a single member of a discord server
+type memberPlan struct {
+	Member *discordgo.Member
+	Add    []guildRole
+	Remove []guildRole
+	// Nickname is empty if the nickname stays
+	Nickname string
+
+	// removeReason explains removed roles in the audit log, reasons and removeReasons override it for single roles
+	removeReason  string
+	reasons       map[string]string
+	removeReasons map[string]string
+
+	// verifiedRoleIDs are the roles of rank tiers and access, they are only added if the member is verified
+	verifiedRoleIDs []string
+	// unverifiedRoleID is the role of members without verified roles, if the discord server wants one
+	unverifiedRoleID string
+
+	guild *guildPlan
+}
+
+// removeReasons explain removed roles of the modes when nothing more specific is known
+var removeReasons = map[mode]string{
+	allServers:  "world changed",
+	oneServer:   "world changed",
+	userBased:   "world changed",
+	oneTeam:     "team changed",
+	allTeams:    "team changed",
+	wvwGuild:    "wvw guild changed",
+	guildMember: "guild membership changed",
+}
+
+// newGuildPlan creates an empty plan for the discord server
+func newGuildPlan(guildID, userID string, options *guildOptions) (plan *guildPlan, err error) {
+	id := [8]byte{}
+	_, err = rand.Read(id[:])
+	if err != nil {
+		loglevels.Errorf("error getting random: %v\n", err)
+		return
+	}
+	plan = &guildPlan{
+		ID:      hex.EncodeToString(id[:]),
+		GuildID: guildID,
+		UserID:  userID,
+		Options: options,
+		Expires: time.Now().Add(planExpiration),
+	}
+	return
+}
+
+// discordRoles returns the roles of the discord server, they are requested once per plan
+func (p *guildPlan) discordRoles() (roles []*discordgo.Role, err error) {
+	if p.guildRoles != nil {
+		return p.guildRoles, nil
+	}
+	roles, err = dg.GuildRoles(p.GuildID)
+	if err != nil {
+		loglevels.Errorf("Error getting guild roles: %v\n", err)
+		return
+	}
+	p.guildRoles = roles
+	return
+}
+
+// member returns the plan of the member, it gets created if it does not exist yet
+func (p *guildPlan) member(member *discordgo.Member) *memberPlan {
+	for _, m := range p.Members {
+		if m.Member.User.ID == member.User.ID {
+			return m
+		}
+	}
+	m := &memberPlan{
+		Member: member,
+		guild:  p,
+	}
+	p.Members = append(p.Members, m)
+	return m
+}
+
+// removeEmpty removes all members without changes
+func (p *guildPlan) removeEmpty() {
+	members := p.Members[:0]
+	for _, m := range p.Members {
+		if len(m.Add) > 0 || len(m.Remove) > 0 || m.Nickname != "" {
+			members = append(members, m)
+		}
+	}
+	p.Members = members
+}
+
+// createRole adds the role to the roles to create and returns it with a placeholder id
+func (m *memberPlan) createRole(name string) guildRole {
+	role := guildRole{
+		ID:   plannedRolePrefix + name,
+		Name: name,
+	}
+	if indexOfString(name, m.guild.NewRoles) == -1 {
+		m.guild.NewRoles = append(m.guild.NewRoles, name)
+	}
+	return role
+}
+
+// manageRole adds an existing discord role to the roles the bot starts to manage
+func (m *memberPlan) manageRole(role guildRole) {
+	for _, r := range m.guild.ManagedRoles {
+		if r.ID == role.ID {
+			return
+		}
+	}
+	m.guild.ManagedRoles = append(m.guild.ManagedRoles, role)
+}
+
+func (m *memberPlan) addRole(role guildRole) {
+	for _, r := range m.Add {
+		if r.ID == role.ID {
+			return
+		}
+	}
+	m.Add = append(m.Add, role)
+}
+
+func (m *memberPlan) removeRole(role guildRole) {
+	for _, r := range m.Remove {
+		if r.ID == role.ID {
+			return
+		}
+	}
+	m.Remove = append(m.Remove, role)
+}
+
+// setReason explains why the role is added in the audit log
+func (m *memberPlan) setReason(roleID, reason string) {
+	if m.reasons == nil {
+		m.reasons = make(map[string]string)
+	}
+	m.reasons[roleID] = reason
+}
+
+// setRemoveReason explains why the role is removed in the audit log
+func (m *memberPlan) setRemoveReason(roleID, reason string) {
+	if m.removeReasons == nil {
+		m.removeReasons = make(map[string]string)
+	}
+	m.removeReasons[roleID] = reason
+}
+
+// addReason returns why the role is added
+func (m *memberPlan) addReason(roleID string) string {
+	if reason, ok := m.reasons[roleID]; ok {
+		return reason
+	}
+	return "verified"
+}
+
+// removalReason returns why the role is removed
+func (m *memberPlan) removalReason(roleID string) string {
+	if reason, ok := m.removeReasons[roleID]; ok {
+		return reason
+	}
+	if m.removeReason != "" {
+		return m.removeReason
+	}
+	return "not verified"
+}
+
+// findManagedRole returns the managed role with the id, or a role named after the id if it is unknown
+func findManagedRole(id string, managedRoles []guildRole) guildRole {
+	for _, role := range managedRoles {
+		if role.ID == id {
+			return role
+		}
+	}
+	return guildRole{
+		ID:   id,
+		Name: id,
+	}
+}
+
+// computeGuildPlan computes the changes of updating every known user on the discord server with the options.
+// If purge is set, it also removes the managed roles of users unknown to the bot like purgeGuild does
+func computeGuildPlan(ctx context.Context, guildID, userID string, options *guildOptions, purge, linkedOnly bool) (plan *guildPlan, err error) {
+	plan, err = newGuildPlan(guildID, userID, options)
+	if err != nil {
+		return
+	}
+	plan.Trigger = triggerPreview
+	err = plan.compute(ctx, purge, linkedOnly)
+	return
+}
+
+// startComputing stores the plan and computes it in the background like computeGuildPlan.
+// Use waitComputed before showing it, large discord servers take minutes
+func (p *guildPlan) startComputing(purge, linkedOnly bool) {
+	p.computed = make(chan struct{})
+	storePlan(p)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), planComputeTimeout)
+		defer cancel()
+		err := p.compute(ctx, purge, linkedOnly)
+		if err != nil {
+			loglevels.Warningf("Error computing plan of guild %v: %v\n", p.GuildID, err)
+		}
+
+		plansMutex.Lock()
+		p.computeErr = err
+		// the plan can be applied for the full time after it is computed
+		p.Expires = time.Now().Add(planExpiration)
+		plansMutex.Unlock()
+		close(p.computed)
+	}()
+}
+
+// waitComputed waits up to timeout for the plan to be computed and returns the error of computing it.
+// It returns errPlanComputing if the plan is not computed yet
+func (p *guildPlan) waitComputed(timeout time.Duration) (err error) {
+	if p.computed == nil {
+		return
+	}
+	select {
+	case <-p.computed:
+	default:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-p.computed:
+		case <-timer.C:
+			return errPlanComputing
+		}
+	}
+	plansMutex.Lock()
+	defer plansMutex.Unlock()
+	return p.computeErr
+}
+
+// compute adds the changes of every known user to the plan.
+// It only uses the account data known from earlier checks, so that computing a plan never contacts users or removes api keys
+func (p *guildPlan) compute(ctx context.Context, purge, linkedOnly bool) (err error) {
+	var users []string
+	_, err = database.IterateUsers(func(user string) {
+		users = append(users, user)
+	})
+	if err != nil {
+		loglevels.Errorf("Error iterating users for plan of guild %v: %v\n", p.GuildID, err)
+		return
+	}
+
+	for _, user := range users {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		member, erro := getMember(p.GuildID, user)
+		if erro != nil {
+			continue
+		}
+
+		data, erro := getKnownAccountData(user)
+		// errors like missing the rank requirement leave the member unchanged like in a normal update
+		_ = planUserDataInGuild(ctx, member, data, erro == nil && !removalsPaused(), true, p.member(member)) // nolint: errcheck, gosec
+	}
+
+	if purge {
+		var roles []*discordgo.Role
+		roles, err = p.discordRoles()
+		if err != nil {
+			return
+		}
+		err = planPurge(p, roles, linkedOnly)
+		if err != nil {
+			return
+		}
+	}
+
+	p.removeEmpty()
+	sort.Slice(p.Members, func(i, j int) bool {
+		return p.Members[i].Member.User.Username < p.Members[j].Member.User.Username
+	})
+	return
+}
+
+// planPurge adds removing the managed roles of members unknown to the bot to the plan
+func planPurge(plan *guildPlan, roles []*discordgo.Role, linkedOnly bool) (err error) {
+	authRoles, members, err := getPurgeTargets(plan.GuildID, roles, plan.Options, linkedOnly)
+	if err != nil {
+		return
+	}
+	for _, member := range members {
+		m := plan.member(member)
+		m.removeReason = "not verified by the bot"
+		for _, role := range authRoles {
+			if indexOfString(role.ID, member.Roles) != -1 {
+				m.removeRole(role)
+			}
+		}
+	}
+	return
+}
+
+// storePlan keeps the plan until it is applied or expires
+func storePlan(plan *guildPlan) {
+	plansMutex.Lock()
+	defer plansMutex.Unlock()
+	for id, p := range plans {
+		if time.Now().After(p.Expires) {
+			delete(plans, id)
+		}
+	}
+	plans[plan.ID] = plan
+}
+
+// getPlan returns the plan without removing it.
+// Only the user that computed the plan for the discord server can get it
+func getPlan(id, guildID, userID string) (plan *guildPlan, err error) {
+	plansMutex.Lock()
+	defer plansMutex.Unlock()
+	plan, ok := plans[id]
+	if !ok || time.Now().After(plan.Expires) || plan.GuildID != guildID || plan.UserID != userID {
+		return nil, errPlanNotFound
+	}
+	return
+}
+
+// takePlan returns the plan and removes it, so that every plan is applied at most once.
+// Only the user that computed the plan for the discord server can take it, and only once it is computed
+func takePlan(id, guildID, userID string) (plan *guildPlan, err error) {
+	plan, err = getPlan(id, guildID, userID)
+	if err != nil {
+		return
+	}
+	if err = plan.waitComputed(0); err != nil {
+		if err != errPlanComputing {
+			plansMutex.Lock()
+			delete(plans, id)
+			plansMutex.Unlock()
+		}
+		return nil, err
+	}
+
+	plansMutex.Lock()
+	defer plansMutex.Unlock()
+	if _, ok := plans[id]; !ok {
+		// the plan was taken in the meantime
+		return nil, errPlanNotFound
+	}
+	delete(plans, id)
+	return
+}
+
+// applyPlan executes exactly the changes of the plan and writes them to the audit log
+// nolint: gocyclo
+func applyPlan(plan *guildPlan) (err error) {
+	if plan.SaveOptions {
+		err = saveGuildSettings(plan.GuildID, plan.Options)
+		if err != nil {
+			return
+		}
+	}
+
+	var entries []auditEntry
+	audit := func(entry auditEntry) {
+		entry.Time = time.Now()
+		entry.Trigger = plan.Trigger
+		entry.By = plan.UserID
+		entries = append(entries, entry)
+	}
+	defer func() {
+		writeAuditLog(plan.GuildID, plan.Options, entries)
+	}()
+
+	created := make(map[string]string, len(plan.NewRoles))
+	for _, name := range plan.NewRoles {
+		_, role, erro := createRoleAndAddToManaged(plan.GuildID, name)
+		if erro != nil {
+			err = erro
+			continue
+		}
+		created[plannedRolePrefix+name] = role.ID
+		audit(auditEntry{
+			Action: auditRoleCreated,
+			RoleID: role.ID,
+			Role:   role.Name,
+			Reason: "needed by the settings",
+		})
+	}
+
+	for _, role := range plan.ManagedRoles {
+		if erro := addGuildRole(plan.GuildID, role); erro != nil {
+			err = erro
+		}
+	}
+
+	if len(plan.RoleBindings) > 0 {
+		if erro := saveRoleBindings(plan, created); erro != nil {
+			err = erro
+		}
+	}
+
+	roleID := func(role guildRole) (string, bool) {
+		if id, ok := created[role.ID]; ok {
+			return id, true
+		}
+		// roles that failed to be created are skipped
+		return role.ID, !strings.HasPrefix(role.ID, plannedRolePrefix)
+	}
+
+	for _, m := range plan.Members {
+		for _, role := range m.Add {
+			id, ok := roleID(role)
+			if !ok {
+				continue
+			}
+			if erro := addRole(id, m.Member); erro != nil {
+				err = erro
+				continue
+			}
+			audit(auditEntry{
+				UserID: m.Member.User.ID,
+				Action: auditRoleAdded,
+				RoleID: id,
+				Role:   role.Name,
+				Reason: m.addReason(role.ID),
+			})
+		}
+		for _, role := range m.Remove {
+			if erro := removeRole(role.ID, m.Member); erro != nil {
+				err = erro
+				continue
+			}
+			audit(auditEntry{
+				UserID: m.Member.User.ID,
+				Action: auditRoleRemoved,
+				RoleID: role.ID,
+				Role:   role.Name,
+				Reason: m.removalReason(role.ID),
+			})
+		}
+		if m.Nickname != "" {
+			if erro := dg.GuildMemberNickname(plan.GuildID, m.Member.User.ID, m.Nickname); erro != nil {
+				err = erro
+				continue
+			}
+			audit(auditEntry{
+				UserID:   m.Member.User.ID,
+				Action:   auditNickname,
+				Nickname: m.Nickname,
+				Reason:   "nickname template",
+			})
+		}
+	}
+	return
+}
+
+// summary describes the plan in at most limit characters
+func (p *guildPlan) summary(limit int) (text string) {
+	text = fmt.Sprintf("Plan `%v` changes %v members", p.ID, len(p.Members))
+	if len(p.NewRoles) > 0 {
+		text += fmt.Sprintf(" and creates the roles %v", p.NewRoles)
+	}
+	text += ":"
+
+	for i, m := range p.Members {
+		line := "\n" + m.describe()
+		more := fmt.Sprintf("\n...and %v more", len(p.Members)-i)
+		if len(text)+len(line)+len(more) > limit {
+			return text + more
+		}
+		text += line
+	}
+	return
+}
+
+// describe lists the changes of the member in one line
+func (m *memberPlan) describe() (line string) {
+	line = m.Member.Mention() + ":"
+	for _, role := range m.Add {
+		line += " +" + role.Name
+	}
+	for _, role := range m.Remove {
+		line += " -" + role.Name
+	}
+	if m.Nickname != "" {
+		line += " nickname: " + m.Nickname
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// roleSlotRank binds the role of the rank tier with the minimum rank after the colon
+	roleSlotRank = "rank:"
+
+	// maxRankRoles limits the rank tiers of a discord server
+	maxRankRoles = 25
+)
+
+// rankRole is a role for everyone with at least the wvw rank
+type rankRole struct {
+	MinimumRank int `json:"minimumRank"`
+	// RoleID is the bound discord role, the role is found or created by Name if it is empty.
+	// Name defaults to WvW-Rank- and the minimum rank
+	RoleID string `json:"role"`
+	Name   string `json:"name"`
+}
+
+// name returns the name of a new role of the tier
+func (r rankRole) name() string {
+	if r.Name == "" {
+		return fmt.Sprintf("WvW-Rank-%v", r.MinimumRank)
+	}
+	return r.Name
+}
+
+func rankRoleSlot(minimumRank int) string {
+	return roleSlotRank + strconv.Itoa(minimumRank)
+}
+
+// rankTier returns the rank tier with the highest minimum rank that the rank reaches
+func (o *guildOptions) rankTier(rank int) (tier rankRole, ok bool) {
+	for _, r := range o.RankRoles {
+		if rank >= r.MinimumRank && (!ok || r.MinimumRank > tier.MinimumRank) {
+			tier, ok = r, true
+		}
+	}
+	return
+}
+
+// planRankRole finds the role of the rank tier of the highest rank and remembers it for assignManagedRoles.
+// The roles of the other tiers are removed with a matching reason
+func planRankRole(options *guildOptions, highestRank int, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (managedRoles []guildRole) {
+	for _, r := range options.RankRoles {
+		if r.RoleID != "" {
+			plan.setRemoveReason(r.RoleID, "wvw rank tier changed")
+		}
+	}
+
+	tier, ok := options.rankTier(highestRank)
+	if !ok {
+		return roles
+	}
+	var roleID string
+	roleID, roles = findSlotRole(rankRoleSlot(tier.MinimumRank), tier.name(), roles, guildRoles, plan)
+	plan.verifiedRoleIDs = append(plan.verifiedRoleIDs, roleID)
+	plan.setReason(roleID, fmt.Sprintf("wvw rank %v", highestRank))
+	return roles
+}
+
+// validateRankRoles checks the rank tiers and sorts them by minimum rank
+func validateRankRoles(guildID string, options *guildOptions) (err error) {
+	if len(options.RankRoles) > maxRankRoles {
+		return fmt.Errorf("a server can have at most %v rank roles", maxRankRoles)
+	}
+	sort.Slice(options.RankRoles, func(i, j int) bool {
+		return options.RankRoles[i].MinimumRank < options.RankRoles[j].MinimumRank
+	})
+	for i, r := range options.RankRoles {
+		if r.MinimumRank < 0 {
+			return errors.New("the minimum rank of rank roles can not be negative")
+		}
+		if i > 0 && options.RankRoles[i-1].MinimumRank == r.MinimumRank {
+			return errors.New("every rank role needs a different minimum rank")
+		}
+		if len(r.Name) > maxRoleNameLength {
+			return errors.New("role names can not be longer than 100 characters")
+		}
+		if r.RoleID != "" {
+			role, erro := dg.State.Role(guildID, r.RoleID)
+			if erro != nil || !assignableRole(guildID, role) {
+				return errors.New("the chosen roles have to be roles of this discord server that the bot can assign")
+			}
+		}
+	}
+	return
+}
+
+// describeRankTier names the rank tier of the rank on the discord server
+func describeRankTier(guildID string, options *guildOptions, rank int) string {
+	tier, ok := options.rankTier(rank)
+	if !ok {
+		return "none"
+	}
+	if tier.RoleID != "" {
+		if role, err := dg.State.Role(guildID, tier.RoleID); err == nil {
+			return role.Name
+		}
+	}
+	return tier.name()
+}
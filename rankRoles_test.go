@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/gw2api/gw2apitest"
+)
+
+func TestRankTier(t *testing.T) {
+	options := guildOptions{RankRoles: []rankRole{{MinimumRank: 500}, {MinimumRank: 100}, {MinimumRank: 1000, Name: "Veteran"}}}
+	tests := []struct {
+		rank    int
+		ok      bool
+		minimum int
+	}{
+		{50, false, 0},
+		{100, true, 100},
+		{499, true, 100},
+		{500, true, 500},
+		{5000, true, 1000},
+	}
+	for _, test := range tests {
+		tier, ok := options.rankTier(test.rank)
+		if ok != test.ok || tier.MinimumRank != test.minimum {
+			t.Errorf("rank %v: got tier %v %v, expected %v %v", test.rank, tier.MinimumRank, ok, test.minimum, test.ok)
+		}
+	}
+	if name := (rankRole{MinimumRank: 500}).name(); name != "WvW-Rank-500" {
+		t.Errorf("got default name %q, expected WvW-Rank-500", name)
+	}
+}
+
+// planMember plans the update of a member with the roles and the account data on the discord server "guild"
+func planMember(t *testing.T, options *guildOptions, guildRoles []*discordgo.Role, memberRoles []string, data gw2AccountData) (plan *guildPlan, m *memberPlan) {
+	plan, err := newGuildPlan("guild", "", options)
+	if err != nil {
+		t.Fatalf("creating plan: %v", err)
+	}
+	plan.guildRoles = guildRoles
+	member := &discordgo.Member{
+		GuildID: "guild",
+		User:    &discordgo.User{ID: "user"},
+		Roles:   memberRoles,
+	}
+	m = plan.member(member)
+	if err = planUserDataInGuild(context.Background(), member, data, true, false, m); err != nil {
+		if _, notVerified := err.(notVerifiedError); !notVerified {
+			t.Fatalf("planning: %v", err)
+		}
+	}
+	return
+}
+
+func TestPlanRankRoles(t *testing.T) {
+	previousDatabase := database
+	defer func() { database = previousDatabase }()
+
+	guildRoles := []*discordgo.Role{
+		{ID: "verified", Name: defaultVerifiedRoleName},
+		{ID: "rank100", Name: "Bronze"},
+		{ID: "rank500", Name: "WvW-Rank-500"},
+	}
+	tests := []struct {
+		name        string
+		rank        int
+		memberRoles []string
+		// bound is the role bound to the tier with minimum rank 500
+		bound    string
+		add      []string
+		remove   []string
+		newRoles []string
+		binding  string
+	}{
+		{"bound tier", 150, nil, "", []string{"verified", "rank100"}, nil, nil, ""},
+		{"below every tier", 50, []string{"verified", "rank100"}, "", nil, []string{"rank100"}, nil, ""},
+		{"next tier by default name", 600, []string{"verified", "rank100"}, "", []string{"rank500"}, []string{"rank100"}, nil, "rank500"},
+		{"next tier bound", 600, []string{"verified", "rank100"}, "rank500", []string{"rank500"}, []string{"rank100"}, nil, ""},
+		{"tier role kept", 700, []string{"verified", "rank500"}, "rank500", nil, nil, nil, ""},
+		{"new tier role", 1200, []string{"verified", "rank500"}, "rank500", []string{plannedRolePrefix + "WvW-Rank-1000"}, []string{"rank500"},
+			[]string{"WvW-Rank-1000"}, plannedRolePrefix + "WvW-Rank-1000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			for _, role := range []guildRole{{ID: "verified", Name: defaultVerifiedRoleName}, {ID: "rank100", Name: "Bronze"}} {
+				if err := database.AddManagedRole("guild", role); err != nil {
+					t.Fatalf("adding managed role: %v", err)
+				}
+			}
+			if test.bound != "" {
+				if err := database.AddManagedRole("guild", guildRole{ID: "rank500", Name: "WvW-Rank-500"}); err != nil {
+					t.Fatalf("adding managed role: %v", err)
+				}
+			}
+
+			options := guildOptions{
+				Mode:           oneServer,
+				Gw2ServerID:    2201,
+				VerifiedRoleID: "verified",
+				RankRoles:      []rankRole{{MinimumRank: 100, RoleID: "rank100"}, {MinimumRank: 500, RoleID: test.bound}, {MinimumRank: 1000}},
+			}
+			data := gw2AccountData{Name: "Verified.1234", Worlds: []worldWithRank{{ID: 2201, rank: test.rank, Account: "Verified.1234"}}}
+			plan, m := planMember(t, &options, guildRoles, test.memberRoles, data)
+
+			if add := roleIDs(m.Add); !equalStrings(add, test.add) {
+				t.Errorf("got added roles %v, expected %v", add, test.add)
+			}
+			if remove := roleIDs(m.Remove); !equalStrings(remove, test.remove) {
+				t.Errorf("got removed roles %v, expected %v", remove, test.remove)
+			}
+			for _, role := range test.remove {
+				if reason := m.removalReason(role); reason != "wvw rank tier changed" {
+					t.Errorf("got removal reason %q of %v, expected the tier change", reason, role)
+				}
+			}
+			if !equalStrings(plan.NewRoles, test.newRoles) {
+				t.Errorf("got new roles %v, expected %v", plan.NewRoles, test.newRoles)
+			}
+			if binding := plan.RoleBindings[rankRoleSlot(1000)] + plan.RoleBindings[rankRoleSlot(500)]; binding != test.binding {
+				t.Errorf("got binding %q of the tier, expected %q", binding, test.binding)
+			}
+		})
+	}
+}
+
+func TestPlanGuildRankRoles(t *testing.T) {
+	server := gw2apitest.NewServer()
+	defer server.Close()
+	server.AddKey("leader", gw2api.TokenInfo{Name: "wvwbot"}, gw2api.Account{ID: "leader-id", Name: "Leader.1234", GuildLeader: []string{"gw2guild"}})
+
+	previousDatabase, previousClient := database, gw2Client
+	defer func() { database, gw2Client = previousDatabase, previousClient }()
+	gw2Client = server.NewClient()
+
+	guildRoles := []*discordgo.Role{
+		{ID: "verified", Name: defaultVerifiedRoleName},
+		{ID: "officer", Name: "Officer"},
+		{ID: "member", Name: "Member"},
+	}
+	tests := []struct {
+		name        string
+		rank        string
+		managed     []guildRole
+		bindings    map[string]string
+		memberRoles []string
+		add         []string
+		remove      []string
+		newRoles    []string
+	}{
+		{"bound rank", "Officer", nil, map[string]string{"Officer": "officer"}, []string{"verified"},
+			[]string{"officer"}, nil, nil},
+		// roles of the discord server are not taken over by the name of the rank
+		{"unbound rank", "Officer", nil, nil, []string{"verified"},
+			[]string{plannedRolePrefix + "Officer"}, nil, []string{"Officer"}},
+		{"managed role of the rank", "Officer", []guildRole{{ID: "officer", Name: "Officer"}}, nil, []string{"verified"},
+			[]string{"officer"}, nil, nil},
+		{"rank changed", "Member", nil, map[string]string{"Officer": "officer", "Member": "member"}, []string{"verified", "officer"},
+			[]string{"member"}, []string{"officer"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			server.SetGuildMembers("gw2guild", []gw2api.GuildMember{{Name: "Verified.1234", Rank: test.rank}})
+			managed := append([]guildRole{{ID: "verified", Name: defaultVerifiedRoleName}}, test.managed...)
+			for id, rank := range map[string]string{"officer": "Officer", "member": "Member"} {
+				if test.bindings[rank] == id {
+					managed = append(managed, guildRole{ID: id, Name: rank})
+				}
+			}
+			for _, role := range managed {
+				if err := database.AddManagedRole("guild", role); err != nil {
+					t.Fatalf("adding managed role: %v", err)
+				}
+			}
+
+			options := guildOptions{
+				Mode:             guildMember,
+				Gw2GuildIDs:      []string{"gw2guild"},
+				Gw2AccountKey:    "leader",
+				GuildRankRoles:   true,
+				VerifiedRoleID:   "verified",
+				GuildRankRoleIDs: test.bindings,
+			}
+			data := gw2AccountData{Name: "Verified.1234", Worlds: []worldWithRank{{ID: 2201, Account: "Verified.1234", Guilds: []string{"gw2guild"}}}}
+			plan, m := planMember(t, &options, guildRoles, test.memberRoles, data)
+
+			if add := roleIDs(m.Add); !equalStrings(add, test.add) {
+				t.Errorf("got added roles %v, expected %v", add, test.add)
+			}
+			if remove := roleIDs(m.Remove); !equalStrings(remove, test.remove) {
+				t.Errorf("got removed roles %v, expected %v", remove, test.remove)
+			}
+			if !equalStrings(plan.NewRoles, test.newRoles) {
+				t.Errorf("got new roles %v, expected %v", plan.NewRoles, test.newRoles)
+			}
+			if len(test.add) > 0 && test.bindings[test.rank] == "" {
+				if binding := plan.RoleBindings[guildRankRoleSlot(test.rank)]; binding != test.add[0] {
+					t.Errorf("got binding %q of the rank, expected %q", binding, test.add[0])
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateRoleBindingsWithRankRoles(t *testing.T) {
+	previousDatabase, previousWorlds := database, currentWorlds
+	defer func() { database, currentWorlds = previousDatabase, previousWorlds }()
+	database = newMemoryStore()
+	currentWorlds = map[int]*linkInfo{2201: {ID: 2201, Name: "First", Linked: []int{2201}}}
+
+	// managed roles of older versions are only known by their names
+	for _, role := range []guildRole{
+		{ID: "verified", Name: defaultVerifiedRoleName},
+		{ID: "linked", Name: defaultLinkedRoleName},
+		{ID: "world", Name: "First"},
+		{ID: "rank100", Name: "WvW-Rank-100"},
+		{ID: "officer", Name: "Officer"},
+		// another role with a default name must not replace a role that is bound already
+		{ID: "rank-linked", Name: defaultLinkedRoleName},
+	} {
+		if err := database.AddManagedRole("guild", role); err != nil {
+			t.Fatalf("adding managed role: %v", err)
+		}
+	}
+	options := guildOptions{
+		Mode:             guildMember,
+		LinkedRoleID:     "linked",
+		RankRoles:        []rankRole{{MinimumRank: 100}},
+		GuildRankRoleIDs: map[string]string{"Officer": "officer"},
+	}
+	if err := saveGuildSettings("guild", &options); err != nil {
+		t.Fatalf("saving guild settings: %v", err)
+	}
+
+	migrateRoleBindings()
+
+	migrated, err := getGuildSettings("guild")
+	if err != nil {
+		t.Fatalf("getting guild settings: %v", err)
+	}
+	expected := map[string]string{
+		roleSlotVerified:             "verified",
+		roleSlotLinked:               "linked",
+		worldRoleSlot(2201):          "world",
+		guildRankRoleSlot("Officer"): "officer",
+		// rank tiers keep finding their role by name until it is bound by an update
+		rankRoleSlot(100): "",
+	}
+	for slot, id := range expected {
+		if bound := migrated.roleID(slot); bound != id {
+			t.Errorf("got %q bound to %v, expected %q", bound, slot, id)
+		}
+	}
+
+	// updates after the migration use the bound roles and bind the rank tier
+	migrated.Mode = oneServer
+	migrated.Gw2ServerID = 2201
+	guildRoles := []*discordgo.Role{
+		{ID: "verified", Name: defaultVerifiedRoleName},
+		{ID: "rank100", Name: "WvW-Rank-100"},
+		{ID: "officer", Name: "Officer"},
+	}
+	data := gw2AccountData{Name: "Verified.1234", Worlds: []worldWithRank{{ID: 2201, rank: 150, Account: "Verified.1234"}}}
+	plan, m := planMember(t, migrated, guildRoles, []string{"officer"}, data)
+	if add := roleIDs(m.Add); !equalStrings(add, []string{"verified", "rank100"}) {
+		t.Errorf("got added roles %v, expected verified and rank100", add)
+	}
+	if len(plan.NewRoles) != 0 {
+		t.Errorf("got new roles %v, expected none", plan.NewRoles)
+	}
+	if binding := plan.RoleBindings[rankRoleSlot(100)]; binding != "rank100" {
+		t.Errorf("got binding %q of the rank tier, expected rank100", binding)
+	}
+}
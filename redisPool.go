@@ -7,23 +7,6 @@ import (
 	"github.com/greaka/discordwvwbot/loglevels"
 )
 
-var (
-	// userDatabase holds connections to the redis server
-	usersDatabase *redis.Pool
-	// guildsDatabase holds connections to the redis server
-	guildsDatabase *redis.Pool
-	// sessionsDatabase holds connections to the redis server
-	sessionsDatabase *redis.Pool
-	// cacheDatabase holds connections to the redis server
-	cacheDatabase *redis.Pool
-	// guildRolesDatabase holds connections to the redis server
-	guildRolesDatabase *redis.Pool
-	// uniqueUsersDatabase holds connections to the redis server
-	uniqueUsersDatabase *redis.Pool
-	// guildVerifiesDatabase holds connections to the redis server
-	guildVerifiesDatabase *redis.Pool
-)
-
 type redisDatabase int
 
 // only add new namespaces below to not mess up existing databases
@@ -36,18 +19,12 @@ const (
 	dbTypeGuildRoles
 	dbGw2UsersToDiscordUsers
 	dbAdditionalVerifies
+	dbTypeAuditLog
+	dbTypeMutedUsers
+	dbTypeWorldLinks
+	dbTypeWorldSnapshots
 )
 
-func initializeRedisPools() {
-	usersDatabase = newPool(dbTypeUsers)
-	guildsDatabase = newPool(dbTypeGuilds)
-	sessionsDatabase = newPool(dbTypeSessions)
-	cacheDatabase = newPool(dbTypeCache)
-	guildRolesDatabase = newPool(dbTypeGuildRoles)
-	uniqueUsersDatabase = newPool(dbGw2UsersToDiscordUsers)
-	guildVerifiesDatabase = newPool(dbAdditionalVerifies)
-}
-
 // newPool initializes a new pool
 func newPool(db redisDatabase) *redis.Pool {
 	return &redis.Pool{
@@ -87,3 +64,78 @@ func closeConnection(c redis.Conn) {
 		loglevels.Errorf("Error closing redis connection: %v\n", err)
 	}
 }
+
+// iterateDatabase calls processValue for every key of the selected database
+func iterateDatabase(redisConn redis.Conn, processValue func(string)) (valueCount int, err error) {
+	cursor := 0
+	valueCount = 0
+
+	for ok := true; ok; ok = cursor != 0 {
+		var scan []interface{}
+		scan, err = redis.Values(redisConn.Do("SCAN", cursor))
+		if err != nil {
+			loglevels.Errorf("Error getting scan %v from redis: %v\n", cursor, err)
+			return
+		}
+
+		// convert returned string to []string of 1) new cursor and 2) values
+		var values []string
+		_, err = redis.Scan(scan, &cursor, &values)
+		if err != nil {
+			loglevels.Errorf("Error converting scan %v: %v\n", cursor, err)
+			return
+		}
+
+		valueCount += len(values)
+
+		// fire update while list not empty and not databse key "guilds"
+		for len(values) > 0 {
+			processValue(values[0])
+			values = remove(values, 0)
+		}
+	}
+	return
+}
+
+// keep in mind that this is called from migration, so look if you break migration if you change something here
+/// this uses keys *, please consider twice if you need it
+func smembersallkeys(redisConn redis.Conn, processValue func(string, []string)) (keyCount int, valueCount int) {
+	valueCount = 0
+
+	scan, err := redis.Values(redisConn.Do("KEYS", "*"))
+	if err != nil {
+		loglevels.Errorf("Error getting keys from redis: %v\n", err)
+		return
+	}
+
+	var allKeys []string
+	err = redis.ScanSlice(scan, &allKeys)
+	if err != nil {
+		loglevels.Errorf("Error converting all keys to []string: %v\n", err)
+		return
+	}
+
+	keyCount = len(allKeys)
+	i := -1
+	for i < len(allKeys)-1 {
+		i++
+		key := allKeys[i]
+
+		scanValues, err := redis.Values(redisConn.Do("SMEMBERS", key))
+		if err != nil {
+			loglevels.Errorf("Error getting values from redis: %v\n", err)
+			return
+		}
+
+		var values []string
+		err = redis.ScanSlice(scanValues, &values)
+		if err != nil {
+			loglevels.Errorf("Error converting values to []string: %v\n", err)
+			return
+		}
+
+		valueCount += len(values)
+		processValue(key, values)
+	}
+	return
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisStore implements Store with one redis database per namespace
+type redisStore struct {
+	// users holds connections to the redis server
+	users *redis.Pool
+	// guilds holds connections to the redis server
+	guilds *redis.Pool
+	// sessions holds connections to the redis server
+	sessions *redis.Pool
+	// cache holds connections to the redis server
+	cache *redis.Pool
+	// guildRoles holds connections to the redis server
+	guildRoles *redis.Pool
+	// uniqueUsers holds connections to the redis server
+	uniqueUsers *redis.Pool
+	// guildVerifies holds connections to the redis server
+	guildVerifies *redis.Pool
+	// auditLog holds connections to the redis server
+	auditLog *redis.Pool
+	// mutedUsers holds connections to the redis server
+	mutedUsers *redis.Pool
+	// worldLinks holds connections to the redis server
+	worldLinks *redis.Pool
+	// worldSnapshots holds connections to the redis server
+	worldSnapshots *redis.Pool
+}
+
+// worldSnapshotsKey is the sorted set of the world snapshots scored by their unix start time
+const worldSnapshotsKey = "snapshots"
+
+func newRedisStore() *redisStore {
+	return &redisStore{
+		users:          newPool(dbTypeUsers),
+		guilds:         newPool(dbTypeGuilds),
+		sessions:       newPool(dbTypeSessions),
+		cache:          newPool(dbTypeCache),
+		guildRoles:     newPool(dbTypeGuildRoles),
+		uniqueUsers:    newPool(dbGw2UsersToDiscordUsers),
+		guildVerifies:  newPool(dbAdditionalVerifies),
+		auditLog:       newPool(dbTypeAuditLog),
+		mutedUsers:     newPool(dbTypeMutedUsers),
+		worldLinks:     newPool(dbTypeWorldLinks),
+		worldSnapshots: newPool(dbTypeWorldSnapshots),
+	}
+}
+
+// do executes a single command on a connection of the pool
+func (s *redisStore) do(pool *redis.Pool, command string, args ...interface{}) (reply interface{}, err error) {
+	c := pool.Get()
+	defer closeConnection(c)
+	reply, err = c.Do(command, args...)
+	if err != nil && err != redis.ErrNil {
+		redisErrors.add(1, "command", command)
+	}
+	return
+}
+
+func (s *redisStore) Ping() (err error) {
+	_, err = s.do(s.users, "PING")
+	return
+}
+
+// get executes GET and translates a missing key to errNotFound
+func (s *redisStore) get(pool *redis.Pool, key string) (value string, err error) {
+	value, err = redis.String(s.do(pool, "GET", key))
+	if err == redis.ErrNil {
+		err = errNotFound
+	}
+	return
+}
+
+// setEx executes SET with an expiry in seconds
+func (s *redisStore) setEx(pool *redis.Pool, key, value string, expire time.Duration) (err error) {
+	_, err = s.do(pool, "SET", key, value, "EX", int(expire.Seconds()))
+	return
+}
+
+func (s *redisStore) iterate(pool *redis.Pool, processValue func(string)) (count int, err error) {
+	c := pool.Get()
+	defer closeConnection(c)
+	return iterateDatabase(c, processValue)
+}
+
+func (s *redisStore) GetAPIKeys(userID string) (keys []string, err error) {
+	keys, err = redis.Strings(s.do(s.users, "SMEMBERS", userID))
+	return
+}
+
+func (s *redisStore) AddAPIKey(userID, key string) (err error) {
+	_, err = s.do(s.users, "SADD", userID, key)
+	return
+}
+
+func (s *redisStore) RemoveAPIKey(userID, key string) (err error) {
+	_, err = s.do(s.users, "SREM", userID, key)
+	return
+}
+
+func (s *redisStore) DeleteUser(userID string) (err error) {
+	_, err = s.do(s.users, "DEL", userID)
+	return
+}
+
+func (s *redisStore) IterateUsers(processValue func(string)) (count int, err error) {
+	return s.iterate(s.users, processValue)
+}
+
+func (s *redisStore) GuildExists(guildID string) (exists bool, err error) {
+	exists, err = redis.Bool(s.do(s.guilds, "EXISTS", guildID))
+	return
+}
+
+func (s *redisStore) GetGuildSettings(guildID string) (options *guildOptions, err error) {
+	settingsString, err := s.get(s.guilds, guildID)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(settingsString), &options)
+	return
+}
+
+func (s *redisStore) SaveGuildSettings(guildID string, options *guildOptions) (err error) {
+	settingsString, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+	_, err = s.do(s.guilds, "SET", guildID, settingsString)
+	return
+}
+
+func (s *redisStore) IterateGuilds(processValue func(string)) (count int, err error) {
+	return s.iterate(s.guilds, processValue)
+}
+
+func (s *redisStore) GetManagedRoles(guildID string) (roles []guildRole, err error) {
+	roleStrings, err := redis.Strings(s.do(s.guildRoles, "SMEMBERS", guildID))
+	if err != nil {
+		return
+	}
+	for _, roleString := range roleStrings {
+		var role guildRole
+		if err = json.Unmarshal([]byte(roleString), &role); err != nil {
+			return
+		}
+		roles = append(roles, role)
+	}
+	return
+}
+
+func (s *redisStore) AddManagedRole(guildID string, role guildRole) (err error) {
+	roleString, err := json.Marshal(role)
+	if err != nil {
+		return
+	}
+	_, err = s.do(s.guildRoles, "SADD", guildID, roleString)
+	return
+}
+
+func (s *redisStore) RemoveManagedRole(guildID string, role guildRole) (err error) {
+	roleString, err := json.Marshal(role)
+	if err != nil {
+		return
+	}
+	_, err = s.do(s.guildRoles, "SREM", guildID, roleString)
+	return
+}
+
+func (s *redisStore) GetAccountOwner(accountID string) (userID string, err error) {
+	return s.get(s.uniqueUsers, accountID)
+}
+
+func (s *redisStore) SetAccountOwner(accountID, userID string) (err error) {
+	_, err = s.do(s.uniqueUsers, "SET", accountID, userID)
+	return
+}
+
+func (s *redisStore) GetAdditionalWorlds(guildID string) (worlds []int, err error) {
+	worlds, err = redis.Ints(s.do(s.guildVerifies, "SMEMBERS", guildID))
+	return
+}
+
+func (s *redisStore) AddAdditionalWorld(guildID string, world int, expire time.Duration) (err error) {
+	c := s.guildVerifies.Get()
+	defer closeConnection(c)
+	_, err = c.Do("SADD", guildID, world)
+	if err != nil {
+		return
+	}
+	_, err = c.Do("EXPIRE", guildID, int(expire.Seconds()))
+	return
+}
+
+func (s *redisStore) GetSession(key string) (string, error) {
+	return s.get(s.sessions, key)
+}
+
+func (s *redisStore) SetSession(key, value string, expire time.Duration) error {
+	return s.setEx(s.sessions, key, value, expire)
+}
+
+func (s *redisStore) DeleteSession(key string) (err error) {
+	_, err = s.do(s.sessions, "DEL", key)
+	return
+}
+
+func (s *redisStore) GetCache(key string) (string, error) {
+	return s.get(s.cache, key)
+}
+
+func (s *redisStore) SetCache(key, value string, expire time.Duration) error {
+	return s.setEx(s.cache, key, value, expire)
+}
+
+func (s *redisStore) NotificationsMuted(userID string) (muted bool, err error) {
+	muted, err = redis.Bool(s.do(s.mutedUsers, "EXISTS", userID))
+	return
+}
+
+func (s *redisStore) SetNotificationsMuted(userID string, muted bool) (err error) {
+	if muted {
+		_, err = s.do(s.mutedUsers, "SET", userID, 1)
+	} else {
+		_, err = s.do(s.mutedUsers, "DEL", userID)
+	}
+	return
+}
+
+func (s *redisStore) GetLinkedWorlds(world int) (linked []int, err error) {
+	linkedString, err := s.get(s.worldLinks, strconv.Itoa(world))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(linkedString), &linked)
+	return
+}
+
+func (s *redisStore) SetLinkedWorlds(world int, linked []int) (err error) {
+	linkedString, err := json.Marshal(linked)
+	if err != nil {
+		return
+	}
+	_, err = s.do(s.worldLinks, "SET", world, linkedString)
+	return
+}
+
+func (s *redisStore) SaveWorldSnapshot(start time.Time, snapshot string) (err error) {
+	c := s.worldSnapshots.Get()
+	defer closeConnection(c)
+	_, err = c.Do("ZREMRANGEBYSCORE", worldSnapshotsKey, start.Unix(), start.Unix())
+	if err != nil {
+		return
+	}
+	_, err = c.Do("ZADD", worldSnapshotsKey, start.Unix(), snapshot)
+	return
+}
+
+func (s *redisStore) GetWorldSnapshots(before time.Time, limit int) (snapshots []string, err error) {
+	snapshots, err = redis.Strings(s.do(s.worldSnapshots, "ZREVRANGEBYSCORE", worldSnapshotsKey, before.Unix(), "-inf", "LIMIT", 0, limit))
+	return
+}
+
+// AddAuditEntry keeps the audit log of a discord server as sorted set scored by unix nano time
+func (s *redisStore) AddAuditEntry(guildID string, at time.Time, entry string, retention time.Duration) (err error) {
+	c := s.auditLog.Get()
+	defer closeConnection(c)
+	_, err = c.Do("ZADD", guildID, at.UnixNano(), entry)
+	if err != nil {
+		return
+	}
+	_, err = c.Do("ZREMRANGEBYSCORE", guildID, "-inf", "("+strconv.FormatInt(at.Add(-retention).UnixNano(), 10))
+	if err != nil {
+		return
+	}
+	_, err = c.Do("EXPIRE", guildID, int(retention.Seconds()))
+	return
+}
+
+func (s *redisStore) GetAuditEntries(guildID string, limit int) (entries []string, err error) {
+	entries, err = redis.Strings(s.do(s.auditLog, "ZREVRANGE", guildID, 0, limit-1))
+	return
+}
+
+func (s *redisStore) Close() (err error) {
+	for _, pool := range []*redis.Pool{s.users, s.guilds, s.sessions, s.cache, s.guildRoles, s.uniqueUsers, s.guildVerifies, s.auditLog, s.mutedUsers, s.worldLinks, s.worldSnapshots} {
+		if erro := pool.Close(); erro != nil {
+			err = erro
+		}
+	}
+	return
+}
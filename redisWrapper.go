@@ -1,11 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/gomodule/redigo/redis"
 	"github.com/greaka/discordwvwbot/loglevels"
 )
 
@@ -14,48 +13,40 @@ const (
 )
 
 func getAPIKeys(userID string) (keys []string, err error) {
-	redisConn := usersDatabase.Get()
 	// get all api keys of the user
-	apikeys, err := redis.Values(redisConn.Do("SMEMBERS", userID))
-	closeConnection(redisConn)
+	stored, err := database.GetAPIKeys(userID)
 	if err != nil {
-		loglevels.Errorf("Error getting api keys from redis: %v\n", err)
+		loglevels.Errorf("Error getting api keys from database: %v\n", err)
 		return
 	}
 
-	err = redis.ScanSlice(apikeys, &keys)
-	if err != nil {
-		loglevels.Errorf("Error converting api keys to []string: %v\n", err)
-		return
+	keys = make([]string, 0, len(stored))
+	for _, value := range stored {
+		key, erro := decrypt(value)
+		if erro != nil {
+			loglevels.Errorf("Error decrypting api key of user %v: %v\n", userID, erro)
+			continue
+		}
+		keys = append(keys, key)
 	}
 	return
 }
 
-func iterateDatabase(redisConn redis.Conn, processValue func(string)) (valueCount int) {
-	cursor := 0
-	valueCount = 0
+func removeAPIKey(userID, key string) (err error) {
+	// the stored value differs from the key if it is encrypted
+	stored, err := database.GetAPIKeys(userID)
+	if err != nil {
+		loglevels.Errorf("Error getting api keys from database: %v\n", err)
+		return
+	}
 
-	for ok := true; ok; ok = cursor != 0 {
-		scan, err := redis.Values(redisConn.Do("SCAN", cursor))
-		if err != nil {
-			loglevels.Errorf("Error getting scan %v from redis: %v\n", cursor, err)
-			return
+	for _, value := range stored {
+		if plain, erro := decrypt(value); erro != nil || plain != key {
+			continue
 		}
-
-		// convert returned string to []string of 1) new cursor and 2) values
-		var values []string
-		_, err = redis.Scan(scan, &cursor, &values)
+		err = database.RemoveAPIKey(userID, value)
 		if err != nil {
-			loglevels.Errorf("Error converting scan %v: %v\n", cursor, err)
-			return
-		}
-
-		valueCount += len(values)
-
-		// fire update while list not empty and not databse key "guilds"
-		for len(values) > 0 {
-			processValue(values[0])
-			values = remove(values, 0)
+			loglevels.Errorf("Error deleting api key from database: %v", err)
 		}
 	}
 	return
@@ -63,15 +54,14 @@ func iterateDatabase(redisConn redis.Conn, processValue func(string)) (valueCoun
 
 /// returns userID of user that already uses this acc and not ok if user != userID
 func checkUnique(acc string, user string, force bool) (userID string, err error) {
-	rc := uniqueUsersDatabase.Get()
-	defer closeConnection(rc)
-	userID, err = redis.String(rc.Do("GET", acc))
-	if err != nil && err.Error() != "redigo: nil returned" {
-		loglevels.Errorf("Error getting unique acc %v from redis: %v\n", acc, err)
+	userID, err = database.GetAccountOwner(acc)
+	if err != nil && err != errNotFound {
+		loglevels.Errorf("Error getting unique acc %v from database: %v\n", acc, err)
 		return
 	}
+	err = nil
 	if userID == "" || force {
-		_, err = rc.Do("SET", acc, user)
+		err = database.SetAccountOwner(acc, user)
 		if err != nil {
 			loglevels.Errorf("Error saving unique acc %v to user %v: %v\n", acc, user, err)
 		}
@@ -84,50 +74,7 @@ func checkUnique(acc string, user string, force bool) (userID string, err error)
 }
 
 // keep in mind that this is called from migration, so look if you break migration if you change something here
-/// this uses keys *, please consider twice if you need it
-func smembersallkeys(redisConn redis.Conn, processValue func(string, []string)) (keyCount int, valueCount int) {
-	valueCount = 0
-
-	scan, err := redis.Values(redisConn.Do("KEYS", "*"))
-	if err != nil {
-		loglevels.Errorf("Error getting keys from redis: %v\n", err)
-		return
-	}
-
-	var allKeys []string
-	err = redis.ScanSlice(scan, &allKeys)
-	if err != nil {
-		loglevels.Errorf("Error converting all keys to []string: %v\n", err)
-		return
-	}
-
-	keyCount = len(allKeys)
-	i := -1
-	for i < len(allKeys)-1 {
-		i++
-		key := allKeys[i]
-
-		scanValues, err := redis.Values(redisConn.Do("SMEMBERS", key))
-		if err != nil {
-			loglevels.Errorf("Error getting values from redis: %v\n", err)
-			return
-		}
-
-		var values []string
-		err = redis.ScanSlice(scanValues, &values)
-		if err != nil {
-			loglevels.Errorf("Error converting values to []string: %v\n", err)
-			return
-		}
-
-		valueCount += len(values)
-		processValue(key, values)
-	}
-	return
-}
-
-// keep in mind that this is called from migration, so look if you break migration if you change something here
-func saveNewGuild(gc redis.Conn, guild string) (err error) {
+func saveNewGuild(guild string) (err error) {
 	options := guildOptions{
 		Gw2ServerID:   0,
 		Gw2AccountKey: "",
@@ -141,14 +88,7 @@ func saveNewGuild(gc redis.Conn, guild string) (err error) {
 	}
 	loglevels.Infof("New guild: %v\n", guild)
 
-	var stringifiedOptions []byte
-	stringifiedOptions, err = json.Marshal(options)
-	if err != nil {
-		loglevels.Errorf("Error marshaling default options for guild %v: %v\n", guild, err)
-		return
-	}
-
-	_, err = gc.Do("SET", guild, stringifiedOptions)
+	err = database.SaveGuildSettings(guild, &options)
 	if err != nil {
 		loglevels.Errorf("Error saving default options for guild %v: %v\n", guild, err)
 		return
@@ -157,15 +97,15 @@ func saveNewGuild(gc redis.Conn, guild string) (err error) {
 }
 
 func saveGuildSettings(guildID string, s *guildOptions) (err error) {
-	settingsString, err := json.Marshal(&s)
+	// encrypt the key on a copy to not leak the encrypted key to the caller
+	options := *s
+	options.Gw2AccountKey, err = encrypt(s.Gw2AccountKey)
 	if err != nil {
-		loglevels.Errorf("Error marshaling guild options for guild %v: %v\n", guildID, err)
+		loglevels.Errorf("Error encrypting api key for guild %v: %v\n", guildID, err)
 		return
 	}
 
-	c := guildsDatabase.Get()
-	_, err = redis.String(c.Do("SET", guildID, settingsString))
-	closeConnection(c)
+	err = database.SaveGuildSettings(guildID, &options)
 	if err != nil {
 		loglevels.Errorf("Error setting options for guild %v: %v\n", guildID, err)
 		return
@@ -174,47 +114,29 @@ func saveGuildSettings(guildID string, s *guildOptions) (err error) {
 }
 
 func getGuildSettings(guildID string) (s *guildOptions, err error) {
-	c := guildsDatabase.Get()
-	settingsString, err := redis.String(c.Do("GET", guildID))
-	closeConnection(c)
+	s, err = database.GetGuildSettings(guildID)
 	if err != nil {
 		loglevels.Errorf("Error getting options for guild %v: %v\n", guildID, err)
 		return
 	}
 
-	err = json.Unmarshal([]byte(settingsString), &s)
+	s.Gw2AccountKey, err = decrypt(s.Gw2AccountKey)
 	if err != nil {
-		loglevels.Errorf("Error converting guild options for guild %v: %v\n", guildID, err)
+		loglevels.Errorf("Error decrypting api key for guild %v: %v\n", guildID, err)
 		return
 	}
 	return
 }
 
 func getGuildRoles(guildID string, guildRoles []*discordgo.Role) (roleStructs []guildRole, err error) {
-	redisConn := guildRolesDatabase.Get()
 	// get all managed guild roles
-	roleString, err := redis.Values(redisConn.Do("SMEMBERS", guildID))
-	closeConnection(redisConn)
-	if err != nil {
-		loglevels.Errorf("Error getting api keys from redis: %v\n", err)
-		return
-	}
-
-	var roles []string
-	err = redis.ScanSlice(roleString, &roles)
+	roles, err := database.GetManagedRoles(guildID)
 	if err != nil {
-		loglevels.Errorf("Error converting api keys to []string: %v\n", err)
+		loglevels.Errorf("Error getting guild roles for guild %v from database: %v\n", guildID, err)
 		return
 	}
 
-	for _, role := range roles {
-		var roleStruct guildRole
-		err = json.Unmarshal([]byte(role), &roleStruct)
-		if err != nil {
-			loglevels.Errorf("Error converting guild roles for guild %v: %v\n", guildID, err)
-			return
-		}
-
+	for _, roleStruct := range roles {
 		found := false
 		for _, guildRole := range guildRoles {
 			if guildRole.ID == roleStruct.ID {
@@ -234,18 +156,9 @@ func getGuildRoles(guildID string, guildRoles []*discordgo.Role) (roleStructs []
 }
 
 func addGuildRole(guildID string, role guildRole) (err error) {
-	roleString, err := json.Marshal(role)
+	err = database.AddManagedRole(guildID, role)
 	if err != nil {
-		loglevels.Errorf("Error converting guild roles for guild %v: %v\n", guildID, err)
-		return
-	}
-
-	redisConn := guildRolesDatabase.Get()
-	// get all managed guild roles
-	_, err = redisConn.Do("SADD", guildID, roleString)
-	closeConnection(redisConn)
-	if err != nil {
-		loglevels.Errorf("Error getting guild role from redis: %v\n", err)
+		loglevels.Errorf("Error adding guild role to database: %v\n", err)
 		return
 	}
 
@@ -253,18 +166,9 @@ func addGuildRole(guildID string, role guildRole) (err error) {
 }
 
 func removeGuildRole(guildID string, role guildRole) (err error) {
-	roleString, err := json.Marshal(role)
-	if err != nil {
-		loglevels.Errorf("Error converting guild roles for guild %v: %v\n", guildID, err)
-		return
-	}
-
-	redisConn := guildRolesDatabase.Get()
-	// get all managed guild roles
-	_, err = redisConn.Do("SREM", guildID, roleString)
-	closeConnection(redisConn)
+	err = database.RemoveManagedRole(guildID, role)
 	if err != nil {
-		loglevels.Errorf("Error removing guild role from redis: %v\n", err)
+		loglevels.Errorf("Error removing guild role from database: %v\n", err)
 		return
 	}
 
@@ -273,12 +177,21 @@ func removeGuildRole(guildID string, role guildRole) (err error) {
 
 func addUserKey(user string, key string) (erro error) {
 	loglevels.Infof("add user %v", user)
-	redisConn := usersDatabase.Get()
-	// SADD will ignore the request if the apikey is already saved from this user
-	_, err := redisConn.Do("SADD", user, key)
-	closeConnection(redisConn)
+	keys, err := getAPIKeys(user)
 	if err != nil {
-		loglevels.Errorf("Error saving key to redis: %v\n", err)
+		erro = errors.New("internal error, please try again or contact me")
+		return
+	}
+	// encrypted values always differ, so check for already saved keys of this user here
+	if indexOfString(key, keys) == -1 {
+		var stored string
+		stored, err = encrypt(key)
+		if err == nil {
+			err = database.AddAPIKey(user, stored)
+		}
+	}
+	if err != nil {
+		loglevels.Errorf("Error saving key to database: %v\n", err)
 		erro = errors.New("internal error, please try again or contact me")
 		return
 	}
@@ -291,18 +204,9 @@ func addUserKey(user string, key string) (erro error) {
 }
 
 func getAdditionalWorlds(guildID string) (additionalWorlds []int, err error) {
-	redisConn := guildVerifiesDatabase.Get()
-	// get all managed guild roles
-	worldString, err := redis.Values(redisConn.Do("SMEMBERS", guildID))
-	closeConnection(redisConn)
+	additionalWorlds, err = database.GetAdditionalWorlds(guildID)
 	if err != nil {
-		loglevels.Errorf("Error getting additional roles from redis: %v\n", err)
-		return
-	}
-
-	err = redis.ScanSlice(worldString, &additionalWorlds)
-	if err != nil {
-		loglevels.Errorf("Error converting api keys to []string: %v\n", err)
+		loglevels.Errorf("Error getting additional roles from database: %v\n", err)
 		return
 	}
 
@@ -310,32 +214,29 @@ func getAdditionalWorlds(guildID string) (additionalWorlds []int, err error) {
 }
 
 func addAdditionalWorld(guildID string, world int) (err error) {
-	redisConn := guildVerifiesDatabase.Get()
-	defer closeConnection(redisConn)
-	// get all managed guild roles
-	_, err = redisConn.Do("SADD", guildID, world)
+	err = database.AddAdditionalWorld(guildID, world, 24*time.Hour)
 	if err != nil {
-		loglevels.Errorf("Error adding additional roles to redis: %v\n", err)
+		loglevels.Errorf("Error adding additional roles to database: %v\n", err)
 		return
 	}
-
-	_, err = redisConn.Do("EXPIRE", guildID, 60*60*24)
 	return
 }
 
 func deleteAllData(userID string) (err error) {
 	loglevels.Infof("Delete all data for user %v", userID)
-	redisConn := usersDatabase.Get()
-	defer closeConnection(redisConn)
-	_, err = redisConn.Do("DEL", userID)
+	err = revokeSessions(userID)
+	if err != nil {
+		return
+	}
+	err = database.DeleteUser(userID)
 	if err != nil {
-		loglevels.Errorf("Error deleting key from redis: %v\n", err)
+		loglevels.Errorf("Error deleting key from database: %v\n", err)
 		return
 	}
 	// this is for deleting roles properly and will be removed on the next run
-	_, err = redisConn.Do("SADD", userID, "A")
+	err = database.AddAPIKey(userID, deletedUserKey)
 	if err != nil {
-		loglevels.Errorf("Error adding temporary key to redis: %v\n", err)
+		loglevels.Errorf("Error adding temporary key to database: %v\n", err)
 		return
 	}
 	return
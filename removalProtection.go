@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// lastKnownAccountExpire is how long the last data of an api key can stand in for failed requests
+	lastKnownAccountExpire = 7 * 24 * time.Hour
+
+	// maxRemovalConfirmations and maxRemovalGracePeriod are the highest removal delays discord servers can choose
+	maxRemovalConfirmations = 10
+	maxRemovalGracePeriod   = 7 * 24 * time.Hour
+
+	// role removals are paused once at least breakerErrorRate of breakerMinRequests or more
+	// gw2 api requests within breakerWindow failed. They stay paused for breakerCooldown after the last failure spike
+	breakerWindow      = 10 * time.Minute
+	breakerMinRequests = 20
+	breakerErrorRate   = 0.25
+	breakerCooldown    = 30 * time.Minute
+)
+
+// lastKnownAccount is the latest complete data of an api key
+type lastKnownAccount struct {
+	Account gw2api.Account    `json:"account"`
+	WvW     gw2api.AccountWvW `json:"wvw"`
+	// Permissions of the api key, nil if the token info is not known
+	Permissions []string  `json:"permissions,omitempty"`
+	Checked     time.Time `json:"checked"`
+}
+
+var (
+	// pendingRemovals holds the role removals of scheduled updates that wait for their confirmation by member and role.
+	// They are only kept in memory, a restart only delays the removals
+	pendingRemovals = struct {
+		sync.Mutex
+		members map[string]map[string]pendingRemoval
+		// cycle is the start of the current full update
+		cycle time.Time
+	}{members: make(map[string]map[string]pendingRemoval)}
+
+	// gw2Breaker counts the gw2 api requests and failures per minute of breakerWindow
+	gw2Breaker struct {
+		sync.Mutex
+		minutes     [int(breakerWindow / time.Minute)]breakerMinute
+		pausedUntil time.Time
+		paused      bool
+	}
+)
+
+type pendingRemoval struct {
+	since time.Time
+	last  time.Time
+	count int
+}
+
+type breakerMinute struct {
+	minute   time.Time
+	requests int
+	failures int
+}
+
+// rememberAccount saves the complete data of the api key for the times the gw2 api fails
+func rememberAccount(key string, account gw2api.Account, wvw gw2api.AccountWvW, permissions []string) {
+	value, err := json.Marshal(lastKnownAccount{
+		Account:     account,
+		WvW:         wvw,
+		Permissions: permissions,
+		Checked:     time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	if err = database.SetCache("gw2LastKnown"+hashKey(key), string(value), lastKnownAccountExpire); err != nil {
+		loglevels.Warningf("Error saving the last known data of an api key: %v\n", err)
+	}
+}
+
+// getLastKnownAccount returns the last complete data of the api key, ok is false if there is none
+func getLastKnownAccount(key string) (known lastKnownAccount, ok bool) {
+	value, err := database.GetCache("gw2LastKnown" + hashKey(key))
+	if err != nil {
+		if err != errNotFound {
+			loglevels.Warningf("Error getting the last known data of an api key: %v\n", err)
+		}
+		return
+	}
+	if err = json.Unmarshal([]byte(value), &known); err != nil {
+		return
+	}
+	return known, !known.Checked.IsZero()
+}
+
+// removalDelayed returns whether the discord server confirms role removals of updates before applying them
+func (o *guildOptions) removalDelayed() bool {
+	return o.RemovalConfirmations > 1 || o.RemovalGracePeriod > 0
+}
+
+// removalGracePeriod returns how long a role removal has to be planned before it is applied
+func (o *guildOptions) removalGracePeriod() time.Duration {
+	return time.Duration(o.RemovalGracePeriod) * time.Hour
+}
+
+// confirmRemovals postpones the role removals of the plan until every one of them was planned by enough consecutive
+// updates and for long enough. Only the purge and applied previews remove roles right away, because a manager asked
+// for exactly these removals. Removing the unverified role is never postponed
+func (p *guildPlan) confirmRemovals() {
+	if p.Trigger == triggerPurge || p.Trigger == triggerPreview || !p.Options.removalDelayed() {
+		return
+	}
+	now := time.Now()
+
+	pendingRemovals.Lock()
+	defer pendingRemovals.Unlock()
+	for _, m := range p.Members {
+		id := p.GuildID + ":" + m.Member.User.ID
+		previous := pendingRemovals.members[id]
+		current := make(map[string]pendingRemoval)
+		confirmed := m.Remove[:0]
+		for _, role := range m.Remove {
+			if role.ID == m.unverifiedRoleID {
+				confirmed = append(confirmed, role)
+				continue
+			}
+			pending, ok := previous[role.ID]
+			if !ok {
+				pending.since = now
+			}
+			pending.last = now
+			pending.count++
+			if pending.count >= p.Options.RemovalConfirmations && now.Sub(pending.since) >= p.Options.removalGracePeriod() {
+				confirmed = append(confirmed, role)
+				continue
+			}
+			current[role.ID] = pending
+		}
+		m.Remove = confirmed
+
+		// removals that were not planned again are not consecutive anymore
+		if len(current) == 0 {
+			delete(pendingRemovals.members, id)
+		} else {
+			pendingRemovals.members[id] = current
+		}
+	}
+}
+
+// startRemovalCycle forgets the pending removals of members that were not updated during the last full update,
+// so that only consecutive updates confirm a removal
+func startRemovalCycle() {
+	pendingRemovals.Lock()
+	defer pendingRemovals.Unlock()
+	for id, member := range pendingRemovals.members {
+		for roleID, pending := range member {
+			if pending.last.Before(pendingRemovals.cycle) {
+				delete(member, roleID)
+			}
+		}
+		if len(member) == 0 {
+			delete(pendingRemovals.members, id)
+		}
+	}
+	pendingRemovals.cycle = time.Now()
+}
+
+// validateRemovalDelay checks the confirmations and the grace period of role removals
+func validateRemovalDelay(options *guildOptions) (err error) {
+	if options.RemovalConfirmations < 0 || options.RemovalConfirmations > maxRemovalConfirmations {
+		return errors.New("the confirmations of role removals have to be between 0 and 10")
+	}
+	if options.RemovalGracePeriod < 0 || options.removalGracePeriod() > maxRemovalGracePeriod {
+		return errors.New("the grace period of role removals has to be between 0 and 168 hours")
+	}
+	return
+}
+
+// observeGw2Response counts a response of the gw2 api for the circuit breaker.
+// Server errors, rate limits and failed connections count as failures, invalid keys don't
+func observeGw2Response(code string) {
+	failed := code == "error" || code == "429" || strings.HasPrefix(code, "5")
+	now := time.Now()
+	minute := now.Truncate(time.Minute)
+
+	gw2Breaker.Lock()
+	defer gw2Breaker.Unlock()
+	bucket := &gw2Breaker.minutes[int(minute.Unix()/60)%len(gw2Breaker.minutes)]
+	if !bucket.minute.Equal(minute) {
+		*bucket = breakerMinute{minute: minute}
+	}
+	bucket.requests++
+	if !failed {
+		return
+	}
+	bucket.failures++
+
+	requests, failures := 0, 0
+	for _, b := range gw2Breaker.minutes {
+		if now.Sub(b.minute) < breakerWindow {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	if requests >= breakerMinRequests && float64(failures) >= breakerErrorRate*float64(requests) {
+		if !gw2Breaker.paused {
+			loglevels.Warningf("Pausing role removals, %v of %v gw2 api requests failed\n", failures, requests)
+			gw2Breaker.paused = true
+		}
+		gw2Breaker.pausedUntil = now.Add(breakerCooldown)
+	}
+}
+
+// removalsPaused returns whether the gw2 api fails too often to trust its results for removing roles
+func removalsPaused() bool {
+	gw2Breaker.Lock()
+	defer gw2Breaker.Unlock()
+	if time.Now().Before(gw2Breaker.pausedUntil) {
+		return true
+	}
+	if gw2Breaker.paused {
+		loglevels.Info("Resuming role removals")
+		gw2Breaker.paused = false
+	}
+	return false
+}
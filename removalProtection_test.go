@@ -0,0 +1,193 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// newRemovalPlan returns a plan that removes the world and the unverified role of a member
+func newRemovalPlan(t *testing.T, trigger string, options *guildOptions) (plan *guildPlan, m *memberPlan) {
+	plan, err := newGuildPlan("guild", "", options)
+	if err != nil {
+		t.Fatalf("creating plan: %v", err)
+	}
+	plan.Trigger = trigger
+	m = plan.member(&discordgo.Member{
+		GuildID: "guild",
+		User:    &discordgo.User{ID: "user"},
+		Roles:   []string{"world", "unverified"},
+	})
+	m.unverifiedRoleID = "unverified"
+	m.removeRole(guildRole{ID: "world", Name: "world"})
+	m.removeRole(guildRole{ID: "unverified", Name: "unverified"})
+	return
+}
+
+func resetPendingRemovals() {
+	pendingRemovals.Lock()
+	pendingRemovals.members = make(map[string]map[string]pendingRemoval)
+	pendingRemovals.cycle = time.Time{}
+	pendingRemovals.Unlock()
+}
+
+func TestConfirmRemovals(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger string
+		options guildOptions
+		// removed is whether the world role is removed by each of the updates in a row
+		removed []bool
+	}{
+		{"no delay", triggerScheduled, guildOptions{}, []bool{true}},
+		{"scheduled updates", triggerScheduled, guildOptions{RemovalConfirmations: 3}, []bool{false, false, true}},
+		{"member joins", triggerMemberJoin, guildOptions{RemovalConfirmations: 2}, []bool{false, true}},
+		{"verify command", triggerVerifyCommand, guildOptions{RemovalConfirmations: 2}, []bool{false, true}},
+		{"api request", triggerAPI, guildOptions{RemovalConfirmations: 2}, []bool{false, true}},
+		{"links changed", triggerLinksChanged, guildOptions{RemovalConfirmations: 2}, []bool{false, true}},
+		{"user request", triggerUserRequest, guildOptions{RemovalConfirmations: 2}, []bool{false, true}},
+		{"purge", triggerPurge, guildOptions{RemovalConfirmations: 3}, []bool{true}},
+		{"applied preview", triggerPreview, guildOptions{RemovalConfirmations: 3}, []bool{true}},
+		{"grace period", triggerScheduled, guildOptions{RemovalGracePeriod: 1}, []bool{false, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetPendingRemovals()
+			for i, expected := range test.removed {
+				options := test.options
+				plan, m := newRemovalPlan(t, test.trigger, &options)
+				plan.confirmRemovals()
+
+				removed := false
+				unverified := false
+				for _, role := range m.Remove {
+					removed = removed || role.ID == "world"
+					unverified = unverified || role.ID == "unverified"
+				}
+				if removed != expected {
+					t.Errorf("update %v: got world role removed %v, expected %v", i+1, removed, expected)
+				}
+				if !unverified {
+					t.Errorf("update %v: the removal of the unverified role got postponed", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestConfirmRemovalsGracePeriod(t *testing.T) {
+	resetPendingRemovals()
+	options := guildOptions{RemovalConfirmations: 2, RemovalGracePeriod: 1}
+
+	plan, m := newRemovalPlan(t, triggerScheduled, &options)
+	plan.confirmRemovals()
+	if len(m.Remove) != 1 {
+		t.Fatalf("got removals %v of the first update, expected only the unverified role", m.Remove)
+	}
+
+	// the second confirmation within the grace period does not remove the role yet
+	plan, m = newRemovalPlan(t, triggerScheduled, &options)
+	plan.confirmRemovals()
+	if len(m.Remove) != 1 {
+		t.Fatalf("got removals %v within the grace period, expected only the unverified role", m.Remove)
+	}
+
+	pendingRemovals.Lock()
+	pending := pendingRemovals.members["guild:user"]["world"]
+	pending.since = time.Now().Add(-2 * time.Hour)
+	pendingRemovals.members["guild:user"]["world"] = pending
+	pendingRemovals.Unlock()
+
+	plan, m = newRemovalPlan(t, triggerScheduled, &options)
+	plan.confirmRemovals()
+	if len(m.Remove) != 2 {
+		t.Errorf("got removals %v after the grace period, expected both roles", m.Remove)
+	}
+}
+
+func TestStartRemovalCycle(t *testing.T) {
+	resetPendingRemovals()
+	options := guildOptions{RemovalConfirmations: 2}
+
+	startRemovalCycle()
+	plan, _ := newRemovalPlan(t, triggerScheduled, &options)
+	plan.confirmRemovals()
+
+	// the member was not updated during the last full update, the confirmations start again
+	pendingRemovals.Lock()
+	pendingRemovals.cycle = time.Now().Add(time.Second)
+	pendingRemovals.Unlock()
+	startRemovalCycle()
+
+	plan, m := newRemovalPlan(t, triggerScheduled, &options)
+	plan.confirmRemovals()
+	if len(m.Remove) != 1 {
+		t.Errorf("got removals %v, expected the pending removal to be forgotten", m.Remove)
+	}
+}
+
+func resetGw2Breaker() {
+	gw2Breaker.Lock()
+	for i := range gw2Breaker.minutes {
+		gw2Breaker.minutes[i] = breakerMinute{}
+	}
+	gw2Breaker.pausedUntil = time.Time{}
+	gw2Breaker.paused = false
+	gw2Breaker.Unlock()
+}
+
+func TestGw2Breaker(t *testing.T) {
+	defer resetGw2Breaker()
+
+	type responses struct {
+		code  string
+		count int
+	}
+	tests := []struct {
+		name   string
+		codes  []responses
+		paused bool
+	}{
+		{"no requests", nil, false},
+		{"successful requests", []responses{{"200", 50}}, false},
+		{"too few requests", []responses{{"503", breakerMinRequests - 1}}, false},
+		{"failures below the rate", []responses{{"200", 16}, {"502", 4}}, false},
+		{"failures at the rate", []responses{{"200", 15}, {"502", 5}}, true},
+		{"rate limited", []responses{{"200", 10}, {"429", 10}}, true},
+		{"failed connections", []responses{{"200", 10}, {"error", 10}}, true},
+		{"invalid keys", []responses{{"200", 10}, {"401", 10}, {"400", 10}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetGw2Breaker()
+			for _, r := range test.codes {
+				for i := 0; i < r.count; i++ {
+					observeGw2Response(r.code)
+				}
+			}
+			if paused := removalsPaused(); paused != test.paused {
+				t.Errorf("got paused %v, expected %v", paused, test.paused)
+			}
+		})
+	}
+}
+
+func TestRemovalsPausedCooldown(t *testing.T) {
+	defer resetGw2Breaker()
+	resetGw2Breaker()
+
+	for i := 0; i < breakerMinRequests; i++ {
+		observeGw2Response("503")
+	}
+	if !removalsPaused() {
+		t.Fatal("expected removals to be paused")
+	}
+
+	gw2Breaker.Lock()
+	gw2Breaker.pausedUntil = time.Now().Add(-time.Second)
+	gw2Breaker.Unlock()
+	if removalsPaused() {
+		t.Error("expected removals to resume after the cooldown")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// unmetRequirement returns why the account does not meet the requirements of the discord server, it is empty if it does
+func (o *guildOptions) unmetRequirement(account worldWithRank) string {
+	switch {
+	case account.rank < o.MinimumRank:
+		return "wvw rank below minimum"
+	case o.MinimumAccountAge > 0 && (account.Created.IsZero() || time.Since(account.Created) < time.Duration(o.MinimumAccountAge)*24*time.Hour):
+		return "account younger than minimum age"
+	case account.MissingProgression && (o.MinimumDailyAP > 0 || o.MinimumMonthlyAP > 0 || o.MinimumFractalLevel > 0):
+		return "key is missing the progression permission"
+	case account.DailyAP < o.MinimumDailyAP:
+		return "daily ap below minimum"
+	case account.MonthlyAP < o.MinimumMonthlyAP:
+		return "monthly ap below minimum"
+	case account.FractalLevel < o.MinimumFractalLevel:
+		return "fractal level below minimum"
+	}
+	return ""
+}
+
+// validateRequirements checks the account requirements besides the wvw rank
+func validateRequirements(options *guildOptions) (err error) {
+	if options.MinimumAccountAge < 0 || options.MinimumDailyAP < 0 || options.MinimumMonthlyAP < 0 || options.MinimumFractalLevel < 0 {
+		return errors.New("the account requirements can not be negative")
+	}
+	return
+}
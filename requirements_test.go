@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnmetRequirement(t *testing.T) {
+	account := worldWithRank{
+		rank:         500,
+		Created:      time.Now().Add(-365 * 24 * time.Hour),
+		DailyAP:      5000,
+		MonthlyAP:    300,
+		FractalLevel: 100,
+	}
+	withoutProgression := account
+	withoutProgression.DailyAP, withoutProgression.MonthlyAP, withoutProgression.FractalLevel = 0, 0, 0
+	withoutProgression.MissingProgression = true
+	unknownAge := account
+	unknownAge.Created = time.Time{}
+
+	tests := []struct {
+		name     string
+		options  guildOptions
+		account  worldWithRank
+		expected string
+	}{
+		{"no requirements", guildOptions{}, account, ""},
+		{"all requirements met", guildOptions{MinimumRank: 500, MinimumAccountAge: 300, MinimumDailyAP: 5000, MinimumMonthlyAP: 300, MinimumFractalLevel: 100}, account, ""},
+		{"rank", guildOptions{MinimumRank: 501}, account, "wvw rank below minimum"},
+		{"account age", guildOptions{MinimumAccountAge: 400}, account, "account younger than minimum age"},
+		{"unknown account age", guildOptions{MinimumAccountAge: 1}, unknownAge, "account younger than minimum age"},
+		{"daily ap", guildOptions{MinimumDailyAP: 5001}, account, "daily ap below minimum"},
+		{"monthly ap", guildOptions{MinimumMonthlyAP: 301}, account, "monthly ap below minimum"},
+		{"fractal level", guildOptions{MinimumFractalLevel: 101}, account, "fractal level below minimum"},
+		{"daily ap without progression", guildOptions{MinimumDailyAP: 1}, withoutProgression, "key is missing the progression permission"},
+		{"monthly ap without progression", guildOptions{MinimumMonthlyAP: 1}, withoutProgression, "key is missing the progression permission"},
+		{"fractal level without progression", guildOptions{MinimumFractalLevel: 1}, withoutProgression, "key is missing the progression permission"},
+		{"rank without progression", guildOptions{MinimumRank: 100}, withoutProgression, ""},
+		{"rank before progression", guildOptions{MinimumRank: 501, MinimumDailyAP: 1}, withoutProgression, "wvw rank below minimum"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reason := test.options.unmetRequirement(test.account); reason != test.expected {
+				t.Errorf("got %q, expected %q", reason, test.expected)
+			}
+		})
+	}
+}
+
+func TestValidateRequirements(t *testing.T) {
+	tests := []struct {
+		name    string
+		options guildOptions
+		valid   bool
+	}{
+		{"no requirements", guildOptions{}, true},
+		{"positive requirements", guildOptions{MinimumAccountAge: 30, MinimumDailyAP: 1000, MinimumMonthlyAP: 100, MinimumFractalLevel: 50}, true},
+		{"negative account age", guildOptions{MinimumAccountAge: -1}, false},
+		{"negative daily ap", guildOptions{MinimumDailyAP: -1}, false},
+		{"negative monthly ap", guildOptions{MinimumMonthlyAP: -1}, false},
+		{"negative fractal level", guildOptions{MinimumFractalLevel: -1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateRequirements(&test.options); (err == nil) != test.valid {
+				t.Errorf("got error %v, expected valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// deletedUserKey is the placeholder key of users that deleted their data, it removes their roles on the next update
+	deletedUserKey = "A"
+
+	// maxRevokedKeyGracePeriod is the longest grace period discord servers can choose, invalid keys are deleted after it
+	maxRevokedKeyGracePeriod = 14 * 24 * time.Hour
+
+	// revokedKeyNotifyDelay is how long a key has to stay invalid before its user gets a direct message,
+	// so that a short outage of the gw2 api does not message everyone
+	revokedKeyNotifyDelay = time.Hour
+
+	// maxRevokedKeyMessages limits the direct messages about invalid keys per hour
+	maxRevokedKeyMessages = 60
+
+	// keyStateExpire is how long the state of an api key is remembered after its last check
+	keyStateExpire = 30 * 24 * time.Hour
+)
+
+// keyState is remembered for every checked api key
+type keyState struct {
+	// Account is the name of the gw2 account of the key when it was valid
+	Account string `json:"account"`
+	// RevokedSince is zero while the key is valid
+	RevokedSince time.Time `json:"revokedSince"`
+	// Notified is set once the user got a direct message about the invalid key
+	Notified bool `json:"notified"`
+}
+
+// revokedKeyMessages counts the direct messages about invalid keys of the current hour
+var revokedKeyMessages struct {
+	sync.Mutex
+	hour  time.Time
+	count int
+}
+
+func getKeyState(key string) (state keyState) {
+	value, err := database.GetCache("gw2KeyState" + hashKey(key))
+	if err != nil {
+		return
+	}
+	_ = json.Unmarshal([]byte(value), &state) // nolint: errcheck, gosec
+	return
+}
+
+func saveKeyState(key string, state keyState) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err = database.SetCache("gw2KeyState"+hashKey(key), string(value), keyStateExpire); err != nil {
+		loglevels.Warningf("Error saving the state of an api key: %v\n", err)
+	}
+}
+
+// keyValid remembers the account name of the key and forgets that it was invalid
+func keyValid(key, account string) {
+	saveKeyState(key, keyState{Account: account})
+}
+
+// keyRevoked remembers since when the key of the user is invalid. The user gets a direct message once the key stays invalid
+// and the key is deleted after the longest grace period
+func keyRevoked(userID, key string) {
+	if key == deletedUserKey {
+		_ = removeAPIKey(userID, key) // nolint: errcheck, gosec
+		return
+	}
+
+	state := getKeyState(key)
+	if state.RevokedSince.IsZero() {
+		state.RevokedSince = time.Now()
+	}
+	if time.Since(state.RevokedSince) > maxRevokedKeyGracePeriod {
+		loglevels.Infof("Deleting invalid key of %v", userID)
+		_ = removeAPIKey(userID, key) // nolint: errcheck, gosec
+	}
+	if !state.Notified && time.Since(state.RevokedSince) >= revokedKeyNotifyDelay {
+		state.Notified = notifyRevokedKey(userID, state.Account)
+	}
+	saveKeyState(key, state)
+}
+
+// keyRevokedSince returns since when the key is invalid. It is zero while the key is valid.
+// The placeholder key of deleted users is invalid since forever, so that their roles are removed right away
+func keyRevokedSince(key string) time.Time {
+	if key == deletedUserKey {
+		return time.Time{}
+	}
+	return getKeyState(key).RevokedSince
+}
+
+// notifyRevokedKey sends the user a direct message about the invalid key of the account.
+// It returns whether the user does not need another message
+func notifyRevokedKey(userID, account string) bool {
+	muted, err := database.NotificationsMuted(userID)
+	if err != nil {
+		return false
+	}
+	if muted {
+		return true
+	}
+	if !allowRevokedKeyMessage() {
+		return false
+	}
+
+	if account == "" {
+		account = "one of your Guild Wars 2 accounts"
+	}
+	return sendDirectMessage(userID, fmt.Sprintf(`The api key of %v stopped working, it was probably deleted or lost its permissions.
+Discord servers that use this bot will remove your roles soon.
+Create a new key with `+"`wvwbot`"+` in its name at https://account.guildwars2.com/applications and add it with `+"`/wvw addkey`"+` or on %v.
+Use `+"`/wvw notifications enabled: False`"+` to turn off these messages.`, account, config.HostURL))
+}
+
+// sendDirectMessage sends the message to the user and returns whether it does not have to be sent again.
+// It is a variable so that tests don't need a discord connection
+var sendDirectMessage = func(userID, message string) bool {
+	ch, err := dg.UserChannelCreate(userID)
+	if err != nil {
+		loglevels.Warningf("Failed to create dm channel with user %v: %v\n", userID, err)
+		return false
+	}
+	_, err = dg.ChannelMessageSend(ch.ID, message)
+	if err != nil {
+		// users can block direct messages, don't try again
+		loglevels.Warningf("Failed to send direct message to user %v: %v\n", userID, err)
+	}
+	return true
+}
+
+// allowRevokedKeyMessage counts a direct message about an invalid key, it is false if too many were sent this hour
+func allowRevokedKeyMessage() bool {
+	revokedKeyMessages.Lock()
+	defer revokedKeyMessages.Unlock()
+	if hour := time.Now().Truncate(time.Hour); !hour.Equal(revokedKeyMessages.hour) {
+		revokedKeyMessages.hour = hour
+		revokedKeyMessages.count = 0
+	}
+	if revokedKeyMessages.count >= maxRevokedKeyMessages {
+		return false
+	}
+	revokedKeyMessages.count++
+	return true
+}
+
+// gracePeriod returns how long roles are kept after an api key stopped working
+func (o *guildOptions) gracePeriod() time.Duration {
+	return time.Duration(o.RevokedKeyGracePeriod) * 24 * time.Hour
+}
+
+// validateGracePeriod checks the grace period of invalid keys
+func validateGracePeriod(options *guildOptions) (err error) {
+	if options.RevokedKeyGracePeriod < 0 || options.gracePeriod() > maxRevokedKeyGracePeriod {
+		return fmt.Errorf("the grace period of invalid api keys has to be between 0 and %v days", int(maxRevokedKeyGracePeriod.Hours()/24))
+	}
+	return
+}
+
+// commandNotifications turns the direct messages of the bot on or off for the user
+func commandNotifications(m *commandContext, enabled bool) {
+	err := database.SetNotificationsMuted(m.Author.ID, !enabled)
+	if err != nil {
+		loglevels.Errorf("Error saving notification setting of user %v: %v\n", m.Author.ID, err)
+		sendError(m)
+		return
+	}
+	sendSuccess(m)
+}
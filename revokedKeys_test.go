@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevokedKeyTimeline(t *testing.T) {
+	previousDatabase, previousSend := database, sendDirectMessage
+	defer func() {
+		database, sendDirectMessage = previousDatabase, previousSend
+	}()
+	var messages []string
+	sendDirectMessage = func(userID, message string) bool {
+		messages = append(messages, message)
+		return true
+	}
+
+	tests := []struct {
+		name  string
+		muted bool
+		// sent is the number of direct messages the user gets
+		sent int
+	}{
+		{"notifications enabled", false, 1},
+		{"notifications muted", true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			messages = nil
+			revokedKeyMessages.Lock()
+			revokedKeyMessages.count = 0
+			revokedKeyMessages.Unlock()
+			if err := database.AddAPIKey("user", "key"); err != nil {
+				t.Fatalf("adding api key: %v", err)
+			}
+			if err := database.SetNotificationsMuted("user", test.muted); err != nil {
+				t.Fatalf("muting notifications: %v", err)
+			}
+			keyValid("key", "Verified.1234")
+			if since := keyRevokedSince("key"); !since.IsZero() {
+				t.Fatalf("got a valid key revoked since %v", since)
+			}
+
+			// revokedSince moves the start of the invalid key into the past
+			revokedSince := func(ago time.Duration) {
+				state := getKeyState("key")
+				state.RevokedSince = time.Now().Add(-ago)
+				saveKeyState("key", state)
+			}
+			keys := func() int {
+				keys, err := database.GetAPIKeys("user")
+				if err != nil {
+					t.Fatalf("getting api keys: %v", err)
+				}
+				return len(keys)
+			}
+
+			keyRevoked("user", "key")
+			if since := keyRevokedSince("key"); since.IsZero() || time.Since(since) > time.Minute {
+				t.Errorf("got revoked since %v, expected now", since)
+			}
+			if len(messages) != 0 || keys() != 1 {
+				t.Errorf("a short outage sent %v messages and kept %v keys, expected none and the key", len(messages), keys())
+			}
+
+			revokedSince(revokedKeyNotifyDelay + time.Minute)
+			keyRevoked("user", "key")
+			keyRevoked("user", "key")
+			if len(messages) != test.sent || keys() != 1 {
+				t.Errorf("got %v messages and %v keys after the notify delay, expected %v and the key", len(messages), keys(), test.sent)
+			}
+			if !getKeyState("key").Notified {
+				t.Error("the key is not marked as notified")
+			}
+
+			// the roles are removed by the discord servers once their grace period is over, see TestPlanUserDataWithoutVerifiedAccount
+			revokedSince(maxRevokedKeyGracePeriod - time.Hour)
+			keyRevoked("user", "key")
+			if keys() != 1 {
+				t.Error("the key got deleted within the longest grace period")
+			}
+
+			revokedSince(maxRevokedKeyGracePeriod + time.Hour)
+			keyRevoked("user", "key")
+			if keys() != 0 {
+				t.Error("the key was kept after the longest grace period")
+			}
+			if len(messages) != test.sent {
+				t.Errorf("got %v messages in total, expected %v", len(messages), test.sent)
+			}
+		})
+	}
+}
+
+func TestDeletedUserKey(t *testing.T) {
+	previousDatabase := database
+	defer func() {
+		database = previousDatabase
+	}()
+	database = newMemoryStore()
+	if err := database.AddAPIKey("user", deletedUserKey); err != nil {
+		t.Fatalf("adding api key: %v", err)
+	}
+
+	if since := keyRevokedSince(deletedUserKey); !since.IsZero() {
+		t.Errorf("got the placeholder key revoked since %v, expected zero", since)
+	}
+	data := gw2AccountData{}
+	data.addRevoked(deletedUserKey)
+	if !data.Revoked || time.Since(data.RevokedSince) < maxRevokedKeyGracePeriod {
+		t.Errorf("got revoked %v since %v, expected the grace period to be over", data.Revoked, data.RevokedSince)
+	}
+
+	keyRevoked("user", deletedUserKey)
+	if keys, _ := database.GetAPIKeys("user"); len(keys) != 0 {
+		t.Errorf("got keys %v, expected the placeholder key to be removed", keys)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// default names of new roles, used if the discord server did not set its own
+	defaultVerifiedRoleName   = "WvW-Verified"
+	defaultLinkedRoleName     = "WvW-Linked"
+	defaultUnverifiedRoleName = "WvW-Unverified"
+	defaultWorldRoleName      = worldPlaceholder
+
+	// worldPlaceholder is replaced with the world or team name in role names
+	worldPlaceholder = "{world}"
+
+	// maxRoleNameLength is the longest role name discord allows
+	maxRoleNameLength = 100
+
+	// slots of the roles that are bound to a discord role id in the settings
+	roleSlotVerified   = "verified"
+	roleSlotLinked     = "linked"
+	roleSlotUnverified = "unverified"
+	roleSlotWorld      = "world:"
+	roleSlotGuildRank  = "guildRank:"
+)
+
+// roleBindingsMutex keeps concurrent updates from overwriting each others role bindings
+var roleBindingsMutex sync.Mutex
+
+// roleName fills in the world name, empty names fall back to fallback
+func roleName(template, fallback, world string) string {
+	if template == "" {
+		template = fallback
+	}
+	return strings.TrimSpace(strings.Replace(template, worldPlaceholder, world, -1))
+}
+
+func (o *guildOptions) verifiedRoleName(world string) string {
+	return roleName(o.VerifiedRoleName, defaultVerifiedRoleName, world)
+}
+
+func (o *guildOptions) linkedRoleName(world string) string {
+	return roleName(o.LinkedRoleName, defaultLinkedRoleName, world)
+}
+
+func (o *guildOptions) unverifiedRoleName() string {
+	return roleName(o.UnverifiedRoleName, defaultUnverifiedRoleName, "")
+}
+
+func (o *guildOptions) worldRoleName(world string) string {
+	return roleName(o.WorldRoleName, defaultWorldRoleName, world)
+}
+
+// verifyWorldName returns the name of the world or team the discord server verifies for, if it is known without the gw2 api
+func (o *guildOptions) verifyWorldName() string {
+	switch o.Mode {
+	case oneServer:
+		return getWorldName(o.Gw2ServerID)
+	case oneTeam:
+		return getWorldName(o.Gw2TeamID)
+	}
+	return ""
+}
+
+func worldRoleSlot(world int) string {
+	return roleSlotWorld + strconv.Itoa(world)
+}
+
+func guildRankRoleSlot(rank string) string {
+	return roleSlotGuildRank + rank
+}
+
+// roleID returns the discord role id bound to the slot
+func (o *guildOptions) roleID(slot string) string {
+	switch slot {
+	case roleSlotVerified:
+		return o.VerifiedRoleID
+	case roleSlotLinked:
+		return o.LinkedRoleID
+	case roleSlotUnverified:
+		return o.UnverifiedRoleID
+	}
+	if strings.HasPrefix(slot, roleSlotRank) {
+		minimumRank, err := strconv.Atoi(strings.TrimPrefix(slot, roleSlotRank))
+		for _, r := range o.RankRoles {
+			if err == nil && r.MinimumRank == minimumRank {
+				return r.RoleID
+			}
+		}
+		return ""
+	}
+	if strings.HasPrefix(slot, roleSlotAccess) {
+		for _, r := range o.AccessRoles {
+			if r.Access == strings.TrimPrefix(slot, roleSlotAccess) {
+				return r.RoleID
+			}
+		}
+		return ""
+	}
+	if strings.HasPrefix(slot, roleSlotGuildRank) {
+		return o.GuildRankRoleIDs[strings.TrimPrefix(slot, roleSlotGuildRank)]
+	}
+	world, err := strconv.Atoi(strings.TrimPrefix(slot, roleSlotWorld))
+	if err != nil {
+		return ""
+	}
+	return o.WorldRoleIDs[world]
+}
+
+// setRoleID binds the discord role id to the slot
+func (o *guildOptions) setRoleID(slot, roleID string) {
+	switch slot {
+	case roleSlotVerified:
+		o.VerifiedRoleID = roleID
+		return
+	case roleSlotLinked:
+		o.LinkedRoleID = roleID
+		return
+	case roleSlotUnverified:
+		o.UnverifiedRoleID = roleID
+		return
+	}
+	if strings.HasPrefix(slot, roleSlotRank) {
+		minimumRank, err := strconv.Atoi(strings.TrimPrefix(slot, roleSlotRank))
+		for i := range o.RankRoles {
+			if err == nil && o.RankRoles[i].MinimumRank == minimumRank {
+				o.RankRoles[i].RoleID = roleID
+			}
+		}
+		return
+	}
+	if strings.HasPrefix(slot, roleSlotAccess) {
+		for i := range o.AccessRoles {
+			if o.AccessRoles[i].Access == strings.TrimPrefix(slot, roleSlotAccess) {
+				o.AccessRoles[i].RoleID = roleID
+			}
+		}
+		return
+	}
+	if strings.HasPrefix(slot, roleSlotGuildRank) {
+		if o.GuildRankRoleIDs == nil {
+			o.GuildRankRoleIDs = make(map[string]string)
+		}
+		o.GuildRankRoleIDs[strings.TrimPrefix(slot, roleSlotGuildRank)] = roleID
+		return
+	}
+	world, err := strconv.Atoi(strings.TrimPrefix(slot, roleSlotWorld))
+	if err != nil {
+		return
+	}
+	if o.WorldRoleIDs == nil {
+		o.WorldRoleIDs = make(map[int]string)
+	}
+	o.WorldRoleIDs[world] = roleID
+}
+
+// findSlotRole returns the managed role bound to the slot.
+// If no existing role is bound, it finds or creates the role with the name and binds it when the plan is applied
+func findSlotRole(slot, name string, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (roleID string, managedRoles []guildRole) {
+	if roleID, managedRoles, ok := findBoundRole(slot, roles, guildRoles, plan); ok {
+		return roleID, managedRoles
+	}
+
+	roleID, managedRoles = findOrCreateManagedRole(name, roles, guildRoles, plan)
+	plan.guild.bindRole(slot, roleID)
+	return
+}
+
+// findGuildRankRole returns the managed role bound to the guild rank. Unlike findSlotRole, it never starts managing
+// an existing discord role by its name, because rank names like Officer are often used by unrelated roles
+func findGuildRankRole(rank string, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (roleID string, managedRoles []guildRole) {
+	slot := guildRankRoleSlot(rank)
+	if roleID, managedRoles, ok := findBoundRole(slot, roles, guildRoles, plan); ok {
+		return roleID, managedRoles
+	}
+
+	// only roles that are managed already are found by name
+	roleID, managedRoles = findOrCreateManagedRole(rank, roles, nil, plan)
+	plan.guild.bindRole(slot, roleID)
+	return
+}
+
+// findBoundRole returns the existing discord role bound to the slot and manages it if it is not managed yet
+func findBoundRole(slot string, roles []guildRole, guildRoles []*discordgo.Role, plan *memberPlan) (roleID string, managedRoles []guildRole, ok bool) {
+	id := plan.guild.Options.roleID(slot)
+	if id == "" {
+		return "", roles, false
+	}
+	for _, role := range guildRoles {
+		if role.ID != id {
+			continue
+		}
+		for _, managed := range roles {
+			if managed.ID == id {
+				return id, roles, true
+			}
+		}
+		roleStruct := guildRole{
+			ID:   role.ID,
+			Name: role.Name,
+		}
+		plan.manageRole(roleStruct)
+		return id, append(roles, roleStruct), true
+	}
+	return "", roles, false
+}
+
+// bindRole remembers to bind the role to the slot when the plan is applied
+func (p *guildPlan) bindRole(slot, roleID string) {
+	if p.RoleBindings == nil {
+		p.RoleBindings = make(map[string]string)
+	}
+	p.RoleBindings[slot] = roleID
+}
+
+// saveRoleBindings saves the role bindings of the plan into the settings of the discord server.
+// created maps the placeholder ids of created roles to their discord role ids
+func saveRoleBindings(plan *guildPlan, created map[string]string) (err error) {
+	roleBindingsMutex.Lock()
+	defer roleBindingsMutex.Unlock()
+
+	options, err := getGuildSettings(plan.GuildID)
+	if err != nil {
+		return
+	}
+	changed := false
+	for slot, roleID := range plan.RoleBindings {
+		if id, ok := created[roleID]; ok {
+			roleID = id
+		} else if strings.HasPrefix(roleID, plannedRolePrefix) {
+			// the role failed to be created
+			continue
+		}
+		if options.roleID(slot) != roleID {
+			options.setRoleID(slot, roleID)
+			plan.Options.setRoleID(slot, roleID)
+			changed = true
+		}
+	}
+	if changed {
+		err = saveGuildSettings(plan.GuildID, options)
+	}
+	return
+}
+
+// keepRoleBindings copies the world and guild rank role bindings from the saved settings, they are not part of the dashboard
+func keepRoleBindings(guildID string, options *guildOptions) {
+	if options.WorldRoleIDs != nil && options.GuildRankRoleIDs != nil {
+		return
+	}
+	saved, err := getGuildSettings(guildID)
+	if err != nil {
+		return
+	}
+	if options.WorldRoleIDs == nil {
+		options.WorldRoleIDs = saved.WorldRoleIDs
+	}
+	if options.GuildRankRoleIDs == nil {
+		options.GuildRankRoleIDs = saved.GuildRankRoleIDs
+	}
+}
+
+// validateRoleSettings checks that the chosen roles can be managed by the bot
+func validateRoleSettings(guildID string, options *guildOptions) (err error) {
+	for _, name := range []string{options.VerifiedRoleName, options.LinkedRoleName, options.WorldRoleName, options.UnverifiedRoleName} {
+		if len(name) > maxRoleNameLength {
+			return errors.New("role names can not be longer than 100 characters")
+		}
+	}
+	if options.VerifiedRoleID != "" && options.VerifiedRoleID == options.LinkedRoleID {
+		return errors.New("the verified and the linked role have to be different roles")
+	}
+	if options.UnverifiedRoleID != "" && (options.UnverifiedRoleID == options.VerifiedRoleID || options.UnverifiedRoleID == options.LinkedRoleID) {
+		return errors.New("the unverified role has to be different from the verified and the linked role")
+	}
+	for _, roleID := range []string{options.VerifiedRoleID, options.LinkedRoleID, options.UnverifiedRoleID} {
+		if roleID == "" {
+			continue
+		}
+		role, erro := dg.State.Role(guildID, roleID)
+		if erro != nil || !assignableRole(guildID, role) {
+			return errors.New("the chosen roles have to be roles of this discord server that the bot can assign")
+		}
+	}
+	return
+}
+
+// assignableRole reports whether the role can be given to members by the bot
+func assignableRole(guildID string, role *discordgo.Role) bool {
+	// the id of @everyone is the id of the discord server
+	return role.ID != guildID && !role.Managed
+}
+
+// getRoleChoices lists the roles of the discord server that can be chosen as verified or linked role
+func getRoleChoices(guildID, activeID string) (st []serversTemplate) {
+	guild, err := dg.State.Guild(guildID)
+	if err != nil {
+		return
+	}
+	for _, role := range guild.Roles {
+		if !assignableRole(guildID, role) {
+			continue
+		}
+		st = append(st, serversTemplate{
+			ID:     role.ID,
+			Name:   role.Name,
+			Active: role.ID == activeID,
+		})
+	}
+	return
+}
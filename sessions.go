@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// sessionExpiration is how long a dashboard session lasts without being used
+	sessionExpiration = time.Hour
+
+	// sessionCookie holds the token of the dashboard session
+	sessionCookie = "session"
+
+	// sessionPrefix separates dashboard sessions from other sessions
+	sessionPrefix = "dashboardSession:"
+
+	// userSessionsPrefix separates the lists of sessions of a user from other sessions
+	userSessionsPrefix = "userSessions:"
+)
+
+// errInvalidSession is returned for missing, expired or revoked sessions
+var errInvalidSession = errors.New("invalid or expired session")
+
+// dashboardSession is a login to the dashboard
+type dashboardSession struct {
+	UserID string `json:"userId"`
+	// CSRFToken has to be sent with every form of the dashboard
+	CSRFToken string `json:"csrfToken"`
+
+	token string
+}
+
+// secureCookies reports whether cookies are only sent over https
+func secureCookies() bool {
+	return strings.HasPrefix(config.HostURL, "https://")
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		// lax, because the cookie is set on the redirect back from discord
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// newSession logs the user in to the dashboard and sets the session cookie
+func newSession(w http.ResponseWriter, user string) (err error) {
+	session := dashboardSession{UserID: user}
+	session.token, err = randomToken()
+	if err != nil {
+		return
+	}
+	session.CSRFToken, err = randomToken()
+	if err != nil {
+		return
+	}
+
+	err = saveSession(session)
+	if err != nil {
+		return
+	}
+
+	// remember the session to be able to revoke it
+	tokens, err := getUserSessions(user)
+	if err != nil {
+		return
+	}
+	err = saveUserSessions(user, append(tokens, session.token))
+	if err != nil {
+		return
+	}
+
+	setSessionCookie(w, session.token, int(sessionExpiration.Seconds()))
+	return
+}
+
+func saveSession(session dashboardSession) (err error) {
+	sessionBytes, err := json.Marshal(session)
+	if err != nil {
+		loglevels.Errorf("Error stringifying session: %v\n", err)
+		return
+	}
+	err = database.SetSession(sessionPrefix+session.token, string(sessionBytes), sessionExpiration)
+	if err != nil {
+		loglevels.Errorf("Error setting session for user %v: %v\n", session.UserID, err)
+	}
+	return
+}
+
+// getSession returns the session of the cookie and extends it
+func getSession(w http.ResponseWriter, r *http.Request) (session dashboardSession, err error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		err = errInvalidSession
+		return
+	}
+
+	sessionString, err := database.GetSession(sessionPrefix + cookie.Value)
+	if err != nil {
+		if err != errNotFound {
+			loglevels.Errorf("Error getting session: %v\n", err)
+		}
+		err = errInvalidSession
+		return
+	}
+	err = json.Unmarshal([]byte(sessionString), &session)
+	if err != nil {
+		loglevels.Errorf("Error deserializing session: %v\n", err)
+		return
+	}
+	session.token = cookie.Value
+
+	// sliding expiry, the discord token of the user is needed as long as the session
+	if erro := saveSession(session); erro != nil {
+		return session, nil
+	}
+	if token, erro := database.GetSession(session.UserID); erro == nil {
+		_ = database.SetSession(session.UserID, token, sessionExpiration) // nolint: errcheck, gosec
+	}
+	if tokens, erro := getUserSessions(session.UserID); erro == nil {
+		_ = saveUserSessions(session.UserID, tokens) // nolint: errcheck, gosec
+	}
+	setSessionCookie(w, session.token, int(sessionExpiration.Seconds()))
+	return
+}
+
+// checkCSRF reports whether the form was sent from a page of the session.
+// Scripts send the token in the X-CSRF-Token header instead
+func (s dashboardSession) checkCSRF(r *http.Request) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
+
+// endSession logs out of the dashboard
+func endSession(w http.ResponseWriter, session dashboardSession) (err error) {
+	setSessionCookie(w, "", -1)
+	err = database.DeleteSession(sessionPrefix + session.token)
+	if err != nil {
+		loglevels.Errorf("Error deleting session of user %v: %v\n", session.UserID, err)
+	}
+	return
+}
+
+// revokeSessions logs the user out of the dashboard everywhere and forgets the discord token
+func revokeSessions(user string) (err error) {
+	tokens, err := getUserSessions(user)
+	if err != nil {
+		return
+	}
+	keys := []string{userSessionsPrefix + user, user}
+	for _, token := range tokens {
+		keys = append(keys, sessionPrefix+token)
+	}
+	for _, key := range keys {
+		if erro := database.DeleteSession(key); erro != nil {
+			loglevels.Errorf("Error revoking sessions of user %v: %v\n", user, erro)
+			err = erro
+		}
+	}
+	return
+}
+
+// getUserSessions returns the tokens of all sessions of the user that may not be expired yet
+func getUserSessions(user string) (tokens []string, err error) {
+	tokensString, err := database.GetSession(userSessionsPrefix + user)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		loglevels.Errorf("Error getting sessions of user %v: %v\n", user, err)
+		return
+	}
+	err = json.Unmarshal([]byte(tokensString), &tokens)
+	if err != nil {
+		loglevels.Errorf("Error deserializing sessions of user %v: %v\n", user, err)
+		return
+	}
+
+	// drop expired sessions
+	valid := tokens[:0]
+	for _, token := range tokens {
+		if _, erro := database.GetSession(sessionPrefix + token); erro == nil {
+			valid = append(valid, token)
+		}
+	}
+	return valid, nil
+}
+
+func saveUserSessions(user string, tokens []string) (err error) {
+	tokensBytes, err := json.Marshal(tokens)
+	if err != nil {
+		return
+	}
+	// the list lives as long as the newest session
+	err = database.SetSession(userSessionsPrefix+user, string(tokensBytes), sessionExpiration)
+	if err != nil {
+		loglevels.Errorf("Error saving sessions of user %v: %v\n", user, err)
+	}
+	return
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loginRequest returns a dashboard request with the session cookie of the response
+func loginRequest(method, target string, body url.Values, login *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range login.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// sessionCookieOf returns the session cookie the response sets, it is nil if there is none
+func sessionCookieOf(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestNewSessionCookie(t *testing.T) {
+	previousDatabase, previousHost := database, config.HostURL
+	defer func() { database, config.HostURL = previousDatabase, previousHost }()
+	database = newMemoryStore()
+
+	for _, host := range []string{"https://wvw.test", "http://localhost"} {
+		t.Run(host, func(t *testing.T) {
+			config.HostURL = host
+			w := httptest.NewRecorder()
+			if err := newSession(w, "user"); err != nil {
+				t.Fatalf("creating session: %v", err)
+			}
+
+			cookie := sessionCookieOf(w)
+			if cookie == nil {
+				t.Fatal("expected a session cookie")
+			}
+			if cookie.Value == "" || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" {
+				t.Errorf("got cookie %+v, expected an http only lax cookie for every path", cookie)
+			}
+			if cookie.MaxAge != int(sessionExpiration.Seconds()) {
+				t.Errorf("got max age %v, expected %v", cookie.MaxAge, sessionExpiration.Seconds())
+			}
+			if secure := strings.HasPrefix(host, "https://"); cookie.Secure != secure {
+				t.Errorf("got secure %v, expected %v", cookie.Secure, secure)
+			}
+
+			session, err := getSession(httptest.NewRecorder(), loginRequest(http.MethodGet, "/dashboard", nil, w))
+			if err != nil {
+				t.Fatalf("getting session: %v", err)
+			}
+			if session.UserID != "user" || session.CSRFToken == "" {
+				t.Errorf("got session %+v, expected the user with a csrf token", session)
+			}
+		})
+	}
+}
+
+func TestSessionSlidingExpiry(t *testing.T) {
+	previousDatabase := database
+	defer func() { database = previousDatabase }()
+	store := newMemoryStore()
+	database = store
+
+	login := httptest.NewRecorder()
+	if err := newSession(login, "user"); err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	key := sessionPrefix + sessionCookieOf(login).Value
+
+	// the session is about to expire
+	store.mutex.Lock()
+	value := store.sessions[key]
+	value.expires = time.Now().Add(time.Minute)
+	store.sessions[key] = value
+	store.mutex.Unlock()
+
+	w := httptest.NewRecorder()
+	if _, err := getSession(w, loginRequest(http.MethodGet, "/dashboard", nil, login)); err != nil {
+		t.Fatalf("getting session: %v", err)
+	}
+	store.mutex.Lock()
+	expires := store.sessions[key].expires
+	store.mutex.Unlock()
+	if expires.Before(time.Now().Add(sessionExpiration - time.Minute)) {
+		t.Errorf("got expiry %v, expected the session to be extended", expires)
+	}
+	if cookie := sessionCookieOf(w); cookie == nil || cookie.MaxAge != int(sessionExpiration.Seconds()) {
+		t.Errorf("got cookie %+v, expected the cookie to be extended", cookie)
+	}
+
+	// an expired session is gone
+	store.mutex.Lock()
+	value = store.sessions[key]
+	value.expires = time.Now().Add(-time.Second)
+	store.sessions[key] = value
+	store.mutex.Unlock()
+	if _, err := getSession(httptest.NewRecorder(), loginRequest(http.MethodGet, "/dashboard", nil, login)); err != errInvalidSession {
+		t.Errorf("got %v for an expired session, expected %v", err, errInvalidSession)
+	}
+}
+
+func TestCheckFormSession(t *testing.T) {
+	previousDatabase := database
+	defer func() { database = previousDatabase }()
+	database = newMemoryStore()
+
+	login := httptest.NewRecorder()
+	if err := newSession(login, "user"); err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	session, err := getSession(httptest.NewRecorder(), loginRequest(http.MethodGet, "/dashboard", nil, login))
+	if err != nil {
+		t.Fatalf("getting session: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		form   url.Values
+		header string
+		login  bool
+		ok     bool
+		status int
+	}{
+		{"form token", http.MethodPost, url.Values{"csrf": {session.CSRFToken}}, "", true, true, http.StatusOK},
+		{"header token", http.MethodPost, nil, session.CSRFToken, true, true, http.StatusOK},
+		{"missing token", http.MethodPost, nil, "", true, false, http.StatusForbidden},
+		{"wrong token", http.MethodPost, url.Values{"csrf": {"forged"}}, "", true, false, http.StatusForbidden},
+		{"wrong header token", http.MethodPost, url.Values{"csrf": {session.CSRFToken}}, "forged", true, false, http.StatusForbidden},
+		{"get request", http.MethodGet, url.Values{"csrf": {session.CSRFToken}}, "", true, false, http.StatusMethodNotAllowed},
+		{"no session", http.MethodPost, url.Values{"csrf": {session.CSRFToken}}, "", false, false, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookies := login
+			if !test.login {
+				cookies = httptest.NewRecorder()
+			}
+			r := loginRequest(test.method, "/submit", test.form, cookies)
+			if test.header != "" {
+				r.Header.Set("X-CSRF-Token", test.header)
+			}
+			w := httptest.NewRecorder()
+
+			checked, ok := checkFormSession(w, r)
+			if ok != test.ok {
+				t.Fatalf("got ok %v, expected %v", ok, test.ok)
+			}
+			if w.Code != test.status {
+				t.Errorf("got status %v, expected %v", w.Code, test.status)
+			}
+			if ok && checked.UserID != "user" {
+				t.Errorf("got user %v, expected user", checked.UserID)
+			}
+		})
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	previousDatabase := database
+	defer func() { database = previousDatabase }()
+	database = newMemoryStore()
+
+	var logins []*httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		login := httptest.NewRecorder()
+		if err := newSession(login, "user"); err != nil {
+			t.Fatalf("creating session: %v", err)
+		}
+		logins = append(logins, login)
+	}
+
+	if err := revokeSessions("user"); err != nil {
+		t.Fatalf("revoking sessions: %v", err)
+	}
+	for i, login := range logins {
+		if _, err := getSession(httptest.NewRecorder(), loginRequest(http.MethodGet, "/dashboard", nil, login)); err != errInvalidSession {
+			t.Errorf("session %v: got %v, expected %v", i+1, err, errInvalidSession)
+		}
+	}
+}
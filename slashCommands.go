@@ -0,0 +1,285 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+// commandContext holds who used a command where and how to answer.
+// Commands use it independent of being a slash command or a direct message
+type commandContext struct {
+	GuildID   string
+	ChannelID string
+	Author    *discordgo.User
+	// Member is nil outside of discord servers
+	Member *discordgo.Member
+
+	reply func(content string) error
+}
+
+// slashCommands are registered on startup, remember to add new commands to the help doc
+var slashCommands = []*discordgo.ApplicationCommand{{
+	Name:        "wvw",
+	Description: "Verify your gw2 world on discord servers",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "help",
+			Description: "Shows all commands",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "addkey",
+			Description: "Adds a gw2 api key, nobody else can see it",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "key",
+				Description: "The gw2 api key",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "verify",
+			Description: "Re-verifies you or another user",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "The user to verify, requires Manage Roles",
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "check",
+			Description: "Shows the worlds, account names, wvw ranks and rank role of a user, requires Manage Roles",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "The user to check",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "purge",
+			Description: "Removes roles from players that were manually verified, requires Manage Roles",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "linked",
+				Description: "Only purge the linked servers role",
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "preview",
+			Description: "Shows the role changes of verifying everyone without applying them, requires Manage Roles",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "purge",
+					Description: "Include the roles a purge would remove",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "linked",
+					Description: "Only purge the linked servers role",
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "apply",
+			Description: "Applies exactly the changes of a preview, requires Manage Roles",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "plan",
+				Description: "The id of the plan shown by the preview",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "audit",
+			Description: "Shows the latest role and nickname changes of the bot, requires Manage Roles",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "user",
+				Description: "Only show the changes of this user",
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "allow",
+			Description: "Allows a server as additional linked server for 24h, requires Manage Roles",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "server",
+				Description: "The name of the server",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "links",
+			Description: "Shows the matchups and links of today or of a past date",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "date",
+				Description: "The date as YYYY-MM-DD",
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "notifications",
+			Description: "Turns the direct messages about api keys that stopped working on or off",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "enabled",
+				Description: "Whether the bot sends you direct messages",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "deletealldata",
+			Description: "Deletes all data associated with your discord account",
+		},
+	},
+}}
+
+// registerSlashCommands overwrites the global commands of the bot with slashCommands
+func registerSlashCommands() {
+	_, err := dg.ApplicationCommandBulkOverwrite(dg.State.User.ID, "", slashCommands)
+	if err != nil {
+		loglevels.Errorf("Error registering slash commands: %v\n", err)
+	}
+}
+
+// interactionCreate answers slash commands and the add key button and modal of verification messages
+func interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		slashCommand(s, i)
+	case discordgo.InteractionMessageComponent:
+		if i.MessageComponentData().CustomID != addKeyButtonID {
+			return
+		}
+		if err := s.InteractionRespond(i.Interaction, addKeyModal); err != nil {
+			loglevels.Errorf("Error responding to interaction %v: %v\n", i.ID, err)
+		}
+	case discordgo.InteractionModalSubmit:
+		data := i.ModalSubmitData()
+		if data.CustomID != addKeyModalID {
+			return
+		}
+		m, err := deferInteraction(s, i)
+		if err != nil {
+			return
+		}
+		addKey(m, modalValue(data, addKeyInputID))
+	}
+}
+
+// deferInteraction defers the answer, because most commands take longer than discord waits.
+// Every reply is only visible to the user of the interaction
+func deferInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) (m *commandContext, err error) {
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		loglevels.Errorf("Error responding to interaction %v: %v\n", i.ID, err)
+		return
+	}
+
+	m = &commandContext{
+		GuildID:   i.GuildID,
+		ChannelID: i.ChannelID,
+		Author:    i.User,
+		Member:    i.Member,
+		reply: func(content string) (erro error) {
+			_, erro = s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			})
+			return
+		},
+	}
+	if i.Member != nil {
+		m.Author = i.Member.User
+		m.Member.GuildID = i.GuildID
+	}
+	return
+}
+
+// slashCommand answers the wvw slash command
+func slashCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	if data.Name != "wvw" || len(data.Options) == 0 {
+		return
+	}
+
+	m, err := deferInteraction(s, i)
+	if err != nil {
+		return
+	}
+
+	command := data.Options[0]
+	options := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(command.Options))
+	for _, option := range command.Options {
+		options[option.Name] = option
+	}
+
+	// remember to add new functions to the help doc
+	switch command.Name {
+	case "help":
+		printHelp(m)
+	case "addkey":
+		addKey(m, options["key"].StringValue())
+	case "verify":
+		userID := ""
+		if user, ok := options["user"]; ok {
+			userID = user.UserValue(nil).ID
+		}
+		commandVerifyUser(m, userID)
+	case "check":
+		printUserWorlds(m, options["user"].UserValue(nil).ID)
+	case "purge":
+		relink := ""
+		if linked, ok := options["linked"]; ok && linked.BoolValue() {
+			relink = "linked"
+		}
+		purgeGuild(m, relink)
+	case "preview":
+		purge, linked := false, false
+		if option, ok := options["purge"]; ok {
+			purge = option.BoolValue()
+		}
+		if option, ok := options["linked"]; ok {
+			linked = option.BoolValue()
+		}
+		commandPreview(m, purge, linked)
+	case "apply":
+		commandApply(m, options["plan"].StringValue())
+	case "audit":
+		userID := ""
+		if user, ok := options["user"]; ok {
+			userID = user.UserValue(nil).ID
+		}
+		commandAudit(m, userID)
+	case "allow":
+		commandAddServer(m, options["server"].StringValue())
+	case "links":
+		date := ""
+		if option, ok := options["date"]; ok {
+			date = option.StringValue()
+		}
+		commandLinks(m, date)
+	case "notifications":
+		commandNotifications(m, options["enabled"].BoolValue())
+	case "deletealldata":
+		commandDeleteAllData(m)
+	}
+}
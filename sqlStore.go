@@ -0,0 +1,468 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// database drivers selectable with config.Storage
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlMigrations holds the schema of the sql storage.
+// Every entry is one schema version, only append new versions to not break existing databases.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE api_keys (
+			user_id TEXT NOT NULL,
+			api_key TEXT NOT NULL,
+			PRIMARY KEY (user_id, api_key)
+		)`,
+		`CREATE TABLE guilds (
+			guild_id TEXT NOT NULL PRIMARY KEY,
+			settings TEXT NOT NULL
+		)`,
+		`CREATE TABLE guild_roles (
+			guild_id TEXT NOT NULL,
+			role_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY (guild_id, role_id)
+		)`,
+		`CREATE TABLE account_owners (
+			account_id TEXT NOT NULL PRIMARY KEY,
+			user_id TEXT NOT NULL
+		)`,
+		`CREATE TABLE additional_worlds (
+			guild_id TEXT NOT NULL,
+			world INTEGER NOT NULL,
+			expires BIGINT NOT NULL,
+			PRIMARY KEY (guild_id, world)
+		)`,
+		`CREATE TABLE sessions (
+			session_key TEXT NOT NULL PRIMARY KEY,
+			value TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE TABLE cache (
+			cache_key TEXT NOT NULL PRIMARY KEY,
+			value TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE audit_log (
+			guild_id TEXT NOT NULL,
+			at BIGINT NOT NULL,
+			entry TEXT NOT NULL
+		)`,
+		`CREATE INDEX audit_log_guild_at ON audit_log (guild_id, at)`,
+	},
+	{
+		`CREATE TABLE muted_users (
+			user_id TEXT NOT NULL PRIMARY KEY
+		)`,
+	},
+	{
+		`CREATE TABLE world_links (
+			world INTEGER NOT NULL PRIMARY KEY,
+			linked TEXT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE world_snapshots (
+			start BIGINT NOT NULL PRIMARY KEY,
+			snapshot TEXT NOT NULL
+		)`,
+	},
+	{
+		// managed roles are identified by id and name like in the redis storage
+		`CREATE TABLE managed_roles (
+			guild_id TEXT NOT NULL,
+			role_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY (guild_id, role_id, name)
+		)`,
+		`INSERT INTO managed_roles (guild_id, role_id, name) SELECT guild_id, role_id, name FROM guild_roles`,
+		`DROP TABLE guild_roles`,
+	},
+}
+
+// sqlStore implements Store on top of a sqlite or postgres database
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+
+	sweepMutex sync.Mutex
+	// lastSweep holds the time expired rows were last deleted
+	lastSweep time.Time
+}
+
+// newSQLStore connects to the database and migrates the schema to the latest version.
+// driver is either "sqlite3" or "postgres"
+func newSQLStore(driver, connectionString string) (s *sqlStore, err error) {
+	db, err := sql.Open(driver, connectionString)
+	if err != nil {
+		return
+	}
+	if driver == "sqlite3" {
+		// sqlite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	s = &sqlStore{
+		db:        db,
+		driver:    driver,
+		lastSweep: time.Now(),
+	}
+	err = s.migrate()
+	if err != nil {
+		_ = db.Close() // nolint: errcheck, gosec
+		s = nil
+	}
+	return
+}
+
+// migrate applies every schema version that is not applied yet
+func (s *sqlStore) migrate() (err error) {
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return
+	}
+
+	var version int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return
+	}
+
+	for version < len(sqlMigrations) {
+		var tx *sql.Tx
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		for _, statement := range sqlMigrations[version] {
+			if _, err = tx.Exec(statement); err != nil {
+				_ = tx.Rollback() // nolint: errcheck, gosec
+				return
+			}
+		}
+		version++
+		if _, err = tx.Exec(s.rebind(`INSERT INTO schema_version (version) VALUES (?)`), version); err != nil {
+			_ = tx.Rollback() // nolint: errcheck, gosec
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rebind replaces the ? placeholders with numbered ones for postgres
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (err error) {
+	_, err = s.db.Exec(s.rebind(query), args...)
+	return
+}
+
+// queryStrings returns the first column of every row. All rows are read before returning
+func (s *sqlStore) queryStrings(query string, args ...interface{}) (values []string, err error) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if erro := rows.Close(); erro != nil && err == nil {
+			err = erro
+		}
+	}()
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return
+		}
+		values = append(values, value)
+	}
+	err = rows.Err()
+	return
+}
+
+// queryValue returns a single string and translates no rows to errNotFound
+func (s *sqlStore) queryValue(query string, args ...interface{}) (value string, err error) {
+	err = s.db.QueryRow(s.rebind(query), args...).Scan(&value)
+	if err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// iterate reads all values before calling processValue so processValue can use the store
+func (s *sqlStore) iterate(query string, processValue func(string)) (count int, err error) {
+	values, err := s.queryStrings(query)
+	if err != nil {
+		return
+	}
+	for _, value := range values {
+		processValue(value)
+	}
+	return len(values), nil
+}
+
+// setExpiring upserts a value into sessions or cache and deletes expired rows once in a while
+func (s *sqlStore) setExpiring(table, keyColumn, key, value string, expire time.Duration) (err error) {
+	now := time.Now()
+	err = s.exec(`INSERT INTO `+table+` (`+keyColumn+`, value, expires) VALUES (?, ?, ?)
+		ON CONFLICT (`+keyColumn+`) DO UPDATE SET value = excluded.value, expires = excluded.expires`,
+		key, value, now.Add(expire).Unix())
+	if err != nil {
+		return
+	}
+
+	s.sweepMutex.Lock()
+	sweep := now.Sub(s.lastSweep) >= sweepInterval
+	if sweep {
+		s.lastSweep = now
+	}
+	s.sweepMutex.Unlock()
+	if !sweep {
+		return
+	}
+	for _, t := range []string{"sessions", "cache", "additional_worlds"} {
+		if err = s.exec(`DELETE FROM `+t+` WHERE expires <= ?`, now.Unix()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *sqlStore) GetAPIKeys(userID string) ([]string, error) {
+	return s.queryStrings(`SELECT api_key FROM api_keys WHERE user_id = ?`, userID)
+}
+
+func (s *sqlStore) AddAPIKey(userID, key string) error {
+	return s.exec(`INSERT INTO api_keys (user_id, api_key) VALUES (?, ?) ON CONFLICT DO NOTHING`, userID, key)
+}
+
+func (s *sqlStore) RemoveAPIKey(userID, key string) error {
+	return s.exec(`DELETE FROM api_keys WHERE user_id = ? AND api_key = ?`, userID, key)
+}
+
+func (s *sqlStore) DeleteUser(userID string) error {
+	return s.exec(`DELETE FROM api_keys WHERE user_id = ?`, userID)
+}
+
+func (s *sqlStore) IterateUsers(processValue func(string)) (int, error) {
+	return s.iterate(`SELECT DISTINCT user_id FROM api_keys`, processValue)
+}
+
+func (s *sqlStore) GuildExists(guildID string) (exists bool, err error) {
+	_, err = s.queryValue(`SELECT guild_id FROM guilds WHERE guild_id = ?`, guildID)
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) GetGuildSettings(guildID string) (options *guildOptions, err error) {
+	settingsString, err := s.queryValue(`SELECT settings FROM guilds WHERE guild_id = ?`, guildID)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(settingsString), &options)
+	return
+}
+
+func (s *sqlStore) SaveGuildSettings(guildID string, options *guildOptions) (err error) {
+	settingsString, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+	return s.exec(`INSERT INTO guilds (guild_id, settings) VALUES (?, ?)
+		ON CONFLICT (guild_id) DO UPDATE SET settings = excluded.settings`, guildID, string(settingsString))
+}
+
+func (s *sqlStore) IterateGuilds(processValue func(string)) (int, error) {
+	return s.iterate(`SELECT guild_id FROM guilds`, processValue)
+}
+
+func (s *sqlStore) GetManagedRoles(guildID string) (roles []guildRole, err error) {
+	rows, err := s.db.Query(s.rebind(`SELECT role_id, name FROM managed_roles WHERE guild_id = ?`), guildID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if erro := rows.Close(); erro != nil && err == nil {
+			err = erro
+		}
+	}()
+	for rows.Next() {
+		var role guildRole
+		if err = rows.Scan(&role.ID, &role.Name); err != nil {
+			return
+		}
+		roles = append(roles, role)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqlStore) AddManagedRole(guildID string, role guildRole) error {
+	return s.exec(`INSERT INTO managed_roles (guild_id, role_id, name) VALUES (?, ?, ?)
+		ON CONFLICT (guild_id, role_id, name) DO NOTHING`, guildID, role.ID, role.Name)
+}
+
+func (s *sqlStore) RemoveManagedRole(guildID string, role guildRole) error {
+	return s.exec(`DELETE FROM managed_roles WHERE guild_id = ? AND role_id = ? AND name = ?`, guildID, role.ID, role.Name)
+}
+
+func (s *sqlStore) GetAccountOwner(accountID string) (string, error) {
+	return s.queryValue(`SELECT user_id FROM account_owners WHERE account_id = ?`, accountID)
+}
+
+func (s *sqlStore) SetAccountOwner(accountID, userID string) error {
+	return s.exec(`INSERT INTO account_owners (account_id, user_id) VALUES (?, ?)
+		ON CONFLICT (account_id) DO UPDATE SET user_id = excluded.user_id`, accountID, userID)
+}
+
+func (s *sqlStore) GetAdditionalWorlds(guildID string) (worlds []int, err error) {
+	values, err := s.queryStrings(`SELECT world FROM additional_worlds WHERE guild_id = ? AND expires > ?`, guildID, time.Now().Unix())
+	if err != nil {
+		return
+	}
+	for _, value := range values {
+		var world int
+		if world, err = strconv.Atoi(value); err != nil {
+			return
+		}
+		worlds = append(worlds, world)
+	}
+	return
+}
+
+func (s *sqlStore) AddAdditionalWorld(guildID string, world int, expire time.Duration) (err error) {
+	now := time.Now()
+	expires := now.Add(expire).Unix()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	// like the redis set, expired worlds are gone and the expiry resets for all remaining worlds
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`DELETE FROM additional_worlds WHERE guild_id = ? AND expires <= ?`, []interface{}{guildID, now.Unix()}},
+		{`UPDATE additional_worlds SET expires = ? WHERE guild_id = ?`, []interface{}{expires, guildID}},
+		{`INSERT INTO additional_worlds (guild_id, world, expires) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, []interface{}{guildID, world, expires}},
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(s.rebind(statement.query), statement.args...); err != nil {
+			_ = tx.Rollback() // nolint: errcheck, gosec
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) GetSession(key string) (string, error) {
+	return s.queryValue(`SELECT value FROM sessions WHERE session_key = ? AND expires > ?`, key, time.Now().Unix())
+}
+
+func (s *sqlStore) SetSession(key, value string, expire time.Duration) error {
+	return s.setExpiring("sessions", "session_key", key, value, expire)
+}
+
+func (s *sqlStore) DeleteSession(key string) error {
+	return s.exec(`DELETE FROM sessions WHERE session_key = ?`, key)
+}
+
+func (s *sqlStore) GetCache(key string) (string, error) {
+	return s.queryValue(`SELECT value FROM cache WHERE cache_key = ? AND expires > ?`, key, time.Now().Unix())
+}
+
+func (s *sqlStore) SetCache(key, value string, expire time.Duration) error {
+	return s.setExpiring("cache", "cache_key", key, value, expire)
+}
+
+func (s *sqlStore) NotificationsMuted(userID string) (muted bool, err error) {
+	_, err = s.queryValue(`SELECT user_id FROM muted_users WHERE user_id = ?`, userID)
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) SetNotificationsMuted(userID string, muted bool) error {
+	if muted {
+		return s.exec(`INSERT INTO muted_users (user_id) VALUES (?) ON CONFLICT DO NOTHING`, userID)
+	}
+	return s.exec(`DELETE FROM muted_users WHERE user_id = ?`, userID)
+}
+
+func (s *sqlStore) GetLinkedWorlds(world int) (linked []int, err error) {
+	linkedString, err := s.queryValue(`SELECT linked FROM world_links WHERE world = ?`, world)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(linkedString), &linked)
+	return
+}
+
+func (s *sqlStore) SetLinkedWorlds(world int, linked []int) (err error) {
+	linkedString, err := json.Marshal(linked)
+	if err != nil {
+		return
+	}
+	return s.exec(`INSERT INTO world_links (world, linked) VALUES (?, ?)
+		ON CONFLICT (world) DO UPDATE SET linked = excluded.linked`, world, string(linkedString))
+}
+
+func (s *sqlStore) SaveWorldSnapshot(start time.Time, snapshot string) error {
+	return s.exec(`INSERT INTO world_snapshots (start, snapshot) VALUES (?, ?)
+		ON CONFLICT (start) DO UPDATE SET snapshot = excluded.snapshot`, start.Unix(), snapshot)
+}
+
+func (s *sqlStore) GetWorldSnapshots(before time.Time, limit int) ([]string, error) {
+	return s.queryStrings(`SELECT snapshot FROM world_snapshots WHERE start <= ? ORDER BY start DESC LIMIT ?`, before.Unix(), limit)
+}
+
+func (s *sqlStore) AddAuditEntry(guildID string, at time.Time, entry string, retention time.Duration) (err error) {
+	err = s.exec(`INSERT INTO audit_log (guild_id, at, entry) VALUES (?, ?, ?)`, guildID, at.UnixNano(), entry)
+	if err != nil {
+		return
+	}
+	return s.exec(`DELETE FROM audit_log WHERE guild_id = ? AND at < ?`, guildID, at.Add(-retention).UnixNano())
+}
+
+func (s *sqlStore) GetAuditEntries(guildID string, limit int) ([]string, error) {
+	return s.queryStrings(`SELECT entry FROM audit_log WHERE guild_id = ? ORDER BY at DESC LIMIT ?`, guildID, limit)
+}
+
+func (s *sqlStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errNotFound is returned by a Store when the requested key does not exist or has expired
+var errNotFound = errors.New("not found")
+
+// database holds the storage backend selected in the config
+var database Store
+
+// Store abstracts the persistence of the bot.
+// Every namespace of the redis databases in redisPool.go is represented by a group of methods.
+type Store interface {
+	// GetAPIKeys returns all api keys saved for a discord user
+	GetAPIKeys(userID string) (keys []string, err error)
+	// AddAPIKey saves an api key for a discord user. Adding an already saved key does nothing
+	AddAPIKey(userID, key string) error
+	// RemoveAPIKey removes a single api key of a discord user
+	RemoveAPIKey(userID, key string) error
+	// DeleteUser removes all api keys of a discord user
+	DeleteUser(userID string) error
+	// IterateUsers calls processValue for every discord user with saved api keys
+	IterateUsers(processValue func(string)) (count int, err error)
+
+	// GuildExists reports whether settings are saved for the discord server
+	GuildExists(guildID string) (bool, error)
+	// GetGuildSettings returns the bot settings of a discord server
+	GetGuildSettings(guildID string) (*guildOptions, error)
+	// SaveGuildSettings overwrites the bot settings of a discord server
+	SaveGuildSettings(guildID string, options *guildOptions) error
+	// IterateGuilds calls processValue for every discord server with saved settings
+	IterateGuilds(processValue func(string)) (count int, err error)
+
+	// GetManagedRoles returns all roles the bot manages on a discord server
+	GetManagedRoles(guildID string) ([]guildRole, error)
+	// AddManagedRole adds a role to the managed roles of a discord server
+	AddManagedRole(guildID string, role guildRole) error
+	// RemoveManagedRole removes a role from the managed roles of a discord server
+	RemoveManagedRole(guildID string, role guildRole) error
+
+	// GetAccountOwner returns the discord user that verified with the gw2 account
+	GetAccountOwner(accountID string) (userID string, err error)
+	// SetAccountOwner sets the discord user that verified with the gw2 account
+	SetAccountOwner(accountID, userID string) error
+
+	// GetAdditionalWorlds returns the worlds that are temporarily allowed on a discord server
+	GetAdditionalWorlds(guildID string) ([]int, error)
+	// AddAdditionalWorld allows a world on a discord server and resets the expiry of all additional worlds of that server
+	AddAdditionalWorld(guildID string, world int, expire time.Duration) error
+
+	// GetSession returns the value of a session key
+	GetSession(key string) (string, error)
+	// SetSession saves a session key that expires after the given duration
+	SetSession(key, value string, expire time.Duration) error
+	// DeleteSession removes a session key. Removing a missing key does nothing
+	DeleteSession(key string) error
+
+	// GetCache returns a cached value
+	GetCache(key string) (string, error)
+	// SetCache caches a value for the given duration
+	SetCache(key, value string, expire time.Duration) error
+
+	// NotificationsMuted reports whether the discord user turned off direct messages of the bot
+	NotificationsMuted(userID string) (bool, error)
+	// SetNotificationsMuted turns direct messages of the bot off or on for the discord user
+	SetNotificationsMuted(userID string, muted bool) error
+
+	// GetLinkedWorlds returns the worlds the world was linked with at the last world update
+	GetLinkedWorlds(world int) ([]int, error)
+	// SetLinkedWorlds saves the worlds the world is linked with
+	SetLinkedWorlds(world int, linked []int) error
+
+	// SaveWorldSnapshot saves the worlds and matches of a reset and replaces a snapshot with the same start
+	SaveWorldSnapshot(start time.Time, snapshot string) error
+	// GetWorldSnapshots returns up to limit snapshots that started at or before the time, newest first
+	GetWorldSnapshots(before time.Time, limit int) ([]string, error)
+
+	// AddAuditEntry appends an entry to the audit log of a discord server and drops entries older than retention
+	AddAuditEntry(guildID string, at time.Time, entry string, retention time.Duration) error
+	// GetAuditEntries returns up to limit entries of the audit log of a discord server, newest first
+	GetAuditEntries(guildID string, limit int) ([]string, error)
+
+	// Ping checks that the storage is reachable
+	Ping() error
+
+	// Close releases all resources held by the store
+	Close() error
+}
+
+// openStore creates the storage backend selected in the config
+func openStore() (s Store, err error) {
+	switch config.Storage {
+	case "", "redis":
+		s = newRedisStore()
+	case "memory":
+		s = newMemoryStore()
+	case "sqlite":
+		s, err = newSQLStore("sqlite3", config.SQLConnectionString)
+	case "postgres":
+		s, err = newSQLStore("postgres", config.SQLConnectionString)
+	default:
+		err = fmt.Errorf("unknown storage backend %v", config.Storage)
+	}
+	if err != nil {
+		s = nil
+	}
+	return
+}
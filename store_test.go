@@ -0,0 +1,408 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// storeBackends returns the stores every test of the Store contract runs against.
+// The redis store only runs if WVWBOT_TEST_REDIS holds the connection string of a redis server
+// whose databases may be flushed
+func storeBackends(t *testing.T) map[string]func(t *testing.T) Store {
+	backends := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return newMemoryStore()
+		},
+		"sqlite": func(t *testing.T) Store {
+			dir, err := ioutil.TempDir("", "wvwbot")
+			if err != nil {
+				t.Fatalf("creating sqlite directory: %v", err)
+			}
+			t.Cleanup(func() {
+				_ = os.RemoveAll(dir) // nolint: errcheck, gosec
+			})
+			s, err := newSQLStore("sqlite3", filepath.Join(dir, "wvwbot.db"))
+			if err != nil {
+				t.Fatalf("opening sqlite store: %v", err)
+			}
+			return s
+		},
+	}
+	if url := os.Getenv("WVWBOT_TEST_REDIS"); url != "" {
+		backends["redis"] = func(t *testing.T) Store {
+			config.RedisConnectionString = url
+			s := newRedisStore()
+			for _, pool := range []*redis.Pool{s.users, s.guilds, s.sessions, s.cache, s.guildRoles, s.uniqueUsers, s.guildVerifies, s.auditLog, s.mutedUsers, s.worldLinks, s.worldSnapshots} {
+				if _, err := s.do(pool, "FLUSHDB"); err != nil {
+					t.Fatalf("flushing redis database: %v", err)
+				}
+			}
+			return s
+		}
+	}
+	return backends
+}
+
+// runStoreTest runs the test against a new empty store of every backend
+func runStoreTest(t *testing.T, test func(t *testing.T, s Store)) {
+	for name, open := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("closing store: %v", err)
+				}
+			}()
+			test(t, s)
+		})
+	}
+}
+
+func TestStoreAPIKeys(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		steps := []struct {
+			name   string
+			do     func() error
+			user   string
+			expect []string
+		}{
+			{"empty", nil, "user", nil},
+			{"add", func() error { return s.AddAPIKey("user", "a") }, "user", []string{"a"}},
+			{"add twice", func() error { return s.AddAPIKey("user", "a") }, "user", []string{"a"}},
+			{"add second", func() error { return s.AddAPIKey("user", "b") }, "user", []string{"a", "b"}},
+			{"other user", func() error { return s.AddAPIKey("other", "c") }, "user", []string{"a", "b"}},
+			{"remove", func() error { return s.RemoveAPIKey("user", "a") }, "user", []string{"b"}},
+			{"remove missing", func() error { return s.RemoveAPIKey("user", "a") }, "user", []string{"b"}},
+			{"delete user", func() error { return s.DeleteUser("user") }, "user", nil},
+			{"other user kept", nil, "other", []string{"c"}},
+		}
+		for _, step := range steps {
+			if step.do != nil {
+				if err := step.do(); err != nil {
+					t.Fatalf("%v: %v", step.name, err)
+				}
+			}
+			keys, err := s.GetAPIKeys(step.user)
+			if err != nil {
+				t.Fatalf("%v: getting api keys: %v", step.name, err)
+			}
+			if !equalStrings(keys, step.expect) {
+				t.Errorf("%v: got api keys %v, expected %v", step.name, keys, step.expect)
+			}
+		}
+
+		var users []string
+		count, err := s.IterateUsers(func(user string) {
+			users = append(users, user)
+		})
+		if err != nil {
+			t.Fatalf("iterating users: %v", err)
+		}
+		if count != 1 || !equalStrings(users, []string{"other"}) {
+			t.Errorf("iterated %v users %v, expected only other", count, users)
+		}
+	})
+}
+
+func TestStoreGuildSettings(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if _, err := s.GetGuildSettings("guild"); err != errNotFound {
+			t.Errorf("got %v for missing guild settings, expected errNotFound", err)
+		}
+		if exists, err := s.GuildExists("guild"); err != nil || exists {
+			t.Errorf("missing guild exists: %v, %v", exists, err)
+		}
+
+		options := &guildOptions{Mode: oneServer, Gw2ServerID: 2201, RenameUsers: true}
+		if err := s.SaveGuildSettings("guild", options); err != nil {
+			t.Fatalf("saving guild settings: %v", err)
+		}
+		if exists, err := s.GuildExists("guild"); err != nil || !exists {
+			t.Errorf("saved guild does not exist: %v, %v", exists, err)
+		}
+		saved, err := s.GetGuildSettings("guild")
+		if err != nil {
+			t.Fatalf("getting guild settings: %v", err)
+		}
+		if saved.Mode != oneServer || saved.Gw2ServerID != 2201 || !saved.RenameUsers {
+			t.Errorf("got guild settings %+v, expected %+v", saved, options)
+		}
+
+		// changing the returned settings must not change the saved ones
+		saved.Gw2ServerID = 1001
+		if saved, err = s.GetGuildSettings("guild"); err != nil || saved.Gw2ServerID != 2201 {
+			t.Errorf("unsaved changes of the guild settings were kept: %+v, %v", saved, err)
+		}
+
+		count, err := s.IterateGuilds(func(string) {})
+		if err != nil || count != 1 {
+			t.Errorf("iterated %v guilds: %v, expected 1", count, err)
+		}
+	})
+}
+
+func TestStoreManagedRoles(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		verified := guildRole{ID: "1", Name: "Verified"}
+		linked := guildRole{ID: "2", Name: "Linked"}
+		for _, role := range []guildRole{verified, linked, verified} {
+			if err := s.AddManagedRole("guild", role); err != nil {
+				t.Fatalf("adding managed role %v: %v", role.ID, err)
+			}
+		}
+		if err := s.RemoveManagedRole("guild", linked); err != nil {
+			t.Fatalf("removing managed role: %v", err)
+		}
+		roles, err := s.GetManagedRoles("guild")
+		if err != nil {
+			t.Fatalf("getting managed roles: %v", err)
+		}
+		if len(roles) != 1 || roles[0] != verified {
+			t.Errorf("got managed roles %v, expected only %v", roles, verified)
+		}
+		if roles, err = s.GetManagedRoles("other"); err != nil || len(roles) != 0 {
+			t.Errorf("got managed roles %v of another guild: %v", roles, err)
+		}
+	})
+}
+
+func TestStoreRenamedManagedRoles(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		old := guildRole{ID: "1", Name: "Verified"}
+		renamed := guildRole{ID: "1", Name: "Verified Players"}
+
+		// managed roles are identified by id and name, a renamed role is a second entry
+		for _, role := range []guildRole{old, renamed} {
+			if err := s.AddManagedRole("guild", role); err != nil {
+				t.Fatalf("adding managed role %v: %v", role.Name, err)
+			}
+		}
+		roles, err := s.GetManagedRoles("guild")
+		if err != nil {
+			t.Fatalf("getting managed roles: %v", err)
+		}
+		if len(roles) != 2 {
+			t.Errorf("got managed roles %v, expected the old and the renamed role", roles)
+		}
+
+		// removing the role under its old name keeps the renamed entry
+		if err = s.RemoveManagedRole("guild", old); err != nil {
+			t.Fatalf("removing managed role: %v", err)
+		}
+		roles, err = s.GetManagedRoles("guild")
+		if err != nil {
+			t.Fatalf("getting managed roles: %v", err)
+		}
+		if len(roles) != 1 || roles[0] != renamed {
+			t.Errorf("got managed roles %v, expected only %v", roles, renamed)
+		}
+
+		if err = s.RemoveManagedRole("guild", renamed); err != nil {
+			t.Fatalf("removing managed role: %v", err)
+		}
+		if roles, err = s.GetManagedRoles("guild"); err != nil || len(roles) != 0 {
+			t.Errorf("got managed roles %v after removing every name: %v", roles, err)
+		}
+	})
+}
+
+func TestStoreAccountOwner(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		previous := database
+		database = s
+		defer func() {
+			database = previous
+		}()
+
+		steps := []struct {
+			name    string
+			user    string
+			force   bool
+			owner   string
+			errText string
+		}{
+			{"first owner", "user", false, "user", ""},
+			{"same owner", "user", false, "user", ""},
+			{"taken", "other", false, "user", AlreadyTaken},
+			{"forced", "other", true, "other", ""},
+			{"taken by the new owner", "user", false, "other", AlreadyTaken},
+		}
+
+		if _, err := s.GetAccountOwner("account"); err != errNotFound {
+			t.Errorf("got %v for a missing account owner, expected errNotFound", err)
+		}
+		for _, step := range steps {
+			owner, err := checkUnique("account", step.user, step.force)
+			if step.errText == "" && err != nil {
+				t.Errorf("%v: unexpected error %v", step.name, err)
+			}
+			if step.errText != "" && (err == nil || err.Error() != step.errText) {
+				t.Errorf("%v: got error %v, expected %v", step.name, err, step.errText)
+			}
+			if step.errText != "" && owner != step.owner {
+				t.Errorf("%v: got owner %v, expected %v", step.name, owner, step.owner)
+			}
+			saved, err := s.GetAccountOwner("account")
+			if err != nil || saved != step.owner {
+				t.Errorf("%v: saved owner is %v (%v), expected %v", step.name, saved, err, step.owner)
+			}
+		}
+	})
+}
+
+func TestStoreExpiry(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.SetCache("cached", "value", time.Second); err != nil {
+			t.Fatalf("setting cache: %v", err)
+		}
+		if err := s.SetSession("session", "value", time.Second); err != nil {
+			t.Fatalf("setting session: %v", err)
+		}
+		if err := s.SetSession("deleted", "value", time.Hour); err != nil {
+			t.Fatalf("setting session: %v", err)
+		}
+		if err := s.AddAdditionalWorld("guild", 2201, time.Second); err != nil {
+			t.Fatalf("adding additional world: %v", err)
+		}
+		if err := s.DeleteSession("deleted"); err != nil {
+			t.Fatalf("deleting session: %v", err)
+		}
+
+		getters := []struct {
+			name string
+			get  func() (string, error)
+		}{
+			{"cache", func() (string, error) { return s.GetCache("cached") }},
+			{"session", func() (string, error) { return s.GetSession("session") }},
+		}
+		for _, getter := range getters {
+			if value, err := getter.get(); err != nil || value != "value" {
+				t.Errorf("%v: got %q (%v) before the expiry", getter.name, value, err)
+			}
+		}
+		if _, err := s.GetSession("deleted"); err != errNotFound {
+			t.Errorf("got %v for a deleted session, expected errNotFound", err)
+		}
+		if worlds, err := s.GetAdditionalWorlds("guild"); err != nil || len(worlds) != 1 || worlds[0] != 2201 {
+			t.Errorf("got additional worlds %v (%v) before the expiry", worlds, err)
+		}
+
+		// expiries have a resolution of one second in redis and sql
+		time.Sleep(2100 * time.Millisecond)
+		for _, getter := range getters {
+			if _, err := getter.get(); err != errNotFound {
+				t.Errorf("%v: got %v after the expiry, expected errNotFound", getter.name, err)
+			}
+		}
+		if worlds, err := s.GetAdditionalWorlds("guild"); err != nil || len(worlds) != 0 {
+			t.Errorf("got additional worlds %v (%v) after the expiry", worlds, err)
+		}
+	})
+}
+
+func TestStoreWorlds(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if _, err := s.GetLinkedWorlds(2201); err != errNotFound {
+			t.Errorf("got %v for missing linked worlds, expected errNotFound", err)
+		}
+		if err := s.SetLinkedWorlds(2201, []int{2201, 2202}); err != nil {
+			t.Fatalf("setting linked worlds: %v", err)
+		}
+		if linked, err := s.GetLinkedWorlds(2201); err != nil || !sameWorlds(linked, []int{2201, 2202}) {
+			t.Errorf("got linked worlds %v (%v)", linked, err)
+		}
+
+		start := time.Date(2020, 1, 3, 18, 0, 0, 0, time.UTC)
+		week := 7 * 24 * time.Hour
+		snapshots := []struct {
+			start    time.Time
+			snapshot string
+		}{
+			{start.Add(week), "second"},
+			{start, "first"},
+			{start.Add(week), "second again"},
+			{start.Add(2 * week), "third"},
+		}
+		for _, snapshot := range snapshots {
+			if err := s.SaveWorldSnapshot(snapshot.start, snapshot.snapshot); err != nil {
+				t.Fatalf("saving world snapshot: %v", err)
+			}
+		}
+		got, err := s.GetWorldSnapshots(start.Add(week+time.Hour), 10)
+		if err != nil {
+			t.Fatalf("getting world snapshots: %v", err)
+		}
+		if expect := []string{"second again", "first"}; !equalOrderedStrings(got, expect) {
+			t.Errorf("got world snapshots %v, expected %v", got, expect)
+		}
+		if got, err = s.GetWorldSnapshots(start.Add(3*week), 1); err != nil || !equalOrderedStrings(got, []string{"third"}) {
+			t.Errorf("got world snapshots %v (%v), expected only third", got, err)
+		}
+	})
+}
+
+func TestStoreAuditLog(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		now := time.Now()
+		entries := []struct {
+			at    time.Time
+			entry string
+		}{
+			{now.Add(-3 * time.Hour), "old"},
+			{now.Add(-time.Minute), "first"},
+			{now, "second"},
+		}
+		for _, e := range entries {
+			if err := s.AddAuditEntry("guild", e.at, e.entry, 2*time.Hour); err != nil {
+				t.Fatalf("adding audit entry: %v", err)
+			}
+		}
+		got, err := s.GetAuditEntries("guild", 10)
+		if err != nil {
+			t.Fatalf("getting audit entries: %v", err)
+		}
+		if expect := []string{"second", "first"}; !equalOrderedStrings(got, expect) {
+			t.Errorf("got audit entries %v, expected %v", got, expect)
+		}
+	})
+}
+
+func TestStoreNotificationsMuted(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		for _, muted := range []bool{true, true, false, false} {
+			if err := s.SetNotificationsMuted("user", muted); err != nil {
+				t.Fatalf("setting muted to %v: %v", muted, err)
+			}
+			if got, err := s.NotificationsMuted("user"); err != nil || got != muted {
+				t.Errorf("got muted %v (%v), expected %v", got, err, muted)
+			}
+		}
+	})
+}
+
+// equalStrings reports whether both lists hold the same strings in any order
+func equalStrings(a, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return equalOrderedStrings(a, b)
+}
+
+func equalOrderedStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
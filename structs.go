@@ -1,8 +1,6 @@
 package main
 
-import (
-	"time"
-)
+import "time"
 
 // config is the struct for the bot internal config file
 var config struct {
@@ -12,6 +10,26 @@ var config struct {
 	// PrivateKeyPath holds a string to the path of the corresponding private key to the cert in pem format
 	PrivateKeyPath string `json:"privateKeyPath"`
 
+	// ListenAddress is the address the website is served on. It is served with tls if a certificate or autocert is configured
+	// ListenAddress is optional and defaults to :4040
+	ListenAddress string `json:"listenAddress"`
+
+	// RedirectListenAddress is the address of a plain http listener that redirects to https and answers autocert challenges
+	// RedirectListenAddress is optional, no http listener is started without it
+	RedirectListenAddress string `json:"redirectListenAddress"`
+
+	// Autocert gets certificates for the domain from let's encrypt instead of using CertificatePath and PrivateKeyPath
+	// Autocert is optional
+	Autocert bool `json:"autocert"`
+
+	// AutocertCacheDir holds the certificates of autocert
+	// AutocertCacheDir is optional and defaults to autocert
+	AutocertCacheDir string `json:"autocertCacheDir"`
+
+	// AutocertEmail is the contact for let's encrypt
+	// AutocertEmail is optional
+	AutocertEmail string `json:"autocertEmail"`
+
 	// BotToken holds the bot token generated by discord to authenticate the bot part
 	BotToken string `json:"botToken"`
 
@@ -30,13 +48,34 @@ var config struct {
 	// TemplatePath holds the path to the dashboard template to serve
 	TemplatePath string `json:"dashboard"`
 
+	// Storage selects the storage backend. One of "redis", "memory", "sqlite" or "postgres"
+	// Storage is optional and defaults to "redis"
+	Storage string `json:"storage"`
+
+	// SQLConnectionString holds the file path for sqlite or the connection string for postgres
+	// SQLConnectionString is only used with the sqlite and postgres storage
+	SQLConnectionString string `json:"sql"`
+
 	// RedisConnectionString holds the redis database connection string to authenticate with
 	RedisConnectionString string `json:"redis"`
 
+	// EncryptionKeys holds base64 encoded 32 byte keys to encrypt stored api keys with AES-GCM.
+	// The first key encrypts, all keys decrypt. Put a new key first to rotate, the old keys can be removed after the next start.
+	// EncryptionKeys is optional, the environment variable WVWBOT_ENCRYPTION_KEYS overrides it with comma separated keys
+	EncryptionKeys []string `json:"encryptionKeys"`
+
 	// RedirectURL holds the relative url where oauth requests get redirected to.
 	// This has to be identical to your settings at the discord bot settings page.
 	RedirectURL string `json:"oAuthRedirect"`
 
+	// Gw2APIURL overrides the url of the gw2 api including the version, for example to use a fake api
+	// Gw2APIURL is optional
+	Gw2APIURL string `json:"gw2ApiUrl"`
+
+	// AdminListenAddress is the address metrics and health endpoints are served on, keep it private
+	// AdminListenAddress is optional and defaults to localhost:4041
+	AdminListenAddress string `json:"adminListenAddress"`
+
 	// WebhookIDInfo writes logs to the given webhook if set up
 	// WebhookIDInfo is optional
 	WebhookIDInfo string `json:"webhookIdInfo"`
@@ -62,60 +101,19 @@ var config struct {
 	WebhookTokenError string `json:"webhookTokenError"`
 
 	Owner string `json:"owner"`
-}
-
-// gw2Account holds the data returned by the gw2 api /v2/account endpoint
-type gw2Account struct {
-	ID      string   `json:"id"`
-	Name    string   `json:"name"`
-	World   int      `json:"world"`
-	Guilds  []string `json:"guilds"`
-	Access  []string `json:"access"`
-	Created string   `json:"created"`
-
-	FractalLevel int `json:"fractal_level"`
-	DailyAP      int `json:"daily_ap"`
-	MonthlyAP    int `json:"monthly_ap"`
-	WvWRank      int `json:"wvw_rank"`
-}
 
-// worldStruct holds the world data returned by the gw2 api /v2/worlds endpoint
-type worldStruct struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	// AuditRetentionDays is how long the audit log of role changes is kept
+	// AuditRetentionDays is optional and defaults to 30
+	AuditRetentionDays int `json:"auditRetentionDays"`
 }
 
 type linkInfo struct {
 	ID     int    `json:"id"`
 	Name   string `json:"name"`
 	Linked []int  `json:"linked"`
-}
-
-type matchOverview struct {
-	ID string `json:"id"`
-
-	// nolint: megacheck
-	Worlds struct {
-		Red   int `json:"red"`
-		Blue  int `json:"blue"`
-		Green int `json:"green"`
-	} `json:"worlds"`
-
-	AllWorlds struct {
-		Red   []int `json:"red"`
-		Blue  []int `json:"blue"`
-		Green []int `json:"green"`
-	} `json:"all_worlds"`
-
-	StartTime time.Time `json:"start_time"`
-	EndTime   time.Time `json:"end_time"`
-}
-
-// tokenInfo is the struct to the gw2 api endpoint /v2/tokeninfo
-type tokenInfo struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	Permissions []string `json:"permissions"`
+	// Match and Color are empty for worlds that are not part of a match
+	Match string `json:"match,omitempty"`
+	Color string `json:"color,omitempty"`
 }
 
 type guildRole struct {
@@ -143,12 +141,63 @@ type guildOptions struct {
 	DeleteLinked bool `json:"deleteLinked"`
 	// the minimum rank required to be verified
 	MinimumRank int `json:"minimumRank"`
+	// the minimum age in days, achievement points and fractal level required to be verified
+	MinimumAccountAge   int `json:"minimumAccountAge"`
+	MinimumDailyAP      int `json:"minimumDailyAP"`
+	MinimumMonthlyAP    int `json:"minimumMonthlyAP"`
+	MinimumFractalLevel int `json:"minimumFractalLevel"`
+	// gw2 wvw team id to verify for with mode team based
+	Gw2TeamID int `json:"gw2Team"`
+	// gw2 guild ids of which the selected wvw guild is verified with mode wvw guild based
+	WvWGuildIDs []string `json:"wvwGuilds"`
+	// gw2 guild ids of which members are verified with mode guild member based
+	Gw2GuildIDs []string `json:"gw2Guilds"`
+	// give a role for the guild rank with mode guild member based, the ranks are looked up with Gw2AccountKey
+	GuildRankRoles bool `json:"guildRankRoles"`
+	// discord channel id the audit log of role changes is sent to
+	AuditChannelID string `json:"auditChannel"`
+	// discord role ids of the verified and linked role. Roles are found by name and bound here if empty
+	VerifiedRoleID string `json:"verifiedRole"`
+	LinkedRoleID   string `json:"linkedRole"`
+	// discord role ids of the world and team roles by world or team id
+	WorldRoleIDs map[int]string `json:"worldRoles"`
+	// discord role ids of the guild rank roles by rank name
+	GuildRankRoleIDs map[string]string `json:"guildRankRoleIds"`
+	// names of new roles, {world} is replaced with the world or team name
+	VerifiedRoleName string `json:"verifiedRoleName"`
+	LinkedRoleName   string `json:"linkedRoleName"`
+	WorldRoleName    string `json:"worldRoleName"`
+	// nickname of renamed users, see nicknamePlaceholders
+	NicknameTemplate string `json:"nicknameTemplate"`
+	// which accounts are shown in the nickname of users with several api keys
+	NicknameAccount nicknameAccount `json:"nicknameAccount"`
+	// discord role id of members that keep their nickname
+	NicknameExemptRoleID string `json:"nicknameExemptRole"`
+	// roles for wvw rank tiers, sorted by minimum rank
+	RankRoles []rankRole `json:"rankRoles"`
+	// free to play accounts are ignored for verification
+	RefuseFreeToPlay bool `json:"refuseFreeToPlay"`
+	// roles for the game and expansion access of the accounts
+	AccessRoles []accessRole `json:"accessRoles"`
+	// give members without verified roles the unverified role
+	GiveUnverifiedRole bool   `json:"giveUnverifiedRole"`
+	UnverifiedRoleID   string `json:"unverifiedRole"`
+	UnverifiedRoleName string `json:"unverifiedRoleName"`
+	// discord channel id of the verification message with the add key button
+	VerificationChannelID string `json:"verificationChannel"`
+	// days roles are kept after an api key stopped working
+	RevokedKeyGracePeriod int `json:"revokedKeyGracePeriod"`
+	// scheduled updates only remove roles after this many consecutive updates planned the removal
+	// and after the removal was planned for RemovalGracePeriod hours
+	RemovalConfirmations int `json:"removalConfirmations"`
+	RemovalGracePeriod   int `json:"removalGracePeriod"`
 }
 
 // dashboardTemplate holds all infos about a discord servers bot settings and options
 type dashboardTemplate struct {
 	DiscordServers []serversTemplate `json:"discordServers"`
 	Gw2Servers     []serversTemplate `json:"gw2Servers"`
+	Gw2Teams       []serversTemplate `json:"gw2Teams"`
 	Accounts       []accountTemplate `json:"accounts"`
 	Mode           mode              `json:"mode"`
 	RenameUsers    bool              `json:"renameUsers"`
@@ -157,6 +206,99 @@ type dashboardTemplate struct {
 	VerifyOnly     bool              `json:"verifyOnly"`
 	DeleteLinked   bool              `json:"deleteLinked"`
 	MinimumRank    int               `json:"minimumRank"`
+	// MinimumAccountAge is in days
+	MinimumAccountAge   int `json:"minimumAccountAge"`
+	MinimumDailyAP      int `json:"minimumDailyAP"`
+	MinimumMonthlyAP    int `json:"minimumMonthlyAP"`
+	MinimumFractalLevel int `json:"minimumFractalLevel"`
+	// RevokedKeyGracePeriod is in days
+	RevokedKeyGracePeriod int `json:"revokedKeyGracePeriod"`
+	RemovalConfirmations  int `json:"removalConfirmations"`
+	// RemovalGracePeriod is in hours
+	RemovalGracePeriod int `json:"removalGracePeriod"`
+
+	WvWGuilds      string            `json:"wvwGuilds"`
+	Gw2Guilds      string            `json:"gw2Guilds"`
+	GuildRankRoles bool              `json:"guildRankRoles"`
+	AuditChannels  []serversTemplate `json:"auditChannels"`
+	AuditLog       []string          `json:"auditLog"`
+	CSRFToken      string            `json:"-"`
+	// VerifiedRoles and LinkedRoles are the roles that can be chosen, the active one is bound
+	VerifiedRoles    []serversTemplate `json:"verifiedRoles"`
+	LinkedRoles      []serversTemplate `json:"linkedRoles"`
+	VerifiedRoleName string            `json:"verifiedRoleName"`
+	LinkedRoleName   string            `json:"linkedRoleName"`
+	WorldRoleName    string            `json:"worldRoleName"`
+	NicknameTemplate string            `json:"nicknameTemplate"`
+	NicknameAccount  nicknameAccount   `json:"nicknameAccount"`
+	// NicknameExemptRoles are the roles that can be chosen to keep nicknames
+	NicknameExemptRoles []serversTemplate `json:"nicknameExemptRoles"`
+	// RankRoles are the rank tiers followed by empty rows for new tiers
+	RankRoles        []rankRoleTemplate `json:"rankRoles"`
+	RefuseFreeToPlay bool               `json:"refuseFreeToPlay"`
+	// AccessRoles are the access roles followed by empty rows for the remaining access choices
+	AccessRoles        []accessRoleTemplate `json:"accessRoles"`
+	GiveUnverifiedRole bool                 `json:"giveUnverifiedRole"`
+	UnverifiedRoles    []serversTemplate    `json:"unverifiedRoles"`
+	UnverifiedRoleName string               `json:"unverifiedRoleName"`
+	// VerificationChannels are the text channels that can be chosen for the verification message
+	VerificationChannels []serversTemplate `json:"verificationChannels"`
+}
+
+// rankRoleTemplate holds a rank tier for the dashboard
+type rankRoleTemplate struct {
+	// MinimumRank is empty for new tiers
+	MinimumRank string            `json:"minimumRank"`
+	Name        string            `json:"name"`
+	Roles       []serversTemplate `json:"roles"`
+}
+
+// accessRoleTemplate holds an access role for the dashboard
+type accessRoleTemplate struct {
+	// Accesses are the access choices, none is active for new rows
+	Accesses []serversTemplate `json:"accesses"`
+	Name     string            `json:"name"`
+	Roles    []serversTemplate `json:"roles"`
+}
+
+// previewTemplate holds the changes of a plan for the dashboard preview
+type previewTemplate struct {
+	CSRFToken string                  `json:"-"`
+	GuildID   string                  `json:"guildId"`
+	PlanID    string                  `json:"planId"`
+	NewRoles  []string                `json:"newRoles"`
+	Members   []memberPreviewTemplate `json:"members"`
+	// Pending is set while the plan is computed
+	Pending bool `json:"pending"`
+}
+
+// memberPreviewTemplate holds the changes of a single member for the dashboard preview
+type memberPreviewTemplate struct {
+	Name     string   `json:"name"`
+	Add      []string `json:"add"`
+	Remove   []string `json:"remove"`
+	Nickname string   `json:"nickname"`
+}
+
+// linkHistoryTemplate holds the matchups of the link history page
+type linkHistoryTemplate struct {
+	Date      string
+	Snapshots []snapshotTemplate
+}
+
+// snapshotTemplate holds the matches of a world snapshot for the link history page
+type snapshotTemplate struct {
+	Start   string
+	End     string
+	Matches []matchTemplate
+}
+
+// matchTemplate holds the world names of a match by color
+type matchTemplate struct {
+	ID    string
+	Red   string
+	Blue  string
+	Green string
 }
 
 // serversTemplate holds infos about gw2 or discord servers
@@ -164,7 +306,6 @@ type serversTemplate struct {
 	ID     string `json:"id"`
 	Name   string `json:"name"`
 	Active bool   `json:"active"`
-	State  string `json:"state"`
 }
 
 // accountTemplate holds infos about gw2 account data
@@ -182,6 +323,10 @@ const (
 	allServers
 	oneServer
 	userBased
+	oneTeam
+	allTeams
+	wvwGuild
+	guildMember
 )
 
 type authReason int
@@ -194,6 +339,7 @@ const (
 	useDashboard
 )
 
+// oauthState is the pending action of a login with discord, it stays on the server until the callback
 type oauthState struct {
 	Reason authReason `json:"reason"`
 	Data   string     `json:"data"`
@@ -202,12 +348,34 @@ type oauthState struct {
 type worldWithRank struct {
 	ID   int
 	rank int
+	// Team is the wvw team of the account since the world restructuring
+	Team int
+	// WvWGuild is the id of the selected wvw guild of the account
+	WvWGuild string
+	// Account is the gw2 account name
+	Account string
+	// Guilds are the ids of all gw2 guilds the account is a member of
+	Guilds []string
+	// Access lists the game and expansions the account owns
+	Access []string
+	// FreeToPlay is set for free to play accounts that were never upgraded
+	FreeToPlay bool
+	// Created is zero if the creation date is unknown
+	Created      time.Time
+	DailyAP      int
+	MonthlyAP    int
+	FractalLevel int
+	// MissingProgression is set if the api key lacks the progression permission, the ap and the fractal level are 0 without it
+	MissingProgression bool
+	// Checked is when the data was received from the gw2 api, older data stands in for failed requests
+	Checked time.Time
 }
 
 type gw2AccountData struct {
 	Name   string
 	Worlds []worldWithRank
+	// Revoked is set if one of the api keys is not valid anymore
+	Revoked bool
+	// RevokedSince is the earliest time one of the api keys stopped working
+	RevokedSince time.Time
 }
-
-// TODO:
-//   - delete linked / saving worlds
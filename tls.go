@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/greaka/discordwvwbot/loglevels"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// defaultListenAddress is used if config.ListenAddress is not set
+	defaultListenAddress = ":4040"
+
+	// defaultAutocertCacheDir is used if config.AutocertCacheDir is not set
+	defaultAutocertCacheDir = "autocert"
+
+	// certCheckInterval is how often the certificate files are checked for renewed certificates
+	certCheckInterval = time.Minute
+)
+
+// certReloader serves the certificate of the configured files and reloads it when the files change
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (c *certReloader, err error) {
+	c = &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		checked:  time.Now(),
+	}
+	err = c.reload()
+	if err == nil && c.cert == nil {
+		err = errors.New("no certificate loaded")
+	}
+	return
+}
+
+// GetCertificate returns the current certificate, it is used as tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) > certCheckInterval {
+		c.checked = time.Now()
+		if err := c.reload(); err != nil {
+			// keep serving the old certificate until the files are fixed
+			loglevels.Errorf("Error reloading certificate: %v\n", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate if one of the files changed since the last load
+func (c *certReloader) reload() (err error) {
+	var modTime time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		info, erro := os.Stat(path)
+		if erro != nil {
+			return erro
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if !modTime.After(c.modTime) {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return
+	}
+	if c.cert != nil {
+		loglevels.Info("Loaded renewed certificate")
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return
+}
+
+// newTLSConfig returns the tls config of the https listener and the handler of the http listener.
+// tlsConfig is nil if neither a certificate nor autocert is configured
+func newTLSConfig() (tlsConfig *tls.Config, httpHandler http.Handler, err error) {
+	httpHandler = http.HandlerFunc(redirectToTLS)
+
+	if config.Autocert {
+		var host *url.URL
+		host, err = url.Parse(config.HostURL)
+		if err != nil || host.Hostname() == "" {
+			err = errors.New("autocert needs the domain in the config")
+			return
+		}
+		cacheDir := config.AutocertCacheDir
+		if cacheDir == "" {
+			cacheDir = defaultAutocertCacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(host.Hostname()),
+			Email:      config.AutocertEmail,
+		}
+		// answers http challenges and redirects everything else
+		return manager.TLSConfig(), manager.HTTPHandler(httpHandler), nil
+	}
+
+	if config.CertificatePath == "" || config.PrivateKeyPath == "" {
+		return
+	}
+	reloader, err := newCertReloader(config.CertificatePath, config.PrivateKeyPath)
+	if err != nil {
+		return
+	}
+	tlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	return
+}
+
+// listenAddress returns the address of the https listener
+func listenAddress() string {
+	if config.ListenAddress != "" {
+		return config.ListenAddress
+	}
+	return defaultListenAddress
+}
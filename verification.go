@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// custom ids of the button of the verification message, the modal it opens and the key input of the modal
+	addKeyButtonID = "wvw-addkey"
+	addKeyModalID  = "wvw-addkey-modal"
+	addKeyInputID  = "key"
+
+	// verificationMessageSearch is the number of latest messages searched for the verification message
+	verificationMessageSearch = 50
+)
+
+// verificationInstructions describes how to verify on the discord server
+func verificationInstructions(options *guildOptions) string {
+	text := "**Verify your Guild Wars 2 account**\n" +
+		"Press the button below and enter an api key from https://account.guildwars2.com/applications. " +
+		"The key needs the `account` and `progression` permissions and has to include `wvwbot` in its name. " +
+		"Nobody else can see your key.\n\n"
+
+	linked := ""
+	if options.AllowLinked {
+		linked = " and its linked worlds"
+	}
+	switch options.Mode {
+	case allServers:
+		text += "Everyone gets the role of their world."
+	case oneServer, oneTeam:
+		text += fmt.Sprintf("Players of %v%v get verified.", options.verifyWorldName(), linked)
+	case userBased:
+		text += "Players of the world of this server get verified."
+	case allTeams:
+		text += "Everyone gets the role of their team."
+	case wvwGuild:
+		text += "Players that chose a guild of this server as their wvw guild get verified."
+	case guildMember:
+		text += "Members of the guilds of this server get verified."
+	}
+
+	var requirements []string
+	for _, r := range []struct {
+		minimum int
+		format  string
+	}{
+		{options.MinimumRank, "wvw rank %v"},
+		{options.MinimumAccountAge, "an account age of %v days"},
+		{options.MinimumDailyAP, "%v daily achievement points"},
+		{options.MinimumMonthlyAP, "%v monthly achievement points"},
+		{options.MinimumFractalLevel, "fractal level %v"},
+	} {
+		if r.minimum > 0 {
+			requirements = append(requirements, fmt.Sprintf(r.format, r.minimum))
+		}
+	}
+	if len(requirements) > 0 {
+		text += "\nYour account needs at least " + strings.Join(requirements, ", ") + "."
+	}
+	if options.RefuseFreeToPlay {
+		text += "\nFree to play accounts are not verified."
+	}
+	return text
+}
+
+// addKeyButton is the button below the verification message
+var addKeyButton = []discordgo.MessageComponent{discordgo.ActionsRow{
+	Components: []discordgo.MessageComponent{discordgo.Button{
+		Label:    "Add API key",
+		Style:    discordgo.PrimaryButton,
+		CustomID: addKeyButtonID,
+	}},
+}}
+
+// addKeyModal asks for the api key after the button was pressed
+var addKeyModal = &discordgo.InteractionResponse{
+	Type: discordgo.InteractionResponseModal,
+	Data: &discordgo.InteractionResponseData{
+		CustomID: addKeyModalID,
+		Title:    "Add API key",
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{discordgo.TextInput{
+				CustomID:  addKeyInputID,
+				Label:     "Gw2 api key with wvwbot in its name",
+				Style:     discordgo.TextInputShort,
+				Required:  true,
+				MaxLength: 100,
+			}},
+		}},
+	},
+}
+
+// modalValue returns the value of the text input of a submitted modal
+func modalValue(data discordgo.ModalSubmitInteractionData, customID string) string {
+	for _, component := range data.Components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, c := range row.Components {
+			if input, ok := c.(*discordgo.TextInput); ok && input.CustomID == customID {
+				return strings.TrimSpace(input.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// findVerificationMessages returns the latest messages of the bot with the add key button in the channel
+func findVerificationMessages(channelID string) (messages []*discordgo.Message, err error) {
+	latest, err := dg.ChannelMessages(channelID, verificationMessageSearch, "", "", "")
+	if err != nil {
+		return
+	}
+	for _, message := range latest {
+		if message.Author == nil || message.Author.ID != dg.State.User.ID {
+			continue
+		}
+		for _, component := range message.Components {
+			row, ok := component.(*discordgo.ActionsRow)
+			if !ok {
+				continue
+			}
+			for _, c := range row.Components {
+				if button, ok := c.(*discordgo.Button); ok && button.CustomID == addKeyButtonID {
+					messages = append(messages, message)
+				}
+			}
+		}
+	}
+	return
+}
+
+// updateVerificationMessage posts the verification message in the verification channel or edits the existing one.
+// The messages in the previous verification channel are deleted
+func updateVerificationMessage(guildID, previousChannelID string) {
+	options, err := getGuildSettings(guildID)
+	if err != nil {
+		return
+	}
+
+	if previousChannelID != "" && previousChannelID != options.VerificationChannelID {
+		messages, erro := findVerificationMessages(previousChannelID)
+		if erro != nil {
+			loglevels.Warningf("Error getting messages of the previous verification channel %v of guild %v: %v\n", previousChannelID, guildID, erro)
+		}
+		for _, message := range messages {
+			_ = dg.ChannelMessageDelete(previousChannelID, message.ID) // nolint: errcheck, gosec
+		}
+	}
+	if options.VerificationChannelID == "" {
+		return
+	}
+
+	content := verificationInstructions(options)
+	messages, err := findVerificationMessages(options.VerificationChannelID)
+	if err != nil {
+		loglevels.Warningf("Error getting messages of the verification channel %v of guild %v: %v\n", options.VerificationChannelID, guildID, err)
+		return
+	}
+	if len(messages) == 0 {
+		_, err = dg.ChannelMessageSendComplex(options.VerificationChannelID, &discordgo.MessageSend{
+			Content:    content,
+			Components: addKeyButton,
+		})
+	} else if messages[0].Content != content {
+		_, err = dg.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:         messages[0].ID,
+			Channel:    options.VerificationChannelID,
+			Content:    &content,
+			Components: &addKeyButton,
+		})
+	}
+	if err != nil {
+		loglevels.Warningf("Error updating the verification message in channel %v of guild %v: %v\n", options.VerificationChannelID, guildID, err)
+	}
+}
+
+// updateVerificationMessages updates the verification messages of every discord server, the world names change with the matchups
+func updateVerificationMessages() {
+	dg.State.RLock()
+	guildIDs := make([]string, 0, len(dg.State.Guilds))
+	for _, guild := range dg.State.Guilds {
+		guildIDs = append(guildIDs, guild.ID)
+	}
+	dg.State.RUnlock()
+
+	for _, guildID := range guildIDs {
+		updateVerificationMessage(guildID, "")
+	}
+}
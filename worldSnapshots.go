@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+	"github.com/greaka/discordwvwbot/loglevels"
+)
+
+const (
+	// linkHistoryLimit is the number of snapshots on the link history page
+	linkHistoryLimit = 12
+
+	// snapshotDateFormat is how dates are entered in the links command and on the link history page
+	snapshotDateFormat = "2006-01-02"
+
+	// snapshotTimeFormat is how the start and end of snapshots are shown
+	snapshotTimeFormat = "2006-01-02 15:04 MST"
+)
+
+// worldSnapshot holds the matches and links of the worlds from a reset until the next one.
+// Both regions reset at different times, so every reset starts a new snapshot
+type worldSnapshot struct {
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Matches []matchSnapshot `json:"matches"`
+	// Worlds are the worlds and teams with their names, links, match and color
+	Worlds []*linkInfo `json:"worlds"`
+}
+
+// matchSnapshot holds the worlds or teams of a match by color
+type matchSnapshot struct {
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Red   []int     `json:"red"`
+	Blue  []int     `json:"blue"`
+	Green []int     `json:"green"`
+}
+
+// saveWorldSnapshot saves the matches and links of the last world update.
+// The snapshot starts with the latest match start and ends with the next match end
+func saveWorldSnapshot(matches []gw2api.MatchOverview, links map[int]*linkInfo) {
+	if len(matches) == 0 {
+		return
+	}
+
+	var snapshot worldSnapshot
+	for _, match := range matches {
+		if match.StartTime.After(snapshot.Start) {
+			snapshot.Start = match.StartTime
+		}
+		if snapshot.End.IsZero() || match.EndTime.Before(snapshot.End) {
+			snapshot.End = match.EndTime
+		}
+		snapshot.Matches = append(snapshot.Matches, matchSnapshot{
+			ID:    match.ID,
+			Start: match.StartTime,
+			End:   match.EndTime,
+			Red:   match.AllWorlds.Red,
+			Blue:  match.AllWorlds.Blue,
+			Green: match.AllWorlds.Green,
+		})
+	}
+	sort.Slice(snapshot.Matches, func(i, j int) bool {
+		return snapshot.Matches[i].ID < snapshot.Matches[j].ID
+	})
+	for _, world := range links {
+		snapshot.Worlds = append(snapshot.Worlds, world)
+	}
+	sort.Slice(snapshot.Worlds, func(i, j int) bool {
+		return snapshot.Worlds[i].ID < snapshot.Worlds[j].ID
+	})
+
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		loglevels.Errorf("Error marshaling world snapshot: %v\n", err)
+		return
+	}
+	if err = database.SaveWorldSnapshot(snapshot.Start, string(value)); err != nil {
+		loglevels.Errorf("Error saving world snapshot: %v\n", err)
+	}
+}
+
+// getWorldSnapshots returns up to limit snapshots that started at or before the time, newest first
+func getWorldSnapshots(before time.Time, limit int) (snapshots []worldSnapshot, err error) {
+	values, err := database.GetWorldSnapshots(before, limit)
+	if err != nil {
+		loglevels.Errorf("Error getting world snapshots: %v\n", err)
+		return
+	}
+	for _, value := range values {
+		var snapshot worldSnapshot
+		if erro := json.Unmarshal([]byte(value), &snapshot); erro != nil {
+			loglevels.Warningf("Error unmarshaling world snapshot: %v\n", erro)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return
+}
+
+// loadWorldSnapshot uses the links of the latest snapshot until the gw2 api answers.
+// A snapshot that ended already is skipped, the links changed with the reset
+func loadWorldSnapshot() {
+	snapshots, err := getWorldSnapshots(time.Now(), 1)
+	if err != nil || len(snapshots) == 0 {
+		return
+	}
+	if snapshots[0].End.Before(time.Now()) {
+		loglevels.Infof("Skipped the world snapshot from %v, it ended at %v", snapshots[0].Start.UTC().Format(snapshotTimeFormat), snapshots[0].End.UTC().Format(snapshotTimeFormat))
+		return
+	}
+	links := make(map[int]*linkInfo, len(snapshots[0].Worlds))
+	for _, world := range snapshots[0].Worlds {
+		links[world.ID] = world
+	}
+	currentWorlds = links
+	loglevels.Infof("Loaded the links of the world snapshot from %v", snapshots[0].Start.UTC().Format(snapshotTimeFormat))
+}
+
+// parseSnapshotDate returns the end of the day of the date, or now if the date is empty
+func parseSnapshotDate(date string) (t time.Time, err error) {
+	if date == "" {
+		return time.Now(), nil
+	}
+	t, err = time.Parse(snapshotDateFormat, date)
+	if err != nil {
+		return t, fmt.Errorf("the date has to look like %v", snapshotDateFormat)
+	}
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+// world returns the world or team of the snapshot, it is nil if the world was not known then
+func (s worldSnapshot) world(id int) *linkInfo {
+	for _, world := range s.Worlds {
+		if world.ID == id {
+			return world
+		}
+	}
+	return nil
+}
+
+// worldNames lists the names the worlds had in the snapshot
+func (s worldSnapshot) worldNames(ids []int) string {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if world := s.world(id); world != nil && world.Name != "" {
+			names = append(names, world.Name)
+		} else {
+			names = append(names, getWorldName(id))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// describe lists the matches of the snapshot in one line each, the links of the world come first if it is known
+func (s worldSnapshot) describe(world int) (lines []string) {
+	lines = append(lines, fmt.Sprintf("Matchups from %v to %v:", s.Start.UTC().Format(snapshotTimeFormat), s.End.UTC().Format(snapshotTimeFormat)))
+	if w := s.world(world); w != nil && w.Match != "" {
+		line := fmt.Sprintf("**%v** was %v in match %v", s.worldNames([]int{world}), w.Color, w.Match)
+		var linked []int
+		for _, id := range w.Linked {
+			if id != world {
+				linked = append(linked, id)
+			}
+		}
+		if len(linked) > 0 {
+			line += " linked with " + s.worldNames(linked)
+		}
+		lines = append(lines, line)
+	}
+	for _, match := range s.Matches {
+		lines = append(lines, fmt.Sprintf("`%v` red: %v | blue: %v | green: %v", match.ID, s.worldNames(match.Red), s.worldNames(match.Blue), s.worldNames(match.Green)))
+	}
+	return
+}
+
+// commandLinks shows the matchups at the date, or the current ones
+func commandLinks(m *commandContext, date string) {
+	before, err := parseSnapshotDate(date)
+	if err != nil {
+		sendErrorMes(m, err.Error())
+		return
+	}
+	snapshots, err := getWorldSnapshots(before, 1)
+	if err != nil {
+		sendError(m)
+		return
+	}
+	if len(snapshots) == 0 {
+		sendErrorMes(m, "there are no known matchups at this date.")
+		return
+	}
+
+	world := 0
+	if m.GuildID != "" {
+		if options, erro := getGuildSettings(m.GuildID); erro == nil {
+			world = options.verifyWorld(context.Background())
+		}
+	}
+	erro := replyMessages(m, snapshots[0].describe(world))
+	if erro != nil {
+		loglevels.Errorf("Failed to send links to user %v: %v", m.Author.ID, erro)
+	}
+}
+
+// handleLinkHistory shows the latest matchups until the date of the form, or until now
+func handleLinkHistory(w http.ResponseWriter, r *http.Request) {
+	addHeaders(w, r)
+
+	date := r.FormValue("date")
+	before, err := parseSnapshotDate(date)
+	if err != nil {
+		writeToResponse(w, "%v", err)
+		return
+	}
+	snapshots, err := getWorldSnapshots(before, linkHistoryLimit)
+	if err != nil {
+		writeToResponse(w, "Internal error, please try again or contact me.")
+		return
+	}
+
+	history := linkHistoryTemplate{Date: date}
+	for _, snapshot := range snapshots {
+		st := snapshotTemplate{
+			Start: snapshot.Start.UTC().Format(snapshotTimeFormat),
+			End:   snapshot.End.UTC().Format(snapshotTimeFormat),
+		}
+		for _, match := range snapshot.Matches {
+			st.Matches = append(st.Matches, matchTemplate{
+				ID:    match.ID,
+				Red:   snapshot.worldNames(match.Red),
+				Blue:  snapshot.worldNames(match.Blue),
+				Green: snapshot.worldNames(match.Green),
+			})
+		}
+		history.Snapshots = append(history.Snapshots, st)
+	}
+
+	err = dbTemplate.ExecuteTemplate(w, "links", history)
+	if err != nil {
+		loglevels.Errorf("Error executing link history template: %v\n", err)
+		writeToResponse(w, "Internal error, please try again or contact me.")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/greaka/discordwvwbot/gw2api"
+)
+
+// newMatchOverview returns a match of the worlds by color
+func newMatchOverview(id string, start, end time.Time, red, blue, green []int) (match gw2api.MatchOverview) {
+	match.ID = id
+	match.StartTime = start
+	match.EndTime = end
+	match.AllWorlds.Red = red
+	match.AllWorlds.Blue = blue
+	match.AllWorlds.Green = green
+	return
+}
+
+func TestWorldSnapshotRoundTrip(t *testing.T) {
+	previousDatabase := database
+	defer func() { database = previousDatabase }()
+	database = newMemoryStore()
+
+	reset := time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC)
+	matches := []gw2api.MatchOverview{
+		newMatchOverview("2-1", reset, reset.Add(7*24*time.Hour), []int{2001, 2002}, []int{2003}, []int{2004}),
+		newMatchOverview("1-1", reset.Add(-7*time.Hour), reset.Add(7*24*time.Hour-7*time.Hour), []int{1001}, []int{1002}, []int{1003}),
+	}
+	links := map[int]*linkInfo{
+		2002: {ID: 2002, Name: "Second", Linked: []int{2001, 2002}, Match: "2-1", Color: "red"},
+		2001: {ID: 2001, Name: "First", Linked: []int{2001, 2002}, Match: "2-1", Color: "red"},
+	}
+	saveWorldSnapshot(matches, links)
+	saveWorldSnapshot(nil, links)
+
+	snapshots, err := getWorldSnapshots(reset.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatalf("getting snapshots: %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("got %v snapshots, expected 1", len(snapshots))
+	}
+	snapshot := snapshots[0]
+	if !snapshot.Start.Equal(reset) {
+		t.Errorf("got start %v, expected the latest match start %v", snapshot.Start, reset)
+	}
+	if expected := reset.Add(7*24*time.Hour - 7*time.Hour); !snapshot.End.Equal(expected) {
+		t.Errorf("got end %v, expected the next match end %v", snapshot.End, expected)
+	}
+	if len(snapshot.Matches) != 2 || snapshot.Matches[0].ID != "1-1" || snapshot.Matches[1].ID != "2-1" {
+		t.Errorf("got matches %+v, expected 1-1 and 2-1 in order", snapshot.Matches)
+	}
+	if len(snapshot.Worlds) != 2 || snapshot.Worlds[0].ID != 2001 || snapshot.Worlds[1].Name != "Second" {
+		t.Errorf("got worlds %+v, expected First and Second in order", snapshot.Worlds)
+	}
+
+	snapshots, err = getWorldSnapshots(reset.Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatalf("getting snapshots: %v", err)
+	}
+	if len(snapshots) != 0 {
+		t.Errorf("got %v snapshots before the start, expected none", len(snapshots))
+	}
+}
+
+func TestLoadWorldSnapshot(t *testing.T) {
+	previousDatabase, previousWorlds := database, currentWorlds
+	defer func() { database, currentWorlds = previousDatabase, previousWorlds }()
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		end    time.Time
+		loaded bool
+	}{
+		{"current snapshot", now.Add(time.Hour), true},
+		{"stale snapshot", now.Add(-time.Hour), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database = newMemoryStore()
+			currentWorlds = nil
+			matches := []gw2api.MatchOverview{
+				newMatchOverview("1-1", now.Add(-24*time.Hour), test.end, []int{1001}, []int{1002}, []int{1003}),
+			}
+			saveWorldSnapshot(matches, map[int]*linkInfo{1001: {ID: 1001, Name: "World"}})
+
+			loadWorldSnapshot()
+			if loaded := currentWorlds[1001] != nil; loaded != test.loaded {
+				t.Errorf("got loaded %v, expected %v", loaded, test.loaded)
+			}
+		})
+	}
+}
+
+func TestParseSnapshotDate(t *testing.T) {
+	before := time.Now()
+	now, err := parseSnapshotDate("")
+	if err != nil {
+		t.Fatalf("parsing an empty date: %v", err)
+	}
+	if now.Before(before) || now.After(time.Now()) {
+		t.Errorf("got %v for an empty date, expected now", now)
+	}
+
+	date, err := parseSnapshotDate("2020-05-01")
+	if err != nil {
+		t.Fatalf("parsing a date: %v", err)
+	}
+	if expected := time.Date(2020, 5, 1, 23, 59, 59, 0, time.UTC); !date.Equal(expected) {
+		t.Errorf("got %v, expected the end of the day %v", date, expected)
+	}
+
+	for _, invalid := range []string{"01.05.2020", "2020-5-1", "tomorrow"} {
+		if _, err = parseSnapshotDate(invalid); err == nil {
+			t.Errorf("parsing %q: expected an error", invalid)
+		}
+	}
+}
+
+func TestWorldSnapshotDescribe(t *testing.T) {
+	previousWorlds := currentWorlds
+	defer func() { currentWorlds = previousWorlds }()
+	currentWorlds = nil
+
+	start := time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC)
+	snapshot := worldSnapshot{
+		Start: start,
+		End:   start.Add(7 * 24 * time.Hour),
+		Matches: []matchSnapshot{
+			{ID: "2-1", Red: []int{2001, 2002}, Blue: []int{2003}, Green: []int{2004}},
+		},
+		Worlds: []*linkInfo{
+			{ID: 2001, Name: "First", Linked: []int{2001, 2002}, Match: "2-1", Color: "red"},
+			{ID: 2002, Name: "Second", Linked: []int{2001, 2002}, Match: "2-1", Color: "red"},
+			{ID: 2003, Name: "Third", Linked: []int{2003}, Match: "2-1", Color: "blue"},
+		},
+	}
+
+	header := "Matchups from 2020-05-01 18:00 UTC to 2020-05-08 18:00 UTC:"
+	match := "`2-1` red: First, Second | blue: Third | green: 2004"
+	tests := []struct {
+		name  string
+		world int
+		lines []string
+	}{
+		{"unknown world", 0, []string{header, match}},
+		{"linked world", 2001, []string{header, "**First** was red in match 2-1 linked with Second", match}},
+		{"world without links", 2003, []string{header, "**Third** was blue in match 2-1", match}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if lines := snapshot.describe(test.world); !equalOrderedStrings(lines, test.lines) {
+				t.Errorf("got %q, expected %q", lines, test.lines)
+			}
+		})
+	}
+}